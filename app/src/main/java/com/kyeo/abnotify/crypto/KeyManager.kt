@@ -1,10 +1,17 @@
 package com.kyeo.abnotify.crypto
 
 import android.content.Context
+import android.security.keystore.KeyGenParameterSpec
+import android.security.keystore.KeyProperties
 import android.util.Base64
 import androidx.security.crypto.EncryptedSharedPreferences
 import androidx.security.crypto.MasterKey
+import java.security.KeyPairGenerator
+import java.security.KeyStore
+import java.security.PrivateKey
+import java.security.PublicKey
 import java.security.SecureRandom
+import java.security.Signature
 
 class KeyManager(private val context: Context) {
 
@@ -27,6 +34,56 @@ class KeyManager(private val context: Context) {
         if (getDeviceKey() == null) {
             generateDeviceKey()
         }
+        if (getPublicKey() == null) {
+            generateKeyPair()
+        }
+    }
+
+    /**
+     * Generate the RSA key pair proving this device owns its device key.
+     * The private key never leaves the Android Keystore.
+     */
+    private fun generateKeyPair() {
+        val generator = KeyPairGenerator.getInstance(KeyProperties.KEY_ALGORITHM_RSA, ANDROID_KEYSTORE)
+        generator.initialize(
+            KeyGenParameterSpec.Builder(
+                KEY_ALIAS,
+                KeyProperties.PURPOSE_SIGN or KeyProperties.PURPOSE_DECRYPT
+            )
+                .setKeySize(2048)
+                .setDigests(KeyProperties.DIGEST_SHA256)
+                .setSignaturePaddings(KeyProperties.SIGNATURE_PADDING_RSA_PKCS1)
+                .setEncryptionPaddings(KeyProperties.ENCRYPTION_PADDING_RSA_OAEP)
+                .build()
+        )
+        generator.generateKeyPair()
+    }
+
+    private fun keyStore(): KeyStore = KeyStore.getInstance(ANDROID_KEYSTORE).apply { load(null) }
+
+    private fun getPublicKey(): PublicKey? = keyStore().getCertificate(KEY_ALIAS)?.publicKey
+
+    private fun getPrivateKey(): PrivateKey? = keyStore().getKey(KEY_ALIAS, null) as? PrivateKey
+
+    /**
+     * Public key in PEM format, uploaded when registering
+     */
+    fun getPublicKeyPem(): String? {
+        val encoded = getPublicKey()?.encoded ?: return null
+        val body = Base64.encodeToString(encoded, Base64.NO_WRAP).chunked(64).joinToString("\n")
+        return "-----BEGIN PUBLIC KEY-----\n$body\n-----END PUBLIC KEY-----\n"
+    }
+
+    /**
+     * Sign data with SHA256withRSA, returns the Base64 signature
+     */
+    fun sign(data: ByteArray): String? {
+        val privateKey = getPrivateKey() ?: return null
+        val signature = Signature.getInstance("SHA256withRSA").apply {
+            initSign(privateKey)
+            update(data)
+        }
+        return Base64.encodeToString(signature.sign(), Base64.NO_WRAP)
     }
 
     /**
@@ -47,14 +104,31 @@ class KeyManager(private val context: Context) {
         return prefs.getString(PREF_DEVICE_KEY, null)
     }
 
+    /**
+     * Replace the device key after the server rotated it.
+     * The device stays registered, history and secret are kept.
+     */
+    fun updateDeviceKey(deviceKey: String) {
+        prefs.edit().putString(PREF_DEVICE_KEY, deviceKey).apply()
+    }
+
     /**
      * Regenerate device key
      */
     fun regenerateDeviceKey(): String {
         isRegistered = false // Need to re-register
+        subscribeSecret = null // Issued again for the new key
         return generateDeviceKey()
     }
 
+    /**
+     * Secret issued by the server at registration, required to receive messages.
+     * The device key alone only allows sending.
+     */
+    var subscribeSecret: String?
+        get() = prefs.getString(PREF_SUBSCRIBE_SECRET, null)
+        set(value) = prefs.edit().putString(PREF_SUBSCRIBE_SECRET, value).apply()
+
     /**
      * Get or set server URL
      */
@@ -105,8 +179,11 @@ class KeyManager(private val context: Context) {
         set(value) = prefs.edit().putBoolean(PREF_SHOW_FOREGROUND_NOTIFICATION, value).apply()
 
     companion object {
+        private const val ANDROID_KEYSTORE = "AndroidKeyStore"
+        private const val KEY_ALIAS = "abnotify_device_key"
         private const val PREFS_NAME = "abnotify_secure_prefs"
         private const val PREF_DEVICE_KEY = "device_key"
+        private const val PREF_SUBSCRIBE_SECRET = "subscribe_secret"
         private const val PREF_SERVER_URL = "server_url"
         private const val PREF_SERVER_LIST = "server_list"
         private const val PREF_IS_REGISTERED = "is_registered"
@@ -129,6 +129,10 @@ class WebSocketService : Service() {
                 val messageId = intent.getStringExtra(EXTRA_MESSAGE_ID)
                 messageId?.let { sendAck(it) }
             }
+            ACTION_MARK_READ -> {
+                val messageId = intent.getStringExtra(EXTRA_MESSAGE_ID)
+                messageId?.let { markRead(it) }
+            }
             ACTION_KEEP_ALIVE -> {
                 // Refresh WakeLock to maintain connection
                 refreshConnectionWakeLock()
@@ -487,9 +491,12 @@ class WebSocketService : Service() {
             webSocket = null
         }
 
-        val request = Request.Builder()
+        val requestBuilder = Request.Builder()
             .url(wsUrl)
-            .build()
+        keyManager.subscribeSecret?.let {
+            requestBuilder.header("Authorization", "Bearer $it")
+        }
+        val request = requestBuilder.build()
 
         val newWebSocket = client.newWebSocket(request, object : WebSocketListener() {
             override fun onOpen(webSocket: WebSocket, response: Response) {
@@ -589,7 +596,11 @@ class WebSocketService : Service() {
             Log.d(TAG, "Message type: $type")
             when (type) {
                 "message" -> handlePushMessage(json)
+                "recall" -> handleRecall(json)
+                "read" -> handleRead(json)
                 "ping" -> sendPong()
+                "challenge" -> handleChallenge(json)
+                "key_rotated" -> handleKeyRotated(json)
             }
         } catch (e: Exception) {
             Log.e(TAG, "Error handling message", e)
@@ -618,6 +629,7 @@ class WebSocketService : Service() {
         val url = data.get("url")?.asString
         val sound = data.get("sound")?.asString
         val badge = data.get("badge")?.asInt ?: 0
+        val collapseId = data.get("notification_id")?.asString
 
         // Save to database
         scope.launch {
@@ -642,13 +654,70 @@ class WebSocketService : Service() {
             title = title?.takeIf { it.isNotEmpty() } ?: "Abnotify",
             body = body ?: "",
             group = group,
-            url = url
+            url = url,
+            collapseId = collapseId
         )
 
         // Send ACK
         sendAck(messageId)
     }
 
+    private fun handleRecall(json: JsonObject) {
+        val data = json.getAsJsonObject("data") ?: return
+        val messageIds = data.getAsJsonArray("message_ids")?.map { it.asString } ?: emptyList()
+        val notificationIds = data.getAsJsonArray("notification_ids")?.map { it.asString } ?: emptyList()
+        Log.i(TAG, "Recall: ${json.get("id")}, messages=${messageIds.size}")
+
+        NotificationHelper.cancelNotifications(this, (messageIds + notificationIds).toSet())
+
+        val app = AbnotifyApp.getInstance()
+        scope.launch {
+            messageIds.forEach { app.database.messageDao().delete(it) }
+        }
+    }
+
+    private fun handleRead(json: JsonObject) {
+        val data = json.getAsJsonObject("data") ?: return
+        val messageIds = data.getAsJsonArray("message_ids")?.map { it.asString } ?: emptyList()
+        val notificationIds = data.getAsJsonArray("notification_ids")?.map { it.asString } ?: emptyList()
+        Log.i(TAG, "Read on linked device: messages=${messageIds.size}")
+
+        NotificationHelper.cancelNotifications(this, (messageIds + notificationIds).toSet())
+
+        val app = AbnotifyApp.getInstance()
+        scope.launch {
+            messageIds.forEach { app.database.messageDao().markAsRead(it) }
+        }
+    }
+
+    /**
+     * Prove possession of the device private key, the server only delivers
+     * messages once the signature is verified
+     */
+    private fun handleChallenge(json: JsonObject) {
+        val keyManager = AbnotifyApp.getInstance().keyManager
+        val deviceKey = keyManager.getDeviceKey() ?: return
+        val nonce = json.getAsJsonObject("data")?.get("nonce")?.asString ?: return
+        val signature = keyManager.sign("abnotify-ws-auth\n$deviceKey\n$nonce".toByteArray(Charsets.UTF_8))
+        if (signature == null) {
+            Log.e(TAG, "No device key pair to answer the challenge")
+            return
+        }
+
+        val auth = JsonObject().apply {
+            addProperty("type", "auth")
+            addProperty("id", json.get("id")?.asString)
+            add("data", JsonObject().apply { addProperty("signature", signature) })
+        }
+        webSocket?.send(gson.toJson(auth))
+    }
+
+    private fun handleKeyRotated(json: JsonObject) {
+        val deviceKey = json.getAsJsonObject("data")?.get("device_key")?.asString ?: return
+        Log.i(TAG, "Device key rotated by server")
+        AbnotifyApp.getInstance().keyManager.updateDeviceKey(deviceKey)
+    }
+
     private fun sendAck(messageId: String) {
         val ack = JsonObject().apply {
             addProperty("type", "ack")
@@ -657,6 +726,23 @@ class WebSocketService : Service() {
         webSocket?.send(gson.toJson(ack))
     }
 
+    /**
+     * Mark a message read after its notification was opened or dismissed and
+     * tell the server, which clears it on the other devices of the user
+     */
+    private fun markRead(messageId: String) {
+        val read = JsonObject().apply {
+            addProperty("type", "read")
+            addProperty("id", messageId)
+        }
+        webSocket?.send(gson.toJson(read))
+
+        val app = AbnotifyApp.getInstance()
+        scope.launch {
+            app.database.messageDao().markAsRead(messageId)
+        }
+    }
+
     private fun sendPong() {
         val pong = JsonObject().apply {
             addProperty("type", "pong")
@@ -754,6 +840,7 @@ class WebSocketService : Service() {
         const val ACTION_CONNECT = "com.kyeo.abnotify.action.CONNECT"
         const val ACTION_DISCONNECT = "com.kyeo.abnotify.action.DISCONNECT"
         const val ACTION_SEND_ACK = "com.kyeo.abnotify.action.SEND_ACK"
+        const val ACTION_MARK_READ = "com.kyeo.abnotify.action.MARK_READ"
         const val ACTION_CONNECTION_STATUS = "com.kyeo.abnotify.action.CONNECTION_STATUS"
         const val ACTION_KEEP_ALIVE = "com.kyeo.abnotify.action.KEEP_ALIVE"
         const val ACTION_RESTART_SERVICE = "com.kyeo.abnotify.action.RESTART_SERVICE"
@@ -761,6 +848,16 @@ class WebSocketService : Service() {
         const val EXTRA_MESSAGE_ID = "message_id"
         const val EXTRA_CONNECTED = "connected"
 
+        /**
+         * Intent that reports a message as read to the running service
+         */
+        fun markReadIntent(context: Context, messageId: String): Intent {
+            return Intent(context, WebSocketService::class.java).apply {
+                action = ACTION_MARK_READ
+                putExtra(EXTRA_MESSAGE_ID, messageId)
+            }
+        }
+
         /**
          * Helper to start the service properly
          */
@@ -108,19 +108,43 @@ class MainActivity : AppCompatActivity() {
         CoroutineScope(Dispatchers.IO).launch {
             try {
                 val client = OkHttpClient()
-                val requestBody = mapOf(
+                val requestBody = mutableMapOf(
                     "device_key" to deviceKey,
                     "name" to Build.MODEL
                 )
+                // Lets the server verify WebSocket connections come from this device
+                keyManager.getPublicKeyPem()?.let { requestBody["public_key"] = it }
                 val gson = com.google.gson.Gson()
                 val json = gson.toJson(requestBody)
-                val request = Request.Builder()
+                val requestBuilder = Request.Builder()
                     .url("$serverUrl/register")
                     .post(json.toRequestBody("application/json".toMediaType()))
-                    .build()
+                // Proves ownership when the registration changes the device
+                keyManager.subscribeSecret?.let {
+                    requestBuilder.header("Authorization", "Bearer $it")
+                }
+                val request = requestBuilder.build()
 
                 val response = client.newCall(request).execute()
 
+                // The secret is only returned the first time, keep it
+                if (response.isSuccessful) {
+                    val body = response.body?.string()
+                    val data = runCatching {
+                        gson.fromJson(body, com.google.gson.JsonObject::class.java)
+                            .getAsJsonObject("data")
+                    }.getOrNull()
+                    val secret = data?.get("subscribe_secret")?.asString
+                    if (!secret.isNullOrEmpty()) {
+                        keyManager.subscribeSecret = secret
+                    }
+                    // Registering with a rotated key returns the current one
+                    val currentKey = data?.get("device_key")?.asString
+                    if (!currentKey.isNullOrEmpty() && currentKey != deviceKey) {
+                        keyManager.updateDeviceKey(currentKey)
+                    }
+                }
+
                 withContext(Dispatchers.Main) {
                     if (response.isSuccessful) {
                         keyManager.isRegistered = true
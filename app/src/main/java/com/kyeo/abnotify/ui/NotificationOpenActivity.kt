@@ -0,0 +1,44 @@
+package com.kyeo.abnotify.ui
+
+import android.app.Activity
+import android.content.ActivityNotFoundException
+import android.content.Intent
+import android.net.Uri
+import android.os.Bundle
+import android.util.Log
+import com.kyeo.abnotify.service.WebSocketService
+
+/**
+ * Opened by tapping a message notification: reports the message as read, then
+ * opens its URL or the app. Android 12+ does not allow a service or receiver
+ * started from a notification to open an activity, so this runs in between.
+ */
+class NotificationOpenActivity : Activity() {
+
+    override fun onCreate(savedInstanceState: Bundle?) {
+        super.onCreate(savedInstanceState)
+
+        intent.getStringExtra(WebSocketService.EXTRA_MESSAGE_ID)?.let {
+            startService(WebSocketService.markReadIntent(this, it))
+        }
+
+        val url = intent.getStringExtra(EXTRA_URL)
+        val target = if (!url.isNullOrEmpty()) {
+            Intent(Intent.ACTION_VIEW, Uri.parse(url))
+        } else {
+            Intent(this, MainActivity::class.java)
+        }
+        try {
+            startActivity(target)
+        } catch (e: ActivityNotFoundException) {
+            Log.w(TAG, "No activity to open $url", e)
+        }
+        finish()
+    }
+
+    companion object {
+        private const val TAG = "NotificationOpen"
+
+        const val EXTRA_URL = "url"
+    }
+}
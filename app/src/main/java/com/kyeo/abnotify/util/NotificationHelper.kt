@@ -4,16 +4,17 @@ import android.app.NotificationManager
 import android.app.PendingIntent
 import android.content.Context
 import android.content.Intent
-import android.net.Uri
 import androidx.core.app.NotificationCompat
 import com.kyeo.abnotify.AbnotifyApp
 import com.kyeo.abnotify.R
-import com.kyeo.abnotify.ui.MainActivity
+import com.kyeo.abnotify.service.WebSocketService
+import com.kyeo.abnotify.ui.NotificationOpenActivity
 import java.util.concurrent.atomic.AtomicInteger
 
 object NotificationHelper {
 
     private val notificationIdCounter = AtomicInteger(100)
+    private const val COLLAPSE_NOTIFICATION_ID = 99
 
     fun showNotification(
         context: Context,
@@ -21,25 +22,38 @@ object NotificationHelper {
         title: String,
         body: String,
         group: String? = null,
-        url: String? = null
+        url: String? = null,
+        collapseId: String? = null
     ) {
         val notificationManager = AbnotifyApp.getInstance().getSystemService(Context.NOTIFICATION_SERVICE) as NotificationManager
-        val notificationId = notificationIdCounter.getAndIncrement()
+        // A collapse ID keeps tag and ID stable so newer versions replace the shown notification
+        val tag = collapseId ?: messageId
+        val notificationId = if (collapseId != null) COLLAPSE_NOTIFICATION_ID else notificationIdCounter.getAndIncrement()
+        // PendingIntents are keyed by request code, so collapse groups sharing the
+        // notification ID must not share one or they overwrite each other's extras
+        val requestCode = tag.hashCode()
 
-        // Content intent - open app or URL
-        val contentIntent = if (!url.isNullOrEmpty()) {
-            Intent(Intent.ACTION_VIEW, Uri.parse(url))
-        } else {
-            Intent(context, MainActivity::class.java)
+        // Content intent - mark read, then open app or URL
+        val contentIntent = Intent(context, NotificationOpenActivity::class.java).apply {
+            putExtra(WebSocketService.EXTRA_MESSAGE_ID, messageId)
+            putExtra(NotificationOpenActivity.EXTRA_URL, url)
         }
 
         val pendingIntent = PendingIntent.getActivity(
             context,
-            notificationId,
+            requestCode,
             contentIntent,
             PendingIntent.FLAG_IMMUTABLE or PendingIntent.FLAG_UPDATE_CURRENT
         )
 
+        // Delete intent - swiping the notification away also marks it read
+        val deleteIntent = PendingIntent.getService(
+            context,
+            requestCode,
+            WebSocketService.markReadIntent(context, messageId),
+            PendingIntent.FLAG_IMMUTABLE or PendingIntent.FLAG_UPDATE_CURRENT
+        )
+
         // Use group parameter if provided, otherwise use messageId as group key
         val groupKey = group ?: "abnotify_$messageId"
 
@@ -52,9 +66,20 @@ object NotificationHelper {
             .setDefaults(NotificationCompat.DEFAULT_ALL)
             .setAutoCancel(true)
             .setContentIntent(pendingIntent)
+            .setDeleteIntent(deleteIntent)
             .setVibrate(longArrayOf(0, 500, 200, 500))
             .setGroup(groupKey)
 
-        notificationManager.notify(messageId, notificationId, builder.build())
+        notificationManager.notify(tag, notificationId, builder.build())
+    }
+
+    /**
+     * Dismiss shown notifications whose tag is one of the given IDs
+     */
+    fun cancelNotifications(context: Context, tags: Set<String>) {
+        val notificationManager = context.getSystemService(Context.NOTIFICATION_SERVICE) as NotificationManager
+        notificationManager.activeNotifications
+            .filter { it.tag in tags }
+            .forEach { notificationManager.cancel(it.tag, it.id) }
     }
 }
@@ -2,6 +2,7 @@ package apns
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
@@ -14,6 +15,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/abnotify/server/logging"
 )
 
 const (
@@ -35,9 +38,9 @@ type Client struct {
 	endpoint   string
 
 	// Token caching
-	token      string
-	tokenMu    sync.RWMutex
-	tokenExp   time.Time
+	token    string
+	tokenMu  sync.RWMutex
+	tokenExp time.Time
 }
 
 // Payload represents APNs payload
@@ -143,8 +146,9 @@ func parsePrivateKey(pemKey string) (*ecdsa.PrivateKey, error) {
 	return privateKey, nil
 }
 
-// Push sends a push notification
-func (c *Client) Push(deviceToken string, payload *Payload, headers map[string]string) (*Response, error) {
+// Push sends a push notification. The context carries the request ID for logs;
+// the push is not cancelled with it.
+func (c *Client) Push(ctx context.Context, deviceToken string, payload *Payload, headers map[string]string) (*Response, error) {
 	url := fmt.Sprintf("%s/3/device/%s", c.endpoint, deviceToken)
 
 	// Marshal payload
@@ -180,8 +184,13 @@ func (c *Client) Push(deviceToken string, payload *Payload, headers map[string]s
 	req.Header.Set("authorization", fmt.Sprintf("bearer %s", token))
 
 	// Send request
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	apnsDuration.ObserveSince(start)
+	logger := logging.FromContext(ctx).With("device_token", logging.RedactKey(deviceToken))
 	if err != nil {
+		logger.Warn("APNs request failed", "error", err)
+		recordResponse(nil)
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
@@ -194,6 +203,7 @@ func (c *Client) Push(deviceToken string, payload *Payload, headers map[string]s
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
+		recordResponse(apnsResp)
 		return apnsResp, nil
 	}
 
@@ -203,6 +213,12 @@ func (c *Client) Push(deviceToken string, payload *Payload, headers map[string]s
 	if err := json.Unmarshal(respBody, &errResp); err == nil {
 		apnsResp.Reason = errResp.Reason
 	}
+	recordResponse(apnsResp)
+	if apnsResp.StatusCode == http.StatusOK {
+		logger.Debug("APNs push accepted", "apns_id", apnsResp.ApnsID, "duration", time.Since(start))
+	} else {
+		logger.Warn("APNs push rejected", "status", apnsResp.StatusCode, "reason", apnsResp.Reason, "apns_id", apnsResp.ApnsID)
+	}
 
 	return apnsResp, nil
 }
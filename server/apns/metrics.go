@@ -0,0 +1,29 @@
+package apns
+
+import (
+	"strconv"
+
+	"github.com/abnotify/server/metrics"
+)
+
+var (
+	apnsResponses = metrics.NewCounterVec(
+		"abnotify_apns_responses_total",
+		"APNs responses by HTTP status and reason. Status is \"error\" when the request failed.",
+		"status", "reason",
+	)
+	apnsDuration = metrics.NewHistogramVec(
+		"abnotify_apns_request_duration_seconds",
+		"Time taken by APNs push requests.",
+		metrics.DefaultBuckets,
+	)
+)
+
+// recordResponse counts an APNs response or transport failure
+func recordResponse(resp *Response) {
+	if resp == nil {
+		apnsResponses.Inc("error", "")
+		return
+	}
+	apnsResponses.Inc(strconv.Itoa(resp.StatusCode), resp.Reason)
+}
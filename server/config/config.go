@@ -1,9 +1,9 @@
 package config
 
 import (
-	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds application configuration
@@ -13,12 +13,63 @@ type Config struct {
 	Port int
 
 	// Database
-	DBPath string
+	DBDriver    string // sqlite or postgres
+	DBPath      string // SQLite database file
+	DatabaseURL string // PostgreSQL connection URL
 
 	// WebSocket settings
 	WSPingInterval int // seconds
 	WSPongTimeout  int // seconds
 
+	// Messages
+	MessageTTL        int // seconds, default expiry of undelivered messages (0 = never)
+	IdempotencyWindow int // seconds idempotency keys are remembered
+	DedupeWindow      int // seconds identical messages to a device collapse (0 = disabled)
+
+	// Retention
+	RetentionMaxAge          int            // seconds, delete messages older than this (0 = keep forever)
+	RetentionMaxMessages     int            // keep only the newest N messages per device (0 = unlimited)
+	RetentionGroupMaxAge     map[string]int // per-group max age overrides in seconds (0 = keep forever)
+	RetentionKeepUndelivered bool           // never delete messages not yet delivered
+	RetentionInterval        int            // seconds between retention runs
+	RetentionAuditMaxAge     int            // seconds, delete resolved registration attempts older than this (0 = keep forever)
+	VacuumInterval           int            // seconds between VACUUM runs (0 = never)
+
+	// Rate limiting (requests per minute, 0 = unlimited)
+	RateLimitIP          int
+	RateLimitIPBurst     int
+	RateLimitDevice      int
+	RateLimitDeviceBurst int
+	RateLimitToken       int
+	RateLimitTokenBurst  int
+	TrustedProxies       []string // proxies allowed to set X-Forwarded-For (empty = trust none)
+
+	// Devices registered before subscriber secrets existed must register
+	// again to get one before they can subscribe
+	RequireSubscribeSecret bool
+
+	// Devices with a public key must answer an RSA challenge before they
+	// receive messages over WebSocket
+	RequireWSAuth bool
+
+	// Keep registration changes without proof of ownership for admin review
+	// instead of rejecting them
+	QuarantineRegistrations bool
+
+	// Longest time a rotated device key may keep working
+	KeyRotationMaxGrace int // seconds
+
+	// Admin API
+	AdminToken string // bearer token for /admin endpoints (empty = disabled)
+
+	// Metrics
+	MetricsToken string // bearer token for /metrics (empty = public)
+
+	// Logging
+	LogLevel     string // debug, info, warn or error
+	LogFormat    string // logfmt or json
+	LogSensitive bool   // log message content and full device keys (debugging only)
+
 	// Security
 	EnableHTTPS bool
 	CertFile    string
@@ -31,54 +82,71 @@ type Config struct {
 	APNSProduction bool   // true for production, false for development
 }
 
+// APNSEnabled reports whether APNs credentials are configured
+func (c *Config) APNSEnabled() bool {
+	return c.APNSKeyID != "" && c.APNSTeamID != "" && c.APNSPrivateKey != ""
+}
+
+// DatabaseSource returns the SQLite database file or the PostgreSQL
+// connection URL, depending on the driver
+func (c *Config) DatabaseSource() string {
+	if c.DBDriver == "postgres" {
+		return c.DatabaseURL
+	}
+	return c.DBPath
+}
+
 // DefaultConfig returns default configuration
 func DefaultConfig() *Config {
 	return &Config{
 		Host:           "0.0.0.0",
 		Port:           8080,
+		DBDriver:       "sqlite",
 		DBPath:         "./data/abnotify.db",
 		WSPingInterval: 30,
 		WSPongTimeout:  60,
 		EnableHTTPS:    false,
-	}
-}
 
-// LoadFromEnv loads configuration from environment variables
-func LoadFromEnv() *Config {
-	cfg := DefaultConfig()
+		IdempotencyWindow: 24 * 3600,
 
-	if host := os.Getenv("ABNOTIFY_HOST"); host != "" {
-		cfg.Host = host
-	}
+		RetentionGroupMaxAge:     map[string]int{},
+		RetentionKeepUndelivered: true,
+		RetentionInterval:        3600,
+		VacuumInterval:           7 * 24 * 3600,
 
-	if port := os.Getenv("ABNOTIFY_PORT"); port != "" {
-		if p, err := strconv.Atoi(port); err == nil {
-			cfg.Port = p
-		}
-	}
+		RateLimitIP:          120,
+		RateLimitIPBurst:     60,
+		RateLimitDevice:      60,
+		RateLimitDeviceBurst: 30,
+		RateLimitToken:       60,
+		RateLimitTokenBurst:  30,
+
+		KeyRotationMaxGrace: 7 * 24 * 3600,
 
-	if dbPath := os.Getenv("ABNOTIFY_DB_PATH"); dbPath != "" {
-		cfg.DBPath = dbPath
+		LogLevel:  "info",
+		LogFormat: "logfmt",
+
+		APNSProduction: true,
 	}
+}
 
-	if pingInterval := os.Getenv("ABNOTIFY_WS_PING_INTERVAL"); pingInterval != "" {
-		if p, err := strconv.Atoi(pingInterval); err == nil {
-			cfg.WSPingInterval = p
+// parseSeconds parses a duration given as seconds, days ("30d") or a Go
+// duration ("12h") into seconds
+func parseSeconds(v string) (int, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return n, true
+	}
+	if days, found := strings.CutSuffix(v, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil {
+			return n * 24 * 3600, true
 		}
 	}
-
-	if os.Getenv("ABNOTIFY_ENABLE_HTTPS") == "true" {
-		cfg.EnableHTTPS = true
-		cfg.CertFile = os.Getenv("ABNOTIFY_CERT_FILE")
-		cfg.KeyFile = os.Getenv("ABNOTIFY_KEY_FILE")
+	if d, err := time.ParseDuration(v); err == nil {
+		return int(d.Seconds()), true
 	}
-
-	// APNs configuration
-	cfg.APNSKeyID = os.Getenv("APNS_KEY_ID")
-	cfg.APNSTeamID = os.Getenv("APNS_TEAM_ID")
-	// Handle \n escape sequences in private key (for environment variables)
-	cfg.APNSPrivateKey = strings.ReplaceAll(os.Getenv("APNS_PRIVATE_KEY"), "\\n", "\n")
-	cfg.APNSProduction = os.Getenv("APNS_PRODUCTION") != "false"
-
-	return cfg
+	return 0, false
 }
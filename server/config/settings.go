@@ -0,0 +1,352 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// setting maps a key of the config file and an environment variable to a
+// Config field. File values are strings, numbers and booleans; lists and
+// maps are accepted where noted.
+type setting struct {
+	key   string // key in the config file, sections separated by dots
+	env   string // environment variable
+	apply func(cfg *Config, v any) error
+}
+
+var settings = []setting{
+	{"server.host", "ABNOTIFY_HOST", stringField(func(c *Config) *string { return &c.Host })},
+	{"server.port", "ABNOTIFY_PORT", intField(func(c *Config) *int { return &c.Port })},
+	{"server.trusted_proxies", "ABNOTIFY_TRUSTED_PROXIES", listField(func(c *Config) *[]string { return &c.TrustedProxies })},
+	{"server.https.enabled", "ABNOTIFY_ENABLE_HTTPS", boolField(func(c *Config) *bool { return &c.EnableHTTPS })},
+	{"server.https.cert_file", "ABNOTIFY_CERT_FILE", stringField(func(c *Config) *string { return &c.CertFile })},
+	{"server.https.key_file", "ABNOTIFY_KEY_FILE", stringField(func(c *Config) *string { return &c.KeyFile })},
+
+	{"database.driver", "ABNOTIFY_DB_DRIVER", stringField(func(c *Config) *string { return &c.DBDriver })},
+	{"database.path", "ABNOTIFY_DB_PATH", stringField(func(c *Config) *string { return &c.DBPath })},
+	{"database.url", "ABNOTIFY_DATABASE_URL", stringField(func(c *Config) *string { return &c.DatabaseURL })},
+
+	{"websocket.ping_interval", "ABNOTIFY_WS_PING_INTERVAL", secondsField(func(c *Config) *int { return &c.WSPingInterval })},
+	{"websocket.pong_timeout", "ABNOTIFY_WS_PONG_TIMEOUT", secondsField(func(c *Config) *int { return &c.WSPongTimeout })},
+
+	{"messages.ttl", "ABNOTIFY_MESSAGE_TTL", secondsField(func(c *Config) *int { return &c.MessageTTL })},
+	{"messages.idempotency_window", "ABNOTIFY_IDEMPOTENCY_WINDOW", secondsField(func(c *Config) *int { return &c.IdempotencyWindow })},
+	{"messages.dedupe_window", "ABNOTIFY_DEDUPE_WINDOW", secondsField(func(c *Config) *int { return &c.DedupeWindow })},
+
+	{"retention.max_age", "ABNOTIFY_RETENTION_MAX_AGE", secondsField(func(c *Config) *int { return &c.RetentionMaxAge })},
+	{"retention.max_messages", "ABNOTIFY_RETENTION_MAX_MESSAGES", intField(func(c *Config) *int { return &c.RetentionMaxMessages })},
+	{"retention.groups", "ABNOTIFY_RETENTION_GROUPS", applyRetentionGroups},
+	{"retention.keep_undelivered", "ABNOTIFY_RETENTION_KEEP_UNDELIVERED", boolField(func(c *Config) *bool { return &c.RetentionKeepUndelivered })},
+	{"retention.interval", "ABNOTIFY_RETENTION_INTERVAL", secondsField(func(c *Config) *int { return &c.RetentionInterval })},
+	{"retention.audit_max_age", "ABNOTIFY_RETENTION_AUDIT_MAX_AGE", secondsField(func(c *Config) *int { return &c.RetentionAuditMaxAge })},
+	{"retention.vacuum_interval", "ABNOTIFY_VACUUM_INTERVAL", secondsField(func(c *Config) *int { return &c.VacuumInterval })},
+
+	{"rate_limit.ip", "ABNOTIFY_RATE_LIMIT_IP", intField(func(c *Config) *int { return &c.RateLimitIP })},
+	{"rate_limit.ip_burst", "ABNOTIFY_RATE_LIMIT_IP_BURST", intField(func(c *Config) *int { return &c.RateLimitIPBurst })},
+	{"rate_limit.device", "ABNOTIFY_RATE_LIMIT_DEVICE", intField(func(c *Config) *int { return &c.RateLimitDevice })},
+	{"rate_limit.device_burst", "ABNOTIFY_RATE_LIMIT_DEVICE_BURST", intField(func(c *Config) *int { return &c.RateLimitDeviceBurst })},
+	{"rate_limit.token", "ABNOTIFY_RATE_LIMIT_TOKEN", intField(func(c *Config) *int { return &c.RateLimitToken })},
+	{"rate_limit.token_burst", "ABNOTIFY_RATE_LIMIT_TOKEN_BURST", intField(func(c *Config) *int { return &c.RateLimitTokenBurst })},
+
+	{"security.require_subscribe_secret", "ABNOTIFY_REQUIRE_SUBSCRIBE_SECRET", boolField(func(c *Config) *bool { return &c.RequireSubscribeSecret })},
+	{"security.require_ws_auth", "ABNOTIFY_REQUIRE_WS_AUTH", boolField(func(c *Config) *bool { return &c.RequireWSAuth })},
+	{"security.quarantine_registrations", "ABNOTIFY_QUARANTINE_REGISTRATIONS", boolField(func(c *Config) *bool { return &c.QuarantineRegistrations })},
+	{"security.key_rotation_max_grace", "ABNOTIFY_KEY_ROTATION_MAX_GRACE", secondsField(func(c *Config) *int { return &c.KeyRotationMaxGrace })},
+
+	{"admin.token", "ABNOTIFY_ADMIN_TOKEN", stringField(func(c *Config) *string { return &c.AdminToken })},
+	{"metrics.token", "ABNOTIFY_METRICS_TOKEN", stringField(func(c *Config) *string { return &c.MetricsToken })},
+
+	{"log.level", "ABNOTIFY_LOG_LEVEL", stringField(func(c *Config) *string { return &c.LogLevel })},
+	{"log.format", "ABNOTIFY_LOG_FORMAT", stringField(func(c *Config) *string { return &c.LogFormat })},
+	{"log.sensitive", "ABNOTIFY_LOG_SENSITIVE", boolField(func(c *Config) *bool { return &c.LogSensitive })},
+
+	{"apns.key_id", "APNS_KEY_ID", stringField(func(c *Config) *string { return &c.APNSKeyID })},
+	{"apns.team_id", "APNS_TEAM_ID", stringField(func(c *Config) *string { return &c.APNSTeamID })},
+	{"apns.private_key", "APNS_PRIVATE_KEY", applyAPNSPrivateKey},
+	{"apns.private_key_file", "APNS_PRIVATE_KEY_FILE", applyAPNSPrivateKeyFile},
+	{"apns.production", "APNS_PRODUCTION", boolField(func(c *Config) *bool { return &c.APNSProduction })},
+}
+
+// Load builds the configuration from the defaults, the config file at path
+// (YAML or TOML by extension, skipped when path is empty) and then the
+// environment, and validates it. Every problem found is reported.
+func Load(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	var errs []error
+
+	if path != "" {
+		if err := applyFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		v := os.Getenv(s.env)
+		if v == "" {
+			continue
+		}
+		if err := s.apply(cfg, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+		}
+	}
+
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// applyFile applies the settings of a YAML or TOML config file
+func applyFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	values := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	return errors.Join(applySection(cfg, "", values, byKey)...)
+}
+
+// applySection applies the keys of a config file section, descending into
+// subsections. It returns an error for every unknown key and invalid value.
+func applySection(cfg *Config, prefix string, values map[string]any, byKey map[string]setting) []error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		key := prefix + k
+		v := values[k]
+		if v == nil {
+			// an empty value keeps the default
+			if _, ok := byKey[key]; !ok && !isSection(byKey, key) {
+				errs = append(errs, fmt.Errorf("config file: unknown setting %s", key))
+			}
+			continue
+		}
+		if s, ok := byKey[key]; ok {
+			if err := s.apply(cfg, v); err != nil {
+				errs = append(errs, fmt.Errorf("config file: %s: %w", key, err))
+			}
+			continue
+		}
+		if section, ok := v.(map[string]any); ok {
+			errs = append(errs, applySection(cfg, key+".", section, byKey)...)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("config file: unknown setting %s", key))
+	}
+	return errs
+}
+
+// isSection reports whether key is a section of the config file
+func isSection(byKey map[string]setting, key string) bool {
+	for k := range byKey {
+		if strings.HasPrefix(k, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// scalar converts a single config value to a string
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		if v != float64(int64(v)) {
+			return "", fmt.Errorf("expected a whole number, got %v", v)
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	}
+	return "", fmt.Errorf("expected a single value, got %T", v)
+}
+
+func stringField(field func(*Config) *string) func(*Config, any) error {
+	return func(cfg *Config, v any) error {
+		s, err := scalar(v)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = s
+		return nil
+	}
+}
+
+func intField(field func(*Config) *int) func(*Config, any) error {
+	return func(cfg *Config, v any) error {
+		s, err := scalar(v)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func secondsField(field func(*Config) *int) func(*Config, any) error {
+	return func(cfg *Config, v any) error {
+		s, err := scalar(v)
+		if err != nil {
+			return err
+		}
+		n, ok := parseSeconds(s)
+		if !ok {
+			return fmt.Errorf("invalid duration %q (seconds, or e.g. 90s, 12h, 7d)", s)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func boolField(field func(*Config) *bool) func(*Config, any) error {
+	return func(cfg *Config, v any) error {
+		s, err := scalar(v)
+		if err != nil {
+			return err
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q (true or false)", s)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+// listField accepts a list or a comma separated string
+func listField(field func(*Config) *[]string) func(*Config, any) error {
+	return func(cfg *Config, v any) error {
+		var items []string
+		if list, ok := v.([]any); ok {
+			for _, item := range list {
+				s, err := scalar(item)
+				if err != nil {
+					return err
+				}
+				items = append(items, s)
+			}
+		} else {
+			s, err := scalar(v)
+			if err != nil {
+				return err
+			}
+			items = strings.Split(s, ",")
+		}
+
+		var values []string
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		*field(cfg) = values
+		return nil
+	}
+}
+
+// applyRetentionGroups accepts a map of group to max age or a string in the
+// form group=age,group=age (e.g. webhook=7d,ci=24h)
+func applyRetentionGroups(cfg *Config, v any) error {
+	ages := map[string]any{}
+	if m, ok := v.(map[string]any); ok {
+		ages = m
+	} else {
+		s, err := scalar(v)
+		if err != nil {
+			return err
+		}
+		for _, entry := range strings.Split(s, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			group, age, found := strings.Cut(entry, "=")
+			if !found || strings.TrimSpace(group) == "" {
+				return fmt.Errorf("invalid entry %q (expected group=age)", entry)
+			}
+			ages[strings.TrimSpace(group)] = age
+		}
+	}
+
+	groups := make(map[string]int, len(ages))
+	for group, age := range ages {
+		s, err := scalar(age)
+		if err != nil {
+			return fmt.Errorf("group %s: %w", group, err)
+		}
+		n, ok := parseSeconds(s)
+		if !ok {
+			return fmt.Errorf("group %s: invalid duration %q", group, s)
+		}
+		groups[group] = n
+	}
+	cfg.RetentionGroupMaxAge = groups
+	return nil
+}
+
+// applyAPNSPrivateKey accepts the PEM key with newlines escaped as \n, as
+// environment variables cannot easily hold several lines
+func applyAPNSPrivateKey(cfg *Config, v any) error {
+	s, err := scalar(v)
+	if err != nil {
+		return err
+	}
+	cfg.APNSPrivateKey = strings.ReplaceAll(s, "\\n", "\n")
+	return nil
+}
+
+// applyAPNSPrivateKeyFile reads the PEM key from a file
+func applyAPNSPrivateKeyFile(cfg *Config, v any) error {
+	path, err := scalar(v)
+	if err != nil || path == "" {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg.APNSPrivateKey = string(data)
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validate checks the configuration and returns every problem found
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "server.port: must be between 1 and 65535, got %d", c.Port)
+	switch c.DBDriver {
+	case "sqlite":
+		check(c.DBPath != "", "database.path: must not be empty")
+	case "postgres":
+		check(c.DatabaseURL != "", "database.url: required for the postgres driver")
+	default:
+		errs = append(errs, fmt.Errorf("database.driver: must be sqlite or postgres, got %q", c.DBDriver))
+	}
+	if c.EnableHTTPS {
+		check(c.CertFile != "" && c.KeyFile != "", "server.https: cert_file and key_file are required when HTTPS is enabled")
+	}
+
+	check(c.WSPingInterval > 0, "websocket.ping_interval: must be positive")
+	check(c.WSPongTimeout > c.WSPingInterval, "websocket.pong_timeout: must be longer than ping_interval (%ds), got %ds", c.WSPingInterval, c.WSPongTimeout)
+
+	check(c.MessageTTL >= 0, "messages.ttl: must not be negative")
+	check(c.IdempotencyWindow >= 0, "messages.idempotency_window: must not be negative")
+	check(c.DedupeWindow >= 0, "messages.dedupe_window: must not be negative")
+
+	check(c.RetentionMaxAge >= 0, "retention.max_age: must not be negative")
+	check(c.RetentionMaxMessages >= 0, "retention.max_messages: must not be negative")
+	for group, age := range c.RetentionGroupMaxAge {
+		check(age >= 0, "retention.groups: max age of %s must not be negative", group)
+	}
+	check(c.RetentionInterval > 0, "retention.interval: must be positive")
+	check(c.RetentionAuditMaxAge >= 0, "retention.audit_max_age: must not be negative")
+	check(c.VacuumInterval >= 0, "retention.vacuum_interval: must not be negative")
+
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"ip", c.RateLimitIP},
+		{"ip_burst", c.RateLimitIPBurst},
+		{"device", c.RateLimitDevice},
+		{"device_burst", c.RateLimitDeviceBurst},
+		{"token", c.RateLimitToken},
+		{"token_burst", c.RateLimitTokenBurst},
+	} {
+		check(limit.value >= 0, "rate_limit.%s: must not be negative", limit.name)
+	}
+
+	check(c.KeyRotationMaxGrace >= 0, "security.key_rotation_max_grace: must not be negative")
+
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "logfmt", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: must be logfmt or json, got %q", c.LogFormat))
+	}
+
+	apns := 0
+	for _, v := range []string{c.APNSKeyID, c.APNSTeamID, c.APNSPrivateKey} {
+		if v != "" {
+			apns++
+		}
+	}
+	if apns > 0 && apns < 3 {
+		errs = append(errs, errors.New("apns: key_id, team_id and private_key must be set together"))
+	}
+
+	return errs
+}
+
+// RestartRequired returns the settings that differ from other but only take
+// effect on restart, as they configure the listener or the database
+func (c *Config) RestartRequired(other *Config) []string {
+	var changed []string
+	if c.Host != other.Host || c.Port != other.Port {
+		changed = append(changed, "server address")
+	}
+	if c.EnableHTTPS != other.EnableHTTPS || c.CertFile != other.CertFile || c.KeyFile != other.KeyFile {
+		changed = append(changed, "server.https")
+	}
+	if strings.Join(c.TrustedProxies, ",") != strings.Join(other.TrustedProxies, ",") {
+		changed = append(changed, "server.trusted_proxies")
+	}
+	if c.DBDriver != other.DBDriver || c.DBPath != other.DBPath || c.DatabaseURL != other.DatabaseURL {
+		changed = append(changed, "database")
+	}
+	return changed
+}
@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -11,6 +12,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"io"
+	"strconv"
 )
 
 const (
@@ -105,3 +107,38 @@ func (c *Crypto) GenerateDeviceKey() (string, error) {
 	// Use URL-safe base64 without padding
 	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
+
+// ChallengeSize is the size of a WebSocket authentication nonce in bytes
+const ChallengeSize = 32
+
+// GenerateChallenge generates a random nonce for a device to sign, base64 encoded
+func (c *Crypto) GenerateChallenge() (string, error) {
+	nonce := make([]byte, ChallengeSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// ChallengeMessage returns the bytes a device signs to answer a challenge.
+// The prefix and device key keep the signature from being reused elsewhere.
+func ChallengeMessage(deviceKey, nonce string) []byte {
+	return []byte("abnotify-ws-auth\n" + deviceKey + "\n" + nonce)
+}
+
+// RegisterMessage returns the bytes a device signs to prove ownership when it
+// changes its registration. The timestamp (unix seconds) limits replays.
+func RegisterMessage(deviceKey string, timestamp int64) []byte {
+	return []byte("abnotify-register\n" + deviceKey + "\n" + strconv.FormatInt(timestamp, 10))
+}
+
+// VerifySignature verifies a base64 RSASSA-PKCS1-v1_5 SHA-256 signature
+// ("SHA256withRSA") of message
+func (c *Crypto) VerifySignature(publicKey *rsa.PublicKey, message []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	hash := sha256.Sum256(message)
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sig)
+}
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/retention"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler handles operator endpoints under /admin
+type AdminHandler struct {
+	storage     storage.Storage
+	hub         *Hub
+	retention   *retention.Worker
+	owners      *OwnershipGuard
+	subscribers *SubscriberAuth
+}
+
+// maxDeviceNameLength is the longest display name accepted on rename
+const maxDeviceNameLength = 100
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(storage storage.Storage, hub *Hub, retention *retention.Worker, owners *OwnershipGuard, subscribers *SubscriberAuth) *AdminHandler {
+	return &AdminHandler{
+		storage:     storage,
+		hub:         hub,
+		retention:   retention,
+		owners:      owners,
+		subscribers: subscribers,
+	}
+}
+
+// AdminAuth requires the admin token returned by token as a bearer token.
+// Every request is rejected when no token is configured.
+func AdminAuth(token func() string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := token()
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, model.NewBarkError(403, "admin API disabled"))
+			return
+		}
+		bearer := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, model.NewBarkError(401, "unauthorized"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// HandleListDevices handles GET /admin/devices
+// Lists devices with their message counts and online status, most recently
+// seen first. Optional type filter (ios, android), limit and offset.
+func (h *AdminHandler) HandleListDevices(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	devices, err := h.storage.ListDeviceStats(c.Query("type"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	total, err := h.storage.CountDevices()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	for _, device := range devices {
+		device.Online = h.hub.IsOnline(device.DeviceKey)
+	}
+	c.JSON(http.StatusOK, model.NewBarkResponse(&model.DeviceList{
+		Devices: devices,
+		Total:   total,
+		Online:  h.hub.OnlineCount(),
+	}))
+}
+
+// HandleGetDevice handles GET /admin/devices/:id
+func (h *AdminHandler) HandleGetDevice(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+	c.JSON(http.StatusOK, model.NewBarkResponse(device))
+}
+
+// HandleRenameDevice handles PATCH /admin/devices/:id
+// Sets the display name of a device.
+func (h *AdminHandler) HandleRenameDevice(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	var req model.RenameDeviceRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid request body"))
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if len(req.Name) > maxDeviceNameLength {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "name is too long"))
+		return
+	}
+
+	if _, err := h.storage.RenameDevice(device.ID, req.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	requestLogger(c).Info("admin renamed device", "device_id", device.ID)
+
+	device.Name = req.Name
+	c.JSON(http.StatusOK, model.NewBarkResponse(device))
+}
+
+// HandleDeleteDevice handles DELETE /admin/devices/:id
+// Deletes a device with all its messages and closes its connection.
+func (h *AdminHandler) HandleDeleteDevice(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	deleted, err := h.storage.DeleteDevice(device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	h.hub.Disconnect(device.DeviceKey)
+	requestLogger(c).Info("admin deleted device", "device_id", device.ID, "messages", deleted)
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
+		"id":               device.ID,
+		"deleted_messages": deleted,
+	}))
+}
+
+// HandleIssueSecret handles POST /admin/devices/:id/secret
+// Issues the subscribe secret of a device registered before secrets existed
+// that cannot prove ownership itself. The secret is returned only here.
+func (h *AdminHandler) HandleIssueSecret(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid id"))
+		return
+	}
+	device, err := h.storage.GetDeviceByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return
+	}
+
+	secret, err := h.subscribers.Issue(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if secret == "" {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, "device already has a subscribe secret"))
+		return
+	}
+	requestLogger(c).Info("admin issued subscribe secret", "device_id", device.ID)
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
+		"id":               device.ID,
+		"device_key":       device.DeviceKey,
+		"subscribe_secret": secret,
+	}))
+}
+
+// getDevice loads the device from the path with its message counts,
+// writing the error response on failure
+func (h *AdminHandler) getDevice(c *gin.Context) *model.DeviceStats {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid id"))
+		return nil
+	}
+
+	device, err := h.storage.GetDeviceStats(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return nil
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return nil
+	}
+	device.Online = h.hub.IsOnline(device.DeviceKey)
+	return device
+}
+
+// HandleRetentionStatus handles GET /admin/retention
+// Returns the retention policy and what the last run removed.
+func (h *AdminHandler) HandleRetentionStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, model.NewBarkResponse(h.retention.Status()))
+}
+
+// HandleRetentionRun handles POST /admin/retention/run
+// Applies the retention policy immediately.
+func (h *AdminHandler) HandleRetentionRun(c *gin.Context) {
+	c.JSON(http.StatusOK, model.NewBarkResponse(h.retention.RunOnce()))
+}
+
+// HandleListRegistrations handles GET /admin/registrations
+// Lists registration changes that failed the ownership check, newest first.
+// Optional status filter (rejected, quarantined, approved, dismissed) and limit.
+func (h *AdminHandler) HandleListRegistrations(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	attempts, err := h.storage.ListRegistrationAttempts(c.Query("status"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewBarkResponse(attempts))
+}
+
+// HandleApproveRegistration handles POST /admin/registrations/:id/approve
+// Applies a quarantined change to its device.
+func (h *AdminHandler) HandleApproveRegistration(c *gin.Context) {
+	attempt := h.resolveRegistration(c, model.AttemptApproved)
+	if attempt == nil {
+		return
+	}
+	if err := h.owners.Apply(attempt); err != nil {
+		requestLogger(c).Error("failed to apply registration attempt", "attempt_id", attempt.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to update device"))
+		return
+	}
+	requestLogger(c).Info("admin approved registration attempt", "attempt_id", attempt.ID, "device_id", attempt.DeviceID)
+	c.JSON(http.StatusOK, model.NewBarkResponse(attempt))
+}
+
+// HandleDismissRegistration handles POST /admin/registrations/:id/dismiss
+// Discards a quarantined change.
+func (h *AdminHandler) HandleDismissRegistration(c *gin.Context) {
+	attempt := h.resolveRegistration(c, model.AttemptDismissed)
+	if attempt == nil {
+		return
+	}
+	requestLogger(c).Info("admin dismissed registration attempt", "attempt_id", attempt.ID, "device_id", attempt.DeviceID)
+	c.JSON(http.StatusOK, model.NewBarkResponse(attempt))
+}
+
+// resolveRegistration moves the quarantined attempt from the path to status,
+// writing the error response on failure
+func (h *AdminHandler) resolveRegistration(c *gin.Context, status string) *model.RegistrationAttempt {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid id"))
+		return nil
+	}
+
+	resolved, err := h.storage.ResolveRegistrationAttempt(id, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return nil
+	}
+	attempt, err := h.storage.GetRegistrationAttempt(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return nil
+	}
+	if attempt == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "registration attempt not found"))
+		return nil
+	}
+	if !resolved {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, "registration attempt is "+attempt.Status))
+		return nil
+	}
+	return attempt
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/abnotify/server/model"
+	"github.com/gin-gonic/gin"
+)
+
+const testAdminToken = "admin-token"
+
+// newAdminRouter serves the admin device endpoints like main does
+func newAdminRouter(h *AdminHandler, token string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/admin", AdminAuth(func() string { return token }))
+	admin.GET("/devices", h.HandleListDevices)
+	admin.GET("/devices/:id", h.HandleGetDevice)
+	admin.PATCH("/devices/:id", h.HandleRenameDevice)
+	admin.DELETE("/devices/:id", h.HandleDeleteDevice)
+	admin.POST("/devices/:id/secret", h.HandleIssueSecret)
+	return router
+}
+
+// adminRequest sends an authorized admin request and decodes the response
+// data into data when given
+func adminRequest(t *testing.T, router http.Handler, method, path, body string, data interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	resp := struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if resp.Code != w.Code {
+		t.Errorf("%s %s: body code %d, status %d", method, path, resp.Code, w.Code)
+	}
+	if data != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(resp.Data, data); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string // configured
+		header   string
+		wantCode int
+	}{
+		{"admin API disabled", "", "Bearer ", http.StatusForbidden},
+		{"missing token", testAdminToken, "", http.StatusUnauthorized},
+		{"wrong token", testAdminToken, "Bearer wrong", http.StatusUnauthorized},
+		{"valid token", testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, store, _ := newTestHub(t)
+			router := newAdminRouter(NewAdminHandler(store, hub, nil, nil, NewSubscriberAuth(store, false)), tt.token)
+
+			r := httptest.NewRequest("GET", "/admin/devices", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAdminDevices(t *testing.T) {
+	hub, store, device := newTestHub(t)
+	other := &model.Device{DeviceKey: "other", DeviceType: "ios"}
+	if err := store.CreateDevice(other); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if err := store.CreateMessage(&model.Message{DeviceID: device.ID, MessageID: id, Title: "t", Body: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connectTestClient(t, hub, device)
+	waitFor(t, "the device to connect", func() bool { return hub.IsOnline(device.DeviceKey) })
+	router := newAdminRouter(NewAdminHandler(store, hub, nil, nil, NewSubscriberAuth(store, false)), testAdminToken)
+	path := "/admin/devices/" + strconv.FormatInt(device.ID, 10)
+
+	var list model.DeviceList
+	if code := adminRequest(t, router, "GET", "/admin/devices", "", &list); code != http.StatusOK {
+		t.Fatalf("list status = %d", code)
+	}
+	if list.Total != 2 || list.Online != 1 || len(list.Devices) != 2 {
+		t.Errorf("list = %d devices, total %d, online %d, want 2, 2, 1", len(list.Devices), list.Total, list.Online)
+	}
+	if code := adminRequest(t, router, "GET", "/admin/devices?type=ios", "", &list); code != http.StatusOK || len(list.Devices) != 1 || list.Devices[0].ID != other.ID {
+		t.Errorf("list ios = %d, %d devices, want only %s", code, len(list.Devices), other.DeviceKey)
+	}
+
+	var stats model.DeviceStats
+	if code := adminRequest(t, router, "GET", path, "", &stats); code != http.StatusOK {
+		t.Fatalf("get status = %d", code)
+	}
+	if !stats.Online || stats.Messages != 2 || stats.Undelivered != 2 {
+		t.Errorf("device = online %v, %d messages, %d undelivered, want online, 2, 2", stats.Online, stats.Messages, stats.Undelivered)
+	}
+
+	if code := adminRequest(t, router, "PATCH", path, `{"name":"  Pixel  "}`, &stats); code != http.StatusOK || stats.Name != "Pixel" {
+		t.Errorf("rename = %d, %q, want 200, Pixel", code, stats.Name)
+	}
+	if code := adminRequest(t, router, "PATCH", path, `{"name":"`+strings.Repeat("x", maxDeviceNameLength+1)+`"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("rename to a long name = %d, want 400", code)
+	}
+
+	var issued struct {
+		Secret string `json:"subscribe_secret"`
+	}
+	if code := adminRequest(t, router, "POST", path+"/secret", "", &issued); code != http.StatusOK || issued.Secret == "" {
+		t.Errorf("issue secret = %d, %q, want a secret", code, issued.Secret)
+	}
+	if code := adminRequest(t, router, "POST", path+"/secret", "", nil); code != http.StatusConflict {
+		t.Errorf("issue secret again = %d, want 409", code)
+	}
+
+	var deleted struct {
+		Messages int64 `json:"deleted_messages"`
+	}
+	if code := adminRequest(t, router, "DELETE", path, "", &deleted); code != http.StatusOK || deleted.Messages != 2 {
+		t.Errorf("delete = %d, %d messages, want 200, 2", code, deleted.Messages)
+	}
+	waitFor(t, "the device to be disconnected", func() bool { return !hub.IsOnline(device.DeviceKey) })
+	if got, err := store.GetDeviceByID(device.ID); got != nil || err != nil {
+		t.Errorf("GetDeviceByID(deleted) = %v, %v, want nil, nil", got, err)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		wantCode     int
+	}{
+		{"GET", path, http.StatusNotFound},
+		{"DELETE", path, http.StatusNotFound},
+		{"POST", path + "/secret", http.StatusNotFound},
+		{"GET", "/admin/devices/abc", http.StatusBadRequest},
+	} {
+		if code := adminRequest(t, router, tt.method, tt.path, "", nil); code != tt.wantCode {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, code, tt.wantCode)
+		}
+	}
+}
@@ -1,32 +1,35 @@
 package handler
 
 import (
-	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-	"github.com/abnotify/server/apns"
+	"github.com/abnotify/server/logging"
 	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
 	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // BarkHandler handles Bark-compatible push requests
 type BarkHandler struct {
-	storage    *storage.SQLiteStorage
-	hub        *Hub
-	apnsClient *apns.Client
+	storage     storage.Storage
+	dispatcher  *notify.Dispatcher
+	subscribers *SubscriberAuth
+	owners      *OwnershipGuard
+	limiter     *RateLimiter
 }
 
 // NewBarkHandler creates a new Bark handler
-func NewBarkHandler(storage *storage.SQLiteStorage, hub *Hub, apnsClient *apns.Client) *BarkHandler {
+func NewBarkHandler(storage storage.Storage, dispatcher *notify.Dispatcher, subscribers *SubscriberAuth, owners *OwnershipGuard, limiter *RateLimiter) *BarkHandler {
 	return &BarkHandler{
-		storage:    storage,
-		hub:        hub,
-		apnsClient: apnsClient,
+		storage:     storage,
+		dispatcher:  dispatcher,
+		subscribers: subscribers,
+		owners:      owners,
+		limiter:     limiter,
 	}
 }
 
@@ -45,7 +48,7 @@ func (h *BarkHandler) HandleRegister(c *gin.Context) {
 		}
 	}
 
-	log.Printf("HandleRegister: deviceKey=%s, hasDeviceToken=%v", req.DeviceKey, req.DeviceToken != "")
+	requestLogger(c).Debug("register request", logging.Key(req.DeviceKey), "has_device_token", req.DeviceToken != "")
 
 	// Also try query parameters if not set from JSON
 	if req.DeviceKey == "" {
@@ -70,29 +73,60 @@ func (h *BarkHandler) HandleRegister(c *gin.Context) {
 		}
 	}
 
+	// The RSA key authenticates WebSocket connections, so it must be valid
+	if req.PublicKey != "" {
+		if _, err := h.subscribers.crypto.ParsePublicKey(req.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid public key"))
+			return
+		}
+	}
+
 	// Check if device exists
 	device, err := h.storage.GetDeviceByKey(req.DeviceKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		writeLookupError(c, err)
 		return
 	}
 
 	if device != nil {
-		// Update existing device
-		device.DeviceType = req.DeviceType
-		if req.DeviceToken != "" {
-			device.DeviceToken = req.DeviceToken
+		// Knowing the device key is not enough to redirect its messages
+		if reason := h.owners.Verify(c, device, &req); reason != "" {
+			if h.owners.Deny(c, device, &req, reason) {
+				c.JSON(http.StatusAccepted, model.NewBarkError(202, "change quarantined for review"))
+			} else {
+				c.JSON(http.StatusForbidden, model.NewBarkError(403, reason))
+			}
+			return
 		}
+
+		// Devices registered before subscriber secrets get one now, once, if
+		// the registration proves ownership against the device as it was
+		issue := device.SubscribeSecret == "" && h.owners.Proven(c, device, &req)
+
+		// Update existing device
+		applyRegistration(device, &req)
 		if err := h.storage.UpdateDevice(device); err != nil {
 			c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to update device"))
 			return
 		}
 
-		c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
+		var secret string
+		if issue {
+			if secret, err = h.subscribers.Issue(device); err != nil {
+				c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to update device"))
+				return
+			}
+		}
+
+		data := gin.H{
 			"key":         device.DeviceKey,
 			"device_key":  device.DeviceKey,
 			"device_type": device.DeviceType,
-		}))
+		}
+		if secret != "" {
+			data["subscribe_secret"] = secret
+		}
+		c.JSON(http.StatusOK, model.NewBarkResponse(data))
 		return
 	}
 
@@ -105,8 +139,13 @@ func (h *BarkHandler) HandleRegister(c *gin.Context) {
 		DeviceKey:   req.DeviceKey,
 		DeviceType:  req.DeviceType,
 		DeviceToken: req.DeviceToken,
+		PublicKey:   req.PublicKey,
 		Name:        req.Name,
 	}
+	if _, err := h.subscribers.Issue(newDevice); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to create device"))
+		return
+	}
 
 	if err := h.storage.CreateDevice(newDevice); err != nil {
 		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to create device"))
@@ -114,9 +153,10 @@ func (h *BarkHandler) HandleRegister(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
-		"key":         newDevice.DeviceKey,
-		"device_key":  newDevice.DeviceKey,
-		"device_type": newDevice.DeviceType,
+		"key":              newDevice.DeviceKey,
+		"device_key":       newDevice.DeviceKey,
+		"device_type":      newDevice.DeviceType,
+		"subscribe_secret": newDevice.SubscribeSecret,
 	}))
 }
 
@@ -135,7 +175,7 @@ func (h *BarkHandler) HandlePush(c *gin.Context) {
 	// Get device
 	device, err := h.storage.GetDeviceByKey(deviceKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		writeLookupError(c, err)
 		return
 	}
 	if device == nil {
@@ -143,7 +183,53 @@ func (h *BarkHandler) HandlePush(c *gin.Context) {
 		return
 	}
 
-	// Parse request - support JSON, form-data, and query parameters
+	req := parsePushRequest(c)
+	req.Normalize()
+
+	requestLogger(c).Debug("push received", logging.Key(deviceKey), "device_type", device.DeviceType,
+		logging.Text("title", req.Title), logging.Text("body", req.Body))
+
+	result, err := h.dispatcher.Dispatch(c.Request.Context(), device, &req)
+	writeBarkResult(c, result, err)
+}
+
+// HandleBatchPush handles POST /push (Bark-compatible, no key in the path).
+// A request carrying device_keys is fanned out to every listed device.
+func (h *BarkHandler) HandleBatchPush(c *gin.Context) {
+	req := parsePushRequest(c)
+	if req.DeviceKey == "" {
+		req.DeviceKey = c.Query("device_key")
+	}
+
+	keys := make([]string, 0, len(req.DeviceKeys)+1)
+	if req.DeviceKey != "" {
+		keys = append(keys, req.DeviceKey)
+	}
+	keys = append(keys, req.DeviceKeys...)
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "device_key is required"))
+		return
+	}
+
+	req.Normalize()
+	requestLogger(c).Debug("batch push received", "devices", len(keys),
+		logging.Text("title", req.Title), logging.Text("body", req.Body))
+
+	// Single device: respond exactly like /:device_key
+	if len(req.DeviceKeys) == 0 {
+		if ok, wait := h.limiter.AllowDevice(req.DeviceKey); !ok {
+			h.limiter.reject(c, wait, "too many requests for this device")
+			return
+		}
+		c.JSON(resultStatus(h.dispatcher.DispatchToKey(c.Request.Context(), req.DeviceKey, &req)))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(h.limiter.dispatchLimited(c.Request.Context(), h.dispatcher, keys, &req)))
+}
+
+// parsePushRequest parses a push request from JSON, form-data and query parameters
+func parsePushRequest(c *gin.Context) model.PushRequest {
 	var req model.PushRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		// JSON binding failed, try form-data and query parameters
@@ -177,43 +263,19 @@ func (h *BarkHandler) HandlePush(c *gin.Context) {
 	if req.Level == "" {
 		req.Level = c.Query("level")
 	}
-	
-	// SMS Forwarder compatibility: check alternative field names for body
-	// Common field names: body, content, msg, message, text, desp, description
-	if req.Body == "" {
-		if req.Content != "" {
-			req.Body = req.Content
-		} else if req.Msg != "" {
-			req.Body = req.Msg
-		} else if req.Message != "" {
-			req.Body = req.Message
-		} else if req.Text != "" {
-			req.Body = req.Text
-		} else if req.Desp != "" {
-			req.Body = req.Desp
-		} else if req.Description != "" {
-			req.Body = req.Description
-		}
-	}
-	// Default title if empty
-	if req.Title == "" {
-		req.Title = "Abnotify"
-	}
-	
-	log.Printf("BarkHandler.HandlePush: deviceKey=%s, Title='%s', Body='%s', Content='%s', Msg='%s'", 
-		deviceKey, req.Title, req.Body, req.Content, req.Msg)
-	log.Printf("BarkHandler.HandlePush: deviceType=%s, hasAPNs=%v", device.DeviceType, h.apnsClient != nil)
+	applyIdempotencyKey(c, &req)
 
-	// Generate message ID
-	messageID := uuid.New().String()
+	return req
+}
 
-	// Push based on device type
-	if device.DeviceType == model.DeviceTypeIOS {
-		log.Printf("BarkHandler.HandlePush: pushing to iOS")
-		h.pushToIOS(device, &req, messageID, c)
-	} else {
-		log.Printf("BarkHandler.HandlePush: pushing to Android (deviceType=%s)", device.DeviceType)
-		h.pushToAndroid(device, &req, messageID, c)
+// applyIdempotencyKey takes the idempotency key from the Idempotency-Key
+// header or idempotency_key query parameter when the body has none
+func applyIdempotencyKey(c *gin.Context, req *model.PushRequest) {
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = c.GetHeader("Idempotency-Key")
+	}
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = c.Query("idempotency_key")
 	}
 }
 
@@ -222,8 +284,9 @@ func (h *BarkHandler) HandleSimplePush(c *gin.Context) {
 	deviceKey := c.Param("device_key")
 	title := c.Param("title")
 	body := c.Param("body")
-	
-	log.Printf("HandleSimplePush: deviceKey=%s, title=%s, body=%s", deviceKey, title, body)
+
+	requestLogger(c).Debug("simple push received", logging.Key(deviceKey),
+		logging.Text("title", title), logging.Text("body", body))
 
 	// If only one param, treat it as body
 	if body == "" {
@@ -234,7 +297,7 @@ func (h *BarkHandler) HandleSimplePush(c *gin.Context) {
 	// Get device
 	device, err := h.storage.GetDeviceByKey(deviceKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		writeLookupError(c, err)
 		return
 	}
 	if device == nil {
@@ -284,144 +347,65 @@ func (h *BarkHandler) HandleSimplePush(c *gin.Context) {
 	if q := c.Query("id"); q != "" {
 		req.ID = q
 	}
-
-	messageID := uuid.New().String()
-
-	// Push based on device type
-	if device.DeviceType == model.DeviceTypeIOS {
-		h.pushToIOS(device, req, messageID, c)
-	} else {
-		h.pushToAndroid(device, req, messageID, c)
+	if q := c.Query("delete"); q != "" {
+		req.Delete = q == "1" || q == "true"
 	}
-}
-
-// pushToIOS pushes message to iOS device via APNs
-func (h *BarkHandler) pushToIOS(device *model.Device, req *model.PushRequest, messageID string, c *gin.Context) {
-	if h.apnsClient == nil {
-		// APNs not configured, fall back to WebSocket (for Android devices registered with iOS type)
-		log.Printf("pushToIOS: APNs not configured, falling back to WebSocket push")
-		h.pushToAndroid(device, req, messageID, c)
-		return
+	if q := c.Query("send_at"); q != "" {
+		req.SendAt = model.FlexString(q)
 	}
-
-	if device.DeviceToken == "" {
-		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "device token not found"))
-		return
+	if q := c.Query("delay"); q != "" {
+		req.Delay = model.FlexString(q)
 	}
-
-	// Build APNs payload
-	sound := req.Sound
-	if sound != "" && !strings.HasSuffix(sound, ".caf") {
-		sound += ".caf"
-	}
-	if sound == "" {
-		sound = "1107.caf"
+	if q := c.Query("ttl"); q != "" {
+		req.TTL = model.FlexString(q)
 	}
+	applyIdempotencyKey(c, req)
 
-	// Handle call (持续响铃)
-	if req.Call {
-		sound = "alarm.caf"
-	}
-
-	// Prepare badge
-	var badge *int
-	if req.Badge > 0 {
-		badge = &req.Badge
-	}
-
-	payload := &apns.Payload{
-		Aps: apns.Aps{
-			Alert: apns.Alert{
-				Title:    req.Title,
-				Subtitle: req.Subtitle,
-				Body:     req.Body,
-			},
-			Badge:          badge,
-			Sound:          sound,
-			ThreadID:       req.Group,
-			Category:       "myNotificationCategory",
-			MutableContent: 1,
-		},
-		Group:     req.Group,
-		Icon:      req.Icon,
-		Image:     req.Image,
-		URL:       req.URL,
-		Badge:     req.Badge,
-		Call:      req.Call,
-		IsArchive: req.IsArchive,
-		Level:     req.Level,
-		Delete:    req.Delete,
-	}
-
-	// Send to APNs
-	headers := make(map[string]string)
-	if req.ID != "" {
-		headers["apns-collapse-id"] = req.ID
-	}
+	result, err := h.dispatcher.Dispatch(c.Request.Context(), device, req)
+	writeBarkResult(c, result, err)
+}
 
-	resp, err := h.apnsClient.Push(device.DeviceToken, payload, headers)
+// writeBarkResult writes a dispatch result in the Bark response format
+func writeBarkResult(c *gin.Context, result *model.DeliveryResult, err error) {
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "APNs push failed: "+err.Error()))
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to store message"))
 		return
 	}
 
-	if resp.StatusCode == 200 {
-		c.JSON(http.StatusOK, model.NewBarkResponse(nil))
-		return
-	}
-
-	// Handle errors
-	if resp.StatusCode == 410 || strings.Contains(resp.Reason, "BadDeviceToken") {
-		// Device token invalid, clear it
-		h.storage.UpdateDeviceToken(device.DeviceKey, "")
-	}
-
-	c.JSON(http.StatusBadRequest, model.NewBarkError(int64(resp.StatusCode), "APNs push failed: "+resp.Reason))
+	c.JSON(resultStatus(result))
 }
 
-// pushToAndroid pushes message to Android device via WebSocket
-func (h *BarkHandler) pushToAndroid(device *model.Device, req *model.PushRequest, messageID string, c *gin.Context) {
-	// Create WebSocket message
-	wsMsg := &model.WSMessage{
-		Type:      model.WSTypeMessage,
-		ID:        messageID,
-		Timestamp: time.Now().Unix(),
-		Data: map[string]interface{}{
-			"title":     req.Title,
-			"body":      req.Body,
-			"group":     req.Group,
-			"icon":      req.Icon,
-			"url":       req.URL,
-			"sound":     req.Sound,
-			"badge":     req.Badge,
-			"level":     req.Level,
-			"call":      req.Call,
-			"isArchive": req.IsArchive,
-		},
-	}
-
-	// Send via WebSocket
-	delivered := h.hub.SendToDevice(device.DeviceKey, wsMsg)
-	log.Printf("Push to Android device %s: delivered=%v, title=%s, body=%s", device.DeviceKey, delivered, req.Title, req.Body)
-
-	if delivered {
-		c.JSON(http.StatusOK, model.NewBarkResponse(nil))
-	} else {
-		// Device offline, save message
-		msg := &model.Message{
-			DeviceID:  device.ID,
-			MessageID: messageID,
-			Title:     req.Title,
-			Body:      req.Body,
-			Group:     req.Group,
-			Icon:      req.Icon,
-			URL:       req.URL,
-			Sound:     req.Sound,
-			Badge:     req.Badge,
+// resultStatus maps a dispatch result to an HTTP status and Bark response
+func resultStatus(result *model.DeliveryResult) (int, *model.BarkResponse) {
+	if result.OK() {
+		if result.ScheduleID != "" {
+			data := gin.H{
+				"message_id":  result.MessageID,
+				"schedule_id": result.ScheduleID,
+			}
+			if result.SendAt != 0 {
+				data["send_at"] = result.SendAt
+			}
+			if result.Duplicate {
+				data["duplicate"] = true
+			}
+			return http.StatusOK, model.NewBarkResponse(data)
+		}
+		if result.Duplicate {
+			return http.StatusOK, model.NewBarkResponse(gin.H{
+				"message_id": result.MessageID,
+				"duplicate":  true,
+			})
 		}
-		h.storage.CreateMessage(msg)
-		c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+		return http.StatusOK, model.NewBarkResponse(nil)
+	}
+
+	status := http.StatusBadRequest
+	switch result.Code {
+	case http.StatusInternalServerError, http.StatusNotFound, http.StatusGone, http.StatusTooManyRequests:
+		status = result.Code
 	}
+	return status, model.NewBarkError(int64(result.Code), result.Error)
 }
 
 // HandleHealth handles health check
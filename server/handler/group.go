@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxGroupNameLength = 64
+
+// GroupHandler handles device group management and group pushes
+type GroupHandler struct {
+	storage    storage.Storage
+	dispatcher *notify.Dispatcher
+	limiter    *RateLimiter
+	crypto     *crypto.Crypto
+}
+
+// NewGroupHandler creates a new group handler
+func NewGroupHandler(storage storage.Storage, dispatcher *notify.Dispatcher, limiter *RateLimiter) *GroupHandler {
+	return &GroupHandler{
+		storage:    storage,
+		dispatcher: dispatcher,
+		limiter:    limiter,
+		crypto:     crypto.NewCrypto(),
+	}
+}
+
+// HandleCreate handles POST /groups
+// The generated token is only returned here and is required for every other group call.
+func (h *GroupHandler) HandleCreate(c *gin.Context) {
+	var req model.GroupRequest
+	if err := c.ShouldBind(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "name is required"))
+		return
+	}
+	if len(req.Name) > maxGroupNameLength || strings.Contains(req.Name, "/") {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid group name"))
+		return
+	}
+
+	existing, err := h.storage.GetGroupByName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, "group already exists"))
+		return
+	}
+
+	token, err := h.crypto.GenerateDeviceKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to generate token"))
+		return
+	}
+
+	group := &model.DeviceGroup{Name: req.Name, Token: token}
+	if err := h.storage.CreateGroup(group); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to create group"))
+		return
+	}
+
+	missing, err := h.addMembers(group, req.DeviceKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to add members"))
+		return
+	}
+
+	requestLogger(c).Info("group created", "group", group.Name, "members", len(group.Members))
+	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
+		"group":   group,
+		"missing": missing,
+	}))
+}
+
+// HandleGet handles GET /groups/:name
+func (h *GroupHandler) HandleGet(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+
+	group.Token = ""
+	c.JSON(http.StatusOK, model.NewBarkResponse(group))
+}
+
+// HandleDelete handles DELETE /groups/:name
+func (h *GroupHandler) HandleDelete(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+
+	if err := h.storage.DeleteGroup(group.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to delete group"))
+		return
+	}
+
+	requestLogger(c).Info("group deleted", "group", group.Name)
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+// HandleAddMembers handles POST /groups/:name/members
+func (h *GroupHandler) HandleAddMembers(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+
+	var req model.GroupRequest
+	if err := c.ShouldBind(&req); err != nil || len(req.DeviceKeys) == 0 {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "device_keys is required"))
+		return
+	}
+
+	missing, err := h.addMembers(group, req.DeviceKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to add members"))
+		return
+	}
+
+	group.Token = ""
+	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{
+		"group":   group,
+		"missing": missing,
+	}))
+}
+
+// HandleRemoveMember handles DELETE /groups/:name/members/:device_key
+func (h *GroupHandler) HandleRemoveMember(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+
+	device, err := h.storage.GetDeviceByKey(c.Param("device_key"))
+	if err != nil {
+		writeLookupError(c, err)
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return
+	}
+
+	removed, err := h.storage.RemoveGroupMember(group.ID, device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to remove member"))
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device is not a member of the group"))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+// HandlePush handles GET/POST /group/:name, fanning the message out to all members
+func (h *GroupHandler) HandlePush(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+	if len(group.Members) == 0 {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "group has no members"))
+		return
+	}
+
+	req := parsePushRequest(c)
+	req.Normalize()
+	if req.Group == "" {
+		req.Group = group.Name
+	}
+
+	requestLogger(c).Debug("group push received", "group", group.Name, "members", len(group.Members),
+		logging.Text("title", req.Title), logging.Text("body", req.Body))
+
+	push := &model.GroupPush{
+		PushID:    uuid.New().String(),
+		Group:     group.Name,
+		CreatedAt: time.Now(),
+		Results:   h.limiter.dispatchLimited(c.Request.Context(), h.dispatcher, group.Members, &req),
+	}
+
+	if err := h.storage.SaveGroupPush(group.ID, push); err != nil {
+		requestLogger(c).Error("failed to save group push results", "push_id", push.PushID, "error", err)
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(push))
+}
+
+// HandleGetPush handles GET /groups/:name/pushes/:push_id
+func (h *GroupHandler) HandleGetPush(c *gin.Context) {
+	group := h.authorize(c)
+	if group == nil {
+		return
+	}
+
+	push, err := h.storage.GetGroupPush(group.ID, c.Param("push_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if push == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "push not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(push))
+}
+
+// authorize loads the group from the path and checks its token.
+// It writes the error response and returns nil on failure.
+func (h *GroupHandler) authorize(c *gin.Context) *model.DeviceGroup {
+	group, err := h.storage.GetGroupByName(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return nil
+	}
+	if group == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "group not found"))
+		return nil
+	}
+
+	token := c.Query("token")
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(group.Token)) != 1 {
+		c.JSON(http.StatusUnauthorized, model.NewBarkError(401, "invalid group token"))
+		return nil
+	}
+
+	return group
+}
+
+// addMembers adds the devices to the group and returns keys that do not exist
+func (h *GroupHandler) addMembers(group *model.DeviceGroup, deviceKeys []string) ([]string, error) {
+	missing := []string{}
+	for _, key := range deviceKeys {
+		device, err := h.storage.GetDeviceByKey(key)
+		if err != nil && !errors.Is(err, storage.ErrDeviceKeyRetired) {
+			return nil, err
+		}
+		if device == nil {
+			missing = append(missing, key)
+			continue
+		}
+		if err := h.storage.AddGroupMember(group.ID, device.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	members, err := h.storage.GetGroupMembers(group.ID)
+	if err != nil {
+		return nil, err
+	}
+	group.Members = members
+	return missing, nil
+}
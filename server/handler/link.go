@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// LinkHandler links the devices of one user so they share read state
+type LinkHandler struct {
+	storage     storage.Storage
+	crypto      *crypto.Crypto
+	subscribers *SubscriberAuth
+}
+
+// NewLinkHandler creates a new link handler
+func NewLinkHandler(storage storage.Storage, subscribers *SubscriberAuth) *LinkHandler {
+	return &LinkHandler{
+		storage:     storage,
+		crypto:      crypto.NewCrypto(),
+		subscribers: subscribers,
+	}
+}
+
+// HandleGet handles GET /link/:device_key
+func (h *LinkHandler) HandleGet(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	token, err := h.storage.GetDeviceLink(device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if token == "" {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device is not linked"))
+		return
+	}
+
+	h.writeLink(c, device, token)
+}
+
+// HandleLink handles POST /link/:device_key
+// Without a token a new link is created (or the current one returned);
+// with a token from another device the device joins that link.
+func (h *LinkHandler) HandleLink(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	var req model.LinkRequest
+	c.ShouldBind(&req)
+	if req.Token == "" {
+		req.Token = c.Query("token")
+	}
+
+	token, err := h.storage.GetDeviceLink(device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	switch {
+	case req.Token != "":
+		members, err := h.storage.GetLinkedDevices(req.Token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+			return
+		}
+		if len(members) == 0 {
+			c.JSON(http.StatusNotFound, model.NewBarkError(404, "link not found"))
+			return
+		}
+		token = req.Token
+	case token == "":
+		token, err = h.crypto.GenerateDeviceKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to generate token"))
+			return
+		}
+	}
+
+	if err := h.storage.SetDeviceLink(device.ID, token); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to link device"))
+		return
+	}
+
+	requestLogger(c).Info("device linked", logging.Key(device.DeviceKey), "joined", req.Token != "")
+	h.writeLink(c, device, token)
+}
+
+// HandleUnlink handles DELETE /link/:device_key
+func (h *LinkHandler) HandleUnlink(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	if err := h.storage.SetDeviceLink(device.ID, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to unlink device"))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+// writeLink writes the link with its member devices
+func (h *LinkHandler) writeLink(c *gin.Context, device *model.Device, token string) {
+	members, err := h.storage.GetLinkedDevices(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	link := &model.DeviceLink{Token: token, Devices: make([]*model.LinkedDevice, 0, len(members))}
+	for _, m := range members {
+		link.Devices = append(link.Devices, &model.LinkedDevice{
+			DeviceType: m.DeviceType,
+			Name:       m.Name,
+			LastSeen:   m.LastSeen,
+			Current:    m.ID == device.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(link))
+}
+
+// getDevice loads the device from the path and checks the subscriber secret,
+// writing the error response on failure
+func (h *LinkHandler) getDevice(c *gin.Context) *model.Device {
+	device, err := h.storage.GetDeviceByKey(c.Param("device_key"))
+	if err != nil {
+		writeLookupError(c, err)
+		return nil
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return nil
+	}
+	if msg := h.subscribers.Check(c.Request, device); msg != "" {
+		c.JSON(http.StatusUnauthorized, model.NewBarkError(401, msg))
+		return nil
+	}
+	return device
+}
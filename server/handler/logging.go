@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/abnotify/server/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 64
+
+// quietRoutes are probes and scrapes logged at debug level only
+var quietRoutes = map[string]bool{
+	"/health":  true,
+	"/healthz": true,
+	"/ping":    true,
+	"/metrics": true,
+}
+
+// RequestLogger gives each request an ID, taken from X-Request-ID when the
+// client sent a valid one, returns it in X-Request-ID and carries it in the
+// request context. Requests are logged by route pattern as paths contain
+// device keys and, for Bark routes, message content.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		c.Header("X-Request-ID", id)
+		ctx := logging.WithRequestID(c.Request.Context(), id)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", route,
+			"status", status,
+			"duration", time.Since(start),
+			"client_ip", c.ClientIP(),
+		}
+		if logging.Sensitive() {
+			attrs = append(attrs, "path", c.Request.URL.RequestURI())
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case quietRoutes[route]:
+			level = slog.LevelDebug
+		}
+		logging.FromContext(ctx).Log(ctx, level, "request", attrs...)
+	}
+}
+
+// validRequestID reports whether a client supplied request ID is safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the logger for the request, tagged with its ID
+func requestLogger(c *gin.Context) *slog.Logger {
+	return logging.FromContext(c.Request.Context())
+}
@@ -0,0 +1,355 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// MessageHandler handles queries on individual stored messages
+type MessageHandler struct {
+	storage     storage.Storage
+	dispatcher  *notify.Dispatcher
+	subscribers *SubscriberAuth
+}
+
+// NewMessageHandler creates a new message handler
+func NewMessageHandler(storage storage.Storage, dispatcher *notify.Dispatcher, subscribers *SubscriberAuth) *MessageHandler {
+	return &MessageHandler{
+		storage:     storage,
+		dispatcher:  dispatcher,
+		subscribers: subscribers,
+	}
+}
+
+// HandleStatus handles GET /message/:message_id
+// The caller must present the target device key (?key=) or the token of the
+// group the message was pushed through (?token= or Authorization: Bearer).
+func (h *MessageHandler) HandleStatus(c *gin.Context) {
+	messageID := c.Param("message_id")
+	events, err := h.storage.GetMessageEvents(messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if len(events) == 0 {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+
+	if !h.authorize(c, messageID, events[0].DeviceID) {
+		// Do not reveal whether the message exists
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+
+	status := &model.MessageStatus{
+		MessageID: messageID,
+		State:     events[len(events)-1].State,
+		Events:    events,
+	}
+	for _, e := range events {
+		switch e.State {
+		case model.MessageStateAcked, model.MessageStateAPNsAccepted:
+			status.Delivered = true
+		}
+		if e.ApnsID != "" || e.State == model.MessageStateAPNsRejected || e.State == model.MessageStateFailed {
+			status.ApnsID = e.ApnsID
+			status.Reason = e.Reason
+		}
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(status))
+}
+
+// HandleRecall handles DELETE /message/:message_id
+// Removes the stored message and asks the device to dismiss the notification.
+// Authorized like HandleStatus.
+func (h *MessageHandler) HandleRecall(c *gin.Context) {
+	messageID := c.Param("message_id")
+	events, err := h.storage.GetMessageEvents(messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if len(events) == 0 || !h.authorize(c, messageID, events[0].DeviceID) {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+
+	device, err := h.storage.GetDeviceByID(events[0].DeviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return
+	}
+
+	result, err := h.dispatcher.Recall(c.Request.Context(), device, messageID)
+	writeBarkResult(c, result, err)
+}
+
+// HandleRead handles POST /message/:message_id/read?key=&secret=
+// Marks the message read and clears it on the devices linked with its device.
+func (h *MessageHandler) HandleRead(c *gin.Context) {
+	device, err := h.storage.GetDeviceByKey(c.Query("key"))
+	if err != nil {
+		writeLookupError(c, err)
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+	if msg := h.subscribers.Check(c.Request, device); msg != "" {
+		c.JSON(http.StatusUnauthorized, model.NewBarkError(401, msg))
+		return
+	}
+
+	found, err := h.dispatcher.MarkRead(c.Request.Context(), device, c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// HandleHistory handles GET /history/:device_key
+// Query: limit, cursor (from next_cursor), group, since, until (RFC 3339 or unix), delivered (true/false)
+func (h *MessageHandler) HandleHistory(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	filter := &model.HistoryFilter{
+		Group: c.Query("group"),
+		Limit: defaultHistoryLimit,
+	}
+	if q := c.Query("limit"); q != "" {
+		limit, err := strconv.Atoi(q)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid limit"))
+			return
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+		filter.Limit = limit
+	}
+	if q := c.Query("cursor"); q != "" {
+		before, err := strconv.ParseInt(q, 10, 64)
+		if err != nil || before <= 0 {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid cursor"))
+			return
+		}
+		filter.Before = before
+	}
+	if q := c.Query("since"); q != "" {
+		since, err := model.ParseTime(q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid since, expected RFC 3339 or unix time"))
+			return
+		}
+		filter.Since = since
+	}
+	if q := c.Query("until"); q != "" {
+		until, err := model.ParseTime(q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid until, expected RFC 3339 or unix time"))
+			return
+		}
+		filter.Until = until
+	}
+	if q := c.Query("delivered"); q != "" {
+		delivered, err := strconv.ParseBool(q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid delivered, expected true or false"))
+			return
+		}
+		filter.Delivered = &delivered
+	}
+
+	messages, err := h.storage.GetMessageHistory(device.ID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	page := &model.HistoryPage{Messages: messages}
+	if len(messages) == filter.Limit {
+		page.NextCursor = strconv.FormatInt(messages[len(messages)-1].ID, 10)
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(page))
+}
+
+// HandleDeleteHistory handles DELETE /history/:device_key?group=
+// Deletes every message of the device in the group.
+func (h *MessageHandler) HandleDeleteHistory(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	group := c.Query("group")
+	if group == "" {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "group is required"))
+		return
+	}
+
+	deleted, err := h.storage.DeleteMessagesByGroup(device.ID, group)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	requestLogger(c).Info("history deleted", logging.Key(device.DeviceKey), "group", group, "deleted", deleted)
+	c.JSON(http.StatusOK, model.NewBarkResponse(gin.H{"deleted": deleted}))
+}
+
+// HandleDeleteMessage handles DELETE /history/:device_key/:message_id
+func (h *MessageHandler) HandleDeleteMessage(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	deleted, err := h.storage.DeleteMessage(device.ID, c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "message not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+// HandleSearch handles GET /search/:device_key?q=
+// Query: q (required), group, limit, offset. Results are ranked best match first.
+func (h *MessageHandler) HandleSearch(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "q is required"))
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid limit"))
+			return
+		}
+		if n > maxHistoryLimit {
+			n = maxHistoryLimit
+		}
+		limit = n
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid offset"))
+			return
+		}
+		offset = n
+	}
+
+	results, err := h.storage.SearchMessages(device.ID, q, c.Query("group"), limit, offset)
+	if err != nil {
+		requestLogger(c).Error("message search failed", "error", err)
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+
+	page := &model.SearchPage{Query: q, Results: results}
+	if len(results) == limit {
+		page.NextOffset = offset + limit
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(page))
+}
+
+// getDevice loads the device from the path and checks the subscriber secret,
+// writing the error response on failure
+func (h *MessageHandler) getDevice(c *gin.Context) *model.Device {
+	device, err := h.storage.GetDeviceByKey(c.Param("device_key"))
+	if err != nil {
+		writeLookupError(c, err)
+		return nil
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return nil
+	}
+	if msg := h.subscribers.Check(c.Request, device); msg != "" {
+		c.JSON(http.StatusUnauthorized, model.NewBarkError(401, msg))
+		return nil
+	}
+	return device
+}
+
+// authorize checks the caller's device key or group token against the message
+func (h *MessageHandler) authorize(c *gin.Context, messageID string, deviceID int64) bool {
+	bearer := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	key := c.Query("key")
+	if key == "" {
+		key = c.Query("device_key")
+	}
+	if key == "" {
+		key = bearer
+	}
+	if key != "" {
+		device, err := h.storage.GetDeviceByKey(key)
+		if err == nil && device != nil && device.ID == deviceID {
+			return true
+		}
+	}
+
+	token := c.Query("token")
+	if token == "" {
+		token = bearer
+	}
+	if token == "" {
+		return false
+	}
+	tokens, err := h.storage.GetGroupTokensForMessage(messageID)
+	if err != nil {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
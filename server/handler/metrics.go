@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abnotify/server/metrics"
+	"github.com/abnotify/server/model"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec(
+		"abnotify_http_requests_total",
+		"HTTP requests by route, method and status code.",
+		"route", "method", "code",
+	)
+	httpDuration = metrics.NewHistogramVec(
+		"abnotify_http_request_duration_seconds",
+		"Time taken to handle HTTP requests by route.",
+		metrics.DefaultBuckets,
+		"route",
+	)
+	pushesReceived = metrics.NewCounterVec(
+		"abnotify_pushes_received_total",
+		"Push requests received by route (bark, push, batch, group, webhook type).",
+		"route",
+	)
+
+	wsConnects = metrics.NewCounterVec(
+		"abnotify_ws_connects_total",
+		"WebSocket clients registered with the hub.",
+	)
+	wsReconnects = metrics.NewCounterVec(
+		"abnotify_ws_reconnects_total",
+		"WebSocket clients registered by a device that was connected before since startup.",
+	)
+	wsAuthFailures = metrics.NewCounterVec(
+		"abnotify_ws_auth_failures_total",
+		"WebSocket connections closed because the challenge was not answered correctly.",
+	)
+	wsBufferFull = metrics.NewCounterVec(
+		"abnotify_ws_client_buffer_full_total",
+		"WebSocket clients disconnected because their send buffer was full.",
+	)
+	hubBroadcastBlocked = metrics.NewCounterVec(
+		"abnotify_hub_broadcast_blocked_total",
+		"Sends that waited because the hub broadcast channel was full.",
+	)
+)
+
+// pushRoutes maps the routes that accept pushes to their metrics label
+var pushRoutes = map[string]string{
+	"/:device_key":                "bark",
+	"/:device_key/*params":        "bark",
+	"/push/:device_key":           "push",
+	"/push/:device_key/*params":   "push",
+	"/push":                       "batch",
+	"/group/:name":                "group",
+	"/webhook/:device_key":        "webhook",
+	"/webhook/:device_key/github": "github",
+	"/webhook/:device_key/gitlab": "gitlab",
+	"/webhook/:device_key/docker": "docker",
+	"/webhook/:device_key/gitea":  "gitea",
+}
+
+// Metrics counts requests and their latency by route
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		if label, ok := pushRoutes[route]; ok {
+			pushesReceived.Inc(label)
+		}
+
+		c.Next()
+
+		httpRequests.Inc(route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		httpDuration.ObserveSince(start, route)
+	}
+}
+
+// MetricsAuth requires the metrics token returned by token as a bearer token.
+// Metrics are public when no token is configured.
+func MetricsAuth(token func() string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := token()
+		if token == "" {
+			c.Next()
+			return
+		}
+		bearer := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, model.NewBarkError(401, "unauthorized"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// BroadcastQueue returns the number of frames waiting in the hub broadcast
+// channel and its capacity
+func (h *Hub) BroadcastQueue() (int, int) {
+	return len(h.broadcast), cap(h.broadcast)
+}
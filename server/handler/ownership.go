@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// signatureMaxSkew bounds the age of a signed registration
+const signatureMaxSkew = 5 * time.Minute
+
+// reasonLegacyClaim denies changes to a device registered before ownership
+// proofs that present no other proof. They always wait for admin approval.
+const reasonLegacyClaim = "legacy device claim requires admin approval"
+
+// OwnershipGuard checks that registrations changing an existing device come
+// from its owner, so knowing a device key is not enough to hijack it
+type OwnershipGuard struct {
+	storage storage.Storage
+	crypto  *crypto.Crypto
+	// Keep failed changes for admin review instead of rejecting them
+	quarantine atomic.Bool
+}
+
+// NewOwnershipGuard creates a new registration ownership guard
+func NewOwnershipGuard(storage storage.Storage, quarantine bool) *OwnershipGuard {
+	g := &OwnershipGuard{
+		storage: storage,
+		crypto:  crypto.NewCrypto(),
+	}
+	g.quarantine.Store(quarantine)
+	return g
+}
+
+// SetQuarantine sets whether denied changes are kept for admin review
+func (g *OwnershipGuard) SetQuarantine(quarantine bool) {
+	g.quarantine.Store(quarantine)
+}
+
+// Verify checks the proof of ownership of a registration for an existing
+// device. Requests that change nothing need no proof. It returns why the
+// change is denied, or "".
+func (g *OwnershipGuard) Verify(c *gin.Context, device *model.Device, req *model.RegisterRequest) string {
+	if !changesDevice(device, req) {
+		return ""
+	}
+	return g.prove(c, device, req)
+}
+
+// Proven reports whether the registration proves ownership of the device,
+// whether or not it changes anything
+func (g *OwnershipGuard) Proven(c *gin.Context, device *model.Device, req *model.RegisterRequest) bool {
+	return g.prove(c, device, req) == ""
+}
+
+// prove checks the proof of ownership presented with a registration: the
+// subscribe secret (secret field, ?secret= or Authorization: Bearer) or a
+// signature of crypto.RegisterMessage by the device's public key. Devices
+// registered before ownership proofs have neither, so the APNs token they
+// were registered with is accepted instead; without one, the change is a
+// legacy claim for an admin to approve. It returns why the proof fails, or "".
+func (g *OwnershipGuard) prove(c *gin.Context, device *model.Device, req *model.RegisterRequest) string {
+	if device.SubscribeSecret == "" && device.PublicKey == "" {
+		if device.DeviceToken != "" &&
+			subtle.ConstantTimeCompare([]byte(req.DeviceToken), []byte(device.DeviceToken)) == 1 {
+			return ""
+		}
+		return reasonLegacyClaim
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		secret = c.Query("secret")
+	}
+	if secret == "" {
+		secret = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if secret != "" && device.SubscribeSecret != "" {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(device.SubscribeSecret)) != 1 {
+			return "invalid secret"
+		}
+		return ""
+	}
+
+	signature := req.Signature
+	if signature == "" {
+		signature = c.Query("signature")
+	}
+	if signature != "" && device.PublicKey != "" {
+		timestamp := req.Timestamp
+		if timestamp == 0 {
+			timestamp, _ = strconv.ParseInt(c.Query("timestamp"), 10, 64)
+		}
+		if skew := time.Since(time.Unix(timestamp, 0)); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+			return "signature timestamp out of range"
+		}
+		publicKey, err := g.crypto.ParsePublicKey(device.PublicKey)
+		if err != nil {
+			return "stored public key is invalid"
+		}
+		if err := g.crypto.VerifySignature(publicKey, crypto.RegisterMessage(device.DeviceKey, timestamp), signature); err != nil {
+			return "invalid signature"
+		}
+		return ""
+	}
+
+	return "proof of ownership required"
+}
+
+// Deny records a denied change for audit. It returns whether the change was
+// quarantined for admin review rather than rejected, as legacy claims always
+// are.
+func (g *OwnershipGuard) Deny(c *gin.Context, device *model.Device, req *model.RegisterRequest, reason string) bool {
+	attempt := &model.RegistrationAttempt{
+		DeviceID:    device.ID,
+		DeviceKey:   device.DeviceKey,
+		DeviceType:  req.DeviceType,
+		DeviceToken: req.DeviceToken,
+		PublicKey:   req.PublicKey,
+		ClientIP:    c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		Reason:      reason,
+		Status:      model.AttemptRejected,
+	}
+	quarantined := g.quarantine.Load() || reason == reasonLegacyClaim
+	if quarantined {
+		attempt.Status = model.AttemptQuarantined
+	}
+	if err := g.storage.CreateRegistrationAttempt(attempt); err != nil {
+		requestLogger(c).Error("failed to record registration attempt", "device_id", device.ID, "error", err)
+	}
+
+	requestLogger(c).Warn("registration change denied", "status", attempt.Status, "device_id", device.ID,
+		"client_ip", attempt.ClientIP, "reason", reason, "attempt_id", attempt.ID)
+	return quarantined
+}
+
+// Apply applies a reviewed attempt to its device
+func (g *OwnershipGuard) Apply(attempt *model.RegistrationAttempt) error {
+	device, err := g.storage.GetDeviceByID(attempt.DeviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return errors.New("device no longer exists")
+	}
+	applyRegistration(device, &model.RegisterRequest{
+		DeviceType:  attempt.DeviceType,
+		DeviceToken: attempt.DeviceToken,
+		PublicKey:   attempt.PublicKey,
+	})
+	return g.storage.UpdateDevice(device)
+}
+
+// changesDevice reports whether a registration changes how the device's
+// messages are delivered
+func changesDevice(device *model.Device, req *model.RegisterRequest) bool {
+	return (req.DeviceType != "" && req.DeviceType != device.DeviceType) ||
+		(req.DeviceToken != "" && req.DeviceToken != device.DeviceToken) ||
+		(req.PublicKey != "" && req.PublicKey != device.PublicKey)
+}
+
+// applyRegistration copies the delivery settings of a registration to the device
+func applyRegistration(device *model.Device, req *model.RegisterRequest) {
+	if req.DeviceType != "" {
+		device.DeviceType = req.DeviceType
+	}
+	if req.DeviceToken != "" {
+		device.DeviceToken = req.DeviceToken
+	}
+	if req.PublicKey != "" {
+		device.PublicKey = req.PublicKey
+	}
+}
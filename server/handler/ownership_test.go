@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	abcrypto "github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/model"
+	"github.com/gin-gonic/gin"
+)
+
+func TestChangesDevice(t *testing.T) {
+	device := &model.Device{DeviceType: "ios", DeviceToken: "token", PublicKey: "key"}
+
+	tests := []struct {
+		name string
+		req  model.RegisterRequest
+		want bool
+	}{
+		{"empty request", model.RegisterRequest{}, false},
+		{"same values", model.RegisterRequest{DeviceType: "ios", DeviceToken: "token", PublicKey: "key"}, false},
+		{"only a name", model.RegisterRequest{Name: "phone"}, false},
+		{"device type", model.RegisterRequest{DeviceType: "android"}, true},
+		{"device token", model.RegisterRequest{DeviceToken: "other"}, true},
+		{"public key", model.RegisterRequest{PublicKey: "other"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changesDevice(device, &tt.req); got != tt.want {
+				t.Errorf("changesDevice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnershipGuardVerify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	sign := func(deviceKey string, timestamp int64) string {
+		hash := sha256.Sum256(abcrypto.RegisterMessage(deviceKey, timestamp))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	now := time.Now().Unix()
+	stale := now - int64(signatureMaxSkew/time.Second) - 60
+
+	legacy := &model.Device{DeviceKey: "legacy", DeviceType: "ios", DeviceToken: "apns-token"}
+	legacyAndroid := &model.Device{DeviceKey: "android", DeviceType: "android"}
+	withSecret := &model.Device{DeviceKey: "secret", DeviceType: "ios", DeviceToken: "apns-token", SubscribeSecret: "s3cret"}
+	withKey := &model.Device{DeviceKey: "signed", DeviceType: "android", PublicKey: publicKey}
+
+	tests := []struct {
+		name   string
+		device *model.Device
+		req    model.RegisterRequest
+		query  string
+		header string
+		want   string
+	}{
+		{"no change needs no proof", legacy, model.RegisterRequest{DeviceToken: "apns-token"}, "", "", ""},
+		{"legacy claim without proof", legacy, model.RegisterRequest{DeviceToken: "attacker"}, "", "", reasonLegacyClaim},
+		{"legacy device proven by its token", legacy, model.RegisterRequest{DeviceToken: "apns-token", PublicKey: "new"}, "", "", ""},
+		{"legacy device with wrong token", legacy, model.RegisterRequest{DeviceToken: "other", PublicKey: "new"}, "", "", reasonLegacyClaim},
+		{"legacy device ignores secret", legacy, model.RegisterRequest{DeviceToken: "other", Secret: "anything"}, "", "", reasonLegacyClaim},
+		{"legacy device without token", legacyAndroid, model.RegisterRequest{PublicKey: "new"}, "", "", reasonLegacyClaim},
+		{"secret in body", withSecret, model.RegisterRequest{DeviceToken: "new", Secret: "s3cret"}, "", "", ""},
+		{"secret in query", withSecret, model.RegisterRequest{DeviceToken: "new"}, "?secret=s3cret", "", ""},
+		{"secret in header", withSecret, model.RegisterRequest{DeviceToken: "new"}, "", "Bearer s3cret", ""},
+		{"wrong secret", withSecret, model.RegisterRequest{DeviceToken: "new", Secret: "guess"}, "", "", "invalid secret"},
+		{"secret device without proof", withSecret, model.RegisterRequest{DeviceToken: "new"}, "", "", "proof of ownership required"},
+		{"valid signature", withKey, model.RegisterRequest{DeviceToken: "new", Signature: sign("signed", now), Timestamp: now}, "", "", ""},
+		{"signature in query", withKey, model.RegisterRequest{DeviceToken: "new"},
+			"?signature=" + url.QueryEscape(sign("signed", now)) + "&timestamp=" + strconv.FormatInt(now, 10), "", ""},
+		{"stale signature", withKey, model.RegisterRequest{DeviceToken: "new", Signature: sign("signed", stale), Timestamp: stale}, "", "", "signature timestamp out of range"},
+		{"signature for another device", withKey, model.RegisterRequest{DeviceToken: "new", Signature: sign("other", now), Timestamp: now}, "", "", "invalid signature"},
+		{"secret for a key-only device", withKey, model.RegisterRequest{DeviceToken: "new", Secret: "s3cret"}, "", "", "proof of ownership required"},
+	}
+
+	guard := NewOwnershipGuard(nil, false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/register"+tt.query, nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+			if got := guard.Verify(c, tt.device, &tt.req); got != tt.want {
+				t.Errorf("Verify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
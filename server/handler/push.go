@@ -1,27 +1,31 @@
 package handler
 
 import (
-	"log"
 	"net/http"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"github.com/abnotify/server/logging"
 	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
 	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
 )
 
 // PushHandler handles push notification requests
 type PushHandler struct {
-	storage *storage.SQLiteStorage
-	hub     *Hub
+	storage     storage.Storage
+	dispatcher  *notify.Dispatcher
+	subscribers *SubscriberAuth
+	owners      *OwnershipGuard
 }
 
 // NewPushHandler creates a new push handler
-func NewPushHandler(storage *storage.SQLiteStorage, hub *Hub) *PushHandler {
+func NewPushHandler(storage storage.Storage, dispatcher *notify.Dispatcher, subscribers *SubscriberAuth, owners *OwnershipGuard) *PushHandler {
 	return &PushHandler{
-		storage: storage,
-		hub:     hub,
+		storage:     storage,
+		dispatcher:  dispatcher,
+		subscribers: subscribers,
+		owners:      owners,
 	}
 }
 
@@ -38,6 +42,9 @@ func (h *PushHandler) HandlePush(c *gin.Context) {
 
 	// Get device
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, model.PushResponse{
 			Success: false,
@@ -60,85 +67,13 @@ func (h *PushHandler) HandlePush(c *gin.Context) {
 		// Fall back to form-data binding
 		c.Bind(&req)
 	}
-	// Log received request for debugging
-	log.Printf("HandlePush received: deviceKey=%s, Title='%s', Body='%s', Content='%s', Msg='%s', Message='%s', Text='%s'", 
-		deviceKey, req.Title, req.Body, req.Content, req.Msg, req.Message, req.Text)
-	
-	// SMS Forwarder compatibility: check alternative field names for body
-	// Common field names: body, content, msg, message, text, desp, description
-	if req.Body == "" {
-		if req.Content != "" {
-			req.Body = req.Content
-		} else if req.Msg != "" {
-			req.Body = req.Msg
-		} else if req.Message != "" {
-			req.Body = req.Message
-		} else if req.Text != "" {
-			req.Body = req.Text
-		} else if req.Desp != "" {
-			req.Body = req.Desp
-		} else if req.Description != "" {
-			req.Body = req.Description
-		}
-	}
-	// Default title if empty
-	if req.Title == "" {
-		req.Title = "Abnotify"
-	}
-	log.Printf("HandlePush processed: Title='%s', Body='%s'", req.Title, req.Body)
-
-	// Generate message ID
-	messageID := uuid.New().String()
-
-	// Create message
-	msg := &model.Message{
-		DeviceID:  device.ID,
-		MessageID: messageID,
-		Title:     req.Title,
-		Body:      req.Body,
-		Group:     req.Group,
-		Icon:      req.Icon,
-		URL:       req.URL,
-		Sound:     req.Sound,
-		Badge:     req.Badge,
-	}
-
-	// Store message
-	if err := h.storage.CreateMessage(msg); err != nil {
-		c.JSON(http.StatusInternalServerError, model.PushResponse{
-			Success: false,
-			Error:   "Failed to store message",
-		})
-		return
-	}
-
-	// Prepare WebSocket message
-	wsMsg := &model.WSMessage{
-		Type:      model.WSTypeMessage,
-		ID:        messageID,
-		Timestamp: time.Now().Unix(),
-		Data: map[string]interface{}{
-			"title": req.Title,
-			"body":  req.Body,
-			"group": req.Group,
-			"icon":  req.Icon,
-			"url":   req.URL,
-			"sound": req.Sound,
-			"badge": req.Badge,
-		},
-	}
+	applyIdempotencyKey(c, &req)
+	req.Normalize()
+	requestLogger(c).Debug("push received", logging.Key(deviceKey),
+		logging.Text("title", req.Title), logging.Text("body", req.Body))
 
-	// Send via WebSocket
-	delivered := h.hub.SendToDevice(deviceKey, wsMsg)
-
-	if delivered {
-		h.storage.MarkMessageDelivered(messageID)
-	}
-
-	c.JSON(http.StatusOK, model.PushResponse{
-		Success:   true,
-		MessageID: messageID,
-	})
+	result, err := h.dispatcher.Dispatch(c.Request.Context(), device, &req)
+	writePushResult(c, result, err)
 }
 
 // HandleSimplePush handles GET /push/:device_key/:title/:body (Bark-compatible)
@@ -153,13 +88,14 @@ func (h *PushHandler) HandleSimplePush(c *gin.Context) {
 		title = "Abnotify"
 	}
 
-	log.Printf("PushHandler.HandleSimplePush: deviceKey=%s, title=%s, body=%s", deviceKey, title, body)
-
-	// Convert to POST request
-	c.Set("device_key", deviceKey)
+	requestLogger(c).Debug("simple push received", logging.Key(deviceKey),
+		logging.Text("title", title), logging.Text("body", body))
 
 	// Get device
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -168,16 +104,22 @@ func (h *PushHandler) HandleSimplePush(c *gin.Context) {
 		return
 	}
 
-	messageID := uuid.New().String()
-
-	msg := &model.Message{
-		DeviceID:  device.ID,
-		MessageID: messageID,
-		Title:     title,
-		Body:      body,
+	req := &model.PushRequest{
+		Title:  title,
+		Body:   body,
+		SendAt: model.FlexString(c.Query("send_at")),
+		Delay:  model.FlexString(c.Query("delay")),
+		TTL:    model.FlexString(c.Query("ttl")),
 	}
+	applyIdempotencyKey(c, req)
+
+	result, err := h.dispatcher.Dispatch(c.Request.Context(), device, req)
+	writePushResult(c, result, err)
+}
 
-	if err := h.storage.CreateMessage(msg); err != nil {
+// writePushResult writes a dispatch result in the Abnotify response format
+func writePushResult(c *gin.Context, result *model.DeliveryResult, err error) {
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, model.PushResponse{
 			Success: false,
 			Error:   "Failed to store message",
@@ -185,25 +127,24 @@ func (h *PushHandler) HandleSimplePush(c *gin.Context) {
 		return
 	}
 
-	wsMsg := &model.WSMessage{
-		Type:      model.WSTypeMessage,
-		ID:        messageID,
-		Timestamp: time.Now().Unix(),
-		Data: map[string]interface{}{
-			"title": title,
-			"body":  body,
-		},
-	}
-
-	delivered := h.hub.SendToDevice(deviceKey, wsMsg)
-	log.Printf("PushHandler.SendToDevice: deviceKey=%s, delivered=%v, title=%s, body=%s", deviceKey, delivered, title, body)
-	if delivered {
-		h.storage.MarkMessageDelivered(messageID)
+	if !result.OK() {
+		status := http.StatusInternalServerError
+		if result.Code == http.StatusBadRequest {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, model.PushResponse{
+			Success:   false,
+			MessageID: result.MessageID,
+			Error:     result.Error,
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, model.PushResponse{
-		Success:   true,
-		MessageID: messageID,
+		Success:    true,
+		MessageID:  result.MessageID,
+		ScheduleID: result.ScheduleID,
+		Duplicate:  result.Duplicate,
 	})
 }
 
@@ -220,6 +161,10 @@ func (h *PushHandler) HandleRegister(c *gin.Context) {
 
 	// Check if device exists
 	device, err := h.storage.GetDeviceByKey(req.DeviceKey)
+	// A rotated key must not be claimed by another device
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -229,9 +174,26 @@ func (h *PushHandler) HandleRegister(c *gin.Context) {
 	}
 
 	if device != nil {
+		// Knowing the device key is not enough to replace its public key
+		if reason := h.owners.Verify(c, device, &req); reason != "" {
+			status, message := http.StatusForbidden, reason
+			if h.owners.Deny(c, device, &req, reason) {
+				status, message = http.StatusAccepted, "change quarantined for review"
+			}
+			c.JSON(status, gin.H{
+				"success": false,
+				"error":   message,
+			})
+			return
+		}
+
+		// Devices registered before subscriber secrets get one now, once, if
+		// the registration proves ownership against the device as it was
+		issue := device.SubscribeSecret == "" && h.owners.Proven(c, device, &req)
+
 		// Update public key
 		if req.PublicKey != "" {
-			if err := h.storage.UpdateDevicePublicKey(req.DeviceKey, req.PublicKey); err != nil {
+			if err := h.storage.UpdateDevicePublicKey(device.DeviceKey, req.PublicKey); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"success": false,
 					"error":   "Failed to update public key",
@@ -239,11 +201,27 @@ func (h *PushHandler) HandleRegister(c *gin.Context) {
 				return
 			}
 		}
-		c.JSON(http.StatusOK, gin.H{
+
+		var secret string
+		if issue {
+			if secret, err = h.subscribers.Issue(device); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"success": false,
+					"error":   "Failed to update device",
+				})
+				return
+			}
+		}
+
+		resp := gin.H{
 			"success":    true,
-			"device_key": req.DeviceKey,
+			"device_key": device.DeviceKey,
 			"message":    "Device updated",
-		})
+		}
+		if secret != "" {
+			resp["subscribe_secret"] = secret
+		}
+		c.JSON(http.StatusOK, resp)
 		return
 	}
 
@@ -253,6 +231,13 @@ func (h *PushHandler) HandleRegister(c *gin.Context) {
 		PublicKey: req.PublicKey,
 		Name:      req.Name,
 	}
+	if _, err := h.subscribers.Issue(newDevice); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to create device",
+		})
+		return
+	}
 
 	if err := h.storage.CreateDevice(newDevice); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -263,9 +248,10 @@ func (h *PushHandler) HandleRegister(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success":    true,
-		"device_key": req.DeviceKey,
-		"message":    "Device registered",
+		"success":          true,
+		"device_key":       req.DeviceKey,
+		"subscribe_secret": newDevice.SubscribeSecret,
+		"message":          "Device registered",
 	})
 }
 
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimiter limits requests by client IP, target device key and sender token
+type RateLimiter struct {
+	mu     sync.RWMutex
+	ip     *ratelimit.Limiter
+	device *ratelimit.Limiter
+	token  *ratelimit.Limiter
+}
+
+// NewRateLimiter creates a new rate limiter. A nil limiter disables that key.
+func NewRateLimiter(ip, device, token *ratelimit.Limiter) *RateLimiter {
+	return &RateLimiter{
+		ip:     ip,
+		device: device,
+		token:  token,
+	}
+}
+
+// SetLimiters replaces the limiters, e.g. after the limits were reloaded.
+// Requests seen so far are forgotten.
+func (r *RateLimiter) SetLimiters(ip, device, token *ratelimit.Limiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ip, r.device, r.token = ip, device, token
+}
+
+// Middleware rejects requests over any limit with 429 and Retry-After
+func (r *RateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.mu.RLock()
+		ip, device, token := r.ip, r.device, r.token
+		r.mu.RUnlock()
+
+		if ok, wait := ip.Allow(c.ClientIP()); !ok {
+			r.reject(c, wait, "too many requests from this address")
+			return
+		}
+
+		deviceKey := c.Param("device_key")
+		if deviceKey == "" {
+			deviceKey = c.Query("key") // WebSocket
+		}
+		if ok, wait := device.Allow(deviceKey); !ok {
+			r.reject(c, wait, "too many requests for this device")
+			return
+		}
+
+		senderToken := c.Query("token")
+		if senderToken == "" {
+			senderToken = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if ok, wait := token.Allow(senderToken); !ok {
+			r.reject(c, wait, "too many requests for this token")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// AllowDevice applies the device limit to a key the middleware cannot see,
+// such as those in the body of POST /push
+func (r *RateLimiter) AllowDevice(deviceKey string) (bool, time.Duration) {
+	r.mu.RLock()
+	device := r.device
+	r.mu.RUnlock()
+	return device.Allow(deviceKey)
+}
+
+// dispatchLimited dispatches the request to the keys within their device rate
+// limit and reports the others as 429. It covers key lists the middleware
+// cannot see: POST /push bodies and group members. Duplicate keys are counted
+// and delivered once; results keep the order of first appearance.
+func (r *RateLimiter) dispatchLimited(ctx context.Context, dispatcher *notify.Dispatcher, keys []string, req *model.PushRequest) []*model.DeliveryResult {
+	seen := make(map[string]bool, len(keys))
+	results := make([]*model.DeliveryResult, 0, len(keys))
+	var allowed []string
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if ok, _ := r.AllowDevice(key); !ok {
+			results = append(results, &model.DeliveryResult{
+				DeviceKey: key,
+				Code:      http.StatusTooManyRequests,
+				Error:     "too many requests for this device",
+			})
+			continue
+		}
+		allowed = append(allowed, key)
+		results = append(results, nil)
+	}
+
+	// allowed has no duplicates, so its results line up with the gaps
+	dispatched := dispatcher.DispatchToKeys(ctx, allowed, req)
+	for i := range results {
+		if results[i] == nil {
+			results[i], dispatched = dispatched[0], dispatched[1:]
+		}
+	}
+	return results
+}
+
+// reject writes a Bark-style 429 response
+func (r *RateLimiter) reject(c *gin.Context, wait time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, model.NewBarkError(429, message))
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/ratelimit"
+)
+
+func TestDispatchLimited(t *testing.T) {
+	hub, store, device := newTestHub(t)
+	other := &model.Device{DeviceKey: "other", DeviceType: "android"}
+	if err := store.CreateDevice(other); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := notify.NewDispatcher(store, notify.NewWebSocketNotifier(hub))
+
+	// One push per device and minute
+	limiter := NewRateLimiter(nil, ratelimit.New(1, 1), nil)
+	if ok, _ := limiter.AllowDevice(other.DeviceKey); !ok {
+		t.Fatal("AllowDevice() denied the first request")
+	}
+
+	keys := []string{device.DeviceKey, other.DeviceKey, device.DeviceKey, ""}
+	results := limiter.dispatchLimited(context.Background(), dispatcher, keys, &model.PushRequest{Title: "t", Body: "b"})
+
+	want := []struct {
+		key  string
+		code int
+	}{
+		{device.DeviceKey, http.StatusOK},
+		{other.DeviceKey, http.StatusTooManyRequests},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("dispatchLimited() returned %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		if results[i].DeviceKey != w.key || results[i].Code != w.code {
+			t.Errorf("result %d = %s %d, want %s %d", i, results[i].DeviceKey, results[i].Code, w.key, w.code)
+		}
+	}
+	if results[1].MessageID != "" {
+		t.Error("rate limited device was dispatched to")
+	}
+}
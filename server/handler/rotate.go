@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// minDeviceKeyLength is the shortest key accepted when the client picks it
+const minDeviceKeyLength = 16
+
+// RotateHandler replaces leaked device keys without losing the device's history
+type RotateHandler struct {
+	storage     storage.Storage
+	hub         *Hub
+	crypto      *crypto.Crypto
+	subscribers *SubscriberAuth
+	maxGrace    atomic.Int64 // time.Duration
+}
+
+// NewRotateHandler creates a new key rotation handler
+func NewRotateHandler(storage storage.Storage, hub *Hub, subscribers *SubscriberAuth, maxGrace time.Duration) *RotateHandler {
+	h := &RotateHandler{
+		storage:     storage,
+		hub:         hub,
+		crypto:      crypto.NewCrypto(),
+		subscribers: subscribers,
+	}
+	h.SetMaxGrace(maxGrace)
+	return h
+}
+
+// SetMaxGrace sets the longest grace period a rotation may request
+func (h *RotateHandler) SetMaxGrace(maxGrace time.Duration) {
+	h.maxGrace.Store(int64(maxGrace))
+}
+
+// HandleRotate handles POST /rotate/:device_key
+// Replaces the device key, keeping the device's messages, groups and links.
+// The old key optionally keeps working for grace_period.
+func (h *RotateHandler) HandleRotate(c *gin.Context) {
+	oldKey := c.Param("device_key")
+	device, err := h.storage.GetDeviceByKey(oldKey)
+	if err != nil {
+		writeLookupError(c, err)
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return
+	}
+	if device.DeviceKey != oldKey {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, "device key has been rotated, use the current key"))
+		return
+	}
+
+	// The push key may be the one that leaked, only the subscriber can rotate
+	if device.SubscribeSecret == "" {
+		c.JSON(http.StatusForbidden, model.NewBarkError(403, "subscribe secret required, register the device again"))
+		return
+	}
+	if msg := h.subscribers.Check(c.Request, device); msg != "" {
+		c.JSON(http.StatusUnauthorized, model.NewBarkError(401, msg))
+		return
+	}
+
+	var req model.RotateKeyRequest
+	c.ShouldBind(&req)
+	if req.GracePeriod == "" {
+		req.GracePeriod = model.FlexString(c.Query("grace_period"))
+	}
+
+	var grace time.Duration
+	if req.GracePeriod != "" {
+		grace, err = model.ParseDuration(string(req.GracePeriod))
+		if err != nil || grace < 0 {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "invalid grace_period"))
+			return
+		}
+		if maxGrace := time.Duration(h.maxGrace.Load()); grace > maxGrace {
+			c.JSON(http.StatusBadRequest, model.NewBarkError(400, "grace_period exceeds "+maxGrace.String()))
+			return
+		}
+	}
+
+	newKey := req.NewKey
+	if newKey == "" {
+		newKey, err = h.crypto.GenerateDeviceKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "failed to generate device key"))
+			return
+		}
+	} else if len(newKey) < minDeviceKeyLength {
+		c.JSON(http.StatusBadRequest, model.NewBarkError(400, "new_key is too short"))
+		return
+	}
+
+	graceUntil := time.Now().Add(grace)
+	if err := h.storage.RotateDeviceKey(device.ID, oldKey, newKey, graceUntil); err != nil {
+		writeRotateError(c, err)
+		return
+	}
+
+	online := h.hub.RekeyDevice(c.Request.Context(), oldKey, newKey)
+	requestLogger(c).Info("device key rotated", "device_id", device.ID, "grace", grace, "online", online)
+
+	rotation := &model.KeyRotation{DeviceKey: newKey, OldKey: oldKey}
+	if grace > 0 {
+		rotation.GraceUntil = &graceUntil
+	}
+	c.JSON(http.StatusOK, model.NewBarkResponse(rotation))
+}
+
+// writeRotateError writes the response for a failed rotation: 409 when the
+// new key is taken or the old one was rotated meanwhile, 500 otherwise
+func writeRotateError(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrDeviceKeyInUse) || errors.Is(err, storage.ErrDeviceKeyRotated) {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, err.Error()))
+		return
+	}
+	c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+}
+
+// writeLookupError writes the response for a failed device lookup: 410 for
+// a key whose rotation grace period is over, 500 otherwise
+func writeLookupError(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrDeviceKeyRetired) {
+		c.JSON(http.StatusGone, model.NewBarkError(410, err.Error()))
+		return
+	}
+	c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+}
+
+// rejectRetiredKey writes 410 in the PushResponse format when the lookup
+// failed because the key was rotated away, and reports whether it did
+func rejectRetiredKey(c *gin.Context, err error) bool {
+	if !errors.Is(err, storage.ErrDeviceKeyRetired) {
+		return false
+	}
+	c.JSON(http.StatusGone, model.PushResponse{
+		Success: false,
+		Error:   "Device key has been retired",
+	})
+	return true
+}
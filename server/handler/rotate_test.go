@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyErrorResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if storage.ErrDeviceKeyRotated.Error() == storage.ErrDeviceKeyRetired.Error() {
+		t.Fatal("rotated and retired keys share an error text")
+	}
+
+	tests := []struct {
+		name     string
+		write    func(c *gin.Context, err error)
+		err      error
+		wantCode int
+		wantMsg  string
+	}{
+		{"retired key lookup", writeLookupError, storage.ErrDeviceKeyRetired, http.StatusGone, storage.ErrDeviceKeyRetired.Error()},
+		{"wrapped retired key lookup", writeLookupError, fmt.Errorf("lookup: %w", storage.ErrDeviceKeyRetired), http.StatusGone, "lookup: " + storage.ErrDeviceKeyRetired.Error()},
+		{"failed lookup", writeLookupError, errors.New("disk I/O error"), http.StatusInternalServerError, "database error"},
+		{"concurrent rotation", writeRotateError, storage.ErrDeviceKeyRotated, http.StatusConflict, storage.ErrDeviceKeyRotated.Error()},
+		{"new key in use", writeRotateError, storage.ErrDeviceKeyInUse, http.StatusConflict, storage.ErrDeviceKeyInUse.Error()},
+		{"failed rotation", writeRotateError, errors.New("disk I/O error"), http.StatusInternalServerError, "database error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			tt.write(c, tt.err)
+
+			var resp struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.wantCode || resp.Code != tt.wantCode || resp.Message != tt.wantMsg {
+				t.Errorf("response = %d %d %q, want %d %q", w.Code, resp.Code, resp.Message, tt.wantCode, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestRejectRetiredKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		err      error
+		want     bool
+		wantCode int
+	}{
+		{"retired key", storage.ErrDeviceKeyRetired, true, http.StatusGone},
+		{"concurrent rotation is not a retired key", storage.ErrDeviceKeyRotated, false, http.StatusOK},
+		{"no error", nil, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			if got := rejectRetiredKey(c, tt.err); got != tt.want {
+				t.Errorf("rejectRetiredKey() = %v, want %v", got, tt.want)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
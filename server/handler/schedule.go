@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleHandler handles listing and cancelling scheduled messages
+type ScheduleHandler struct {
+	storage storage.Storage
+}
+
+// NewScheduleHandler creates a new schedule handler
+func NewScheduleHandler(storage storage.Storage) *ScheduleHandler {
+	return &ScheduleHandler{
+		storage: storage,
+	}
+}
+
+// HandleList handles GET /schedule/:device_key
+func (h *ScheduleHandler) HandleList(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	messages, err := h.storage.GetPendingScheduledMessages(device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if messages == nil {
+		messages = []*model.ScheduledMessage{}
+	}
+
+	c.JSON(http.StatusOK, model.NewBarkResponse(messages))
+}
+
+// HandleCancel handles DELETE /schedule/:device_key/:schedule_id
+func (h *ScheduleHandler) HandleCancel(c *gin.Context) {
+	device := h.getDevice(c)
+	if device == nil {
+		return
+	}
+
+	sm, err := h.storage.GetScheduledMessage(c.Param("schedule_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if sm == nil || sm.DeviceID != device.ID {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "scheduled message not found"))
+		return
+	}
+
+	cancelled, err := h.storage.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusPending, model.ScheduleStatusCancelled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewBarkError(500, "database error"))
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusConflict, model.NewBarkError(409, "scheduled message is no longer pending"))
+		return
+	}
+
+	h.storage.AddMessageEvent(&model.MessageEvent{
+		MessageID: sm.MessageID,
+		DeviceID:  device.ID,
+		State:     model.MessageStateCancelled,
+	})
+
+	requestLogger(c).Info("scheduled message cancelled", logging.Key(device.DeviceKey), "schedule_id", sm.ScheduleID)
+	c.JSON(http.StatusOK, model.NewBarkResponse(nil))
+}
+
+// getDevice loads the device from the path, writing the error response on failure
+func (h *ScheduleHandler) getDevice(c *gin.Context) *model.Device {
+	device, err := h.storage.GetDeviceByKey(c.Param("device_key"))
+	if err != nil {
+		writeLookupError(c, err)
+		return nil
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, model.NewBarkError(404, "device not found"))
+		return nil
+	}
+	return device
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+// SubscriberAuth checks the subscriber secret that, unlike the device key,
+// allows receiving and managing a device's messages
+type SubscriberAuth struct {
+	storage storage.Storage
+	crypto  *crypto.Crypto
+	// Reject devices registered before subscriber secrets were introduced
+	requireSecret atomic.Bool
+}
+
+// NewSubscriberAuth creates a new subscriber secret checker
+func NewSubscriberAuth(storage storage.Storage, requireSecret bool) *SubscriberAuth {
+	a := &SubscriberAuth{
+		storage: storage,
+		crypto:  crypto.NewCrypto(),
+	}
+	a.requireSecret.Store(requireSecret)
+	return a
+}
+
+// SetRequireSecret sets whether devices without a secret are rejected
+func (a *SubscriberAuth) SetRequireSecret(requireSecret bool) {
+	a.requireSecret.Store(requireSecret)
+}
+
+// Check verifies the secret presented with the request (Authorization: Bearer
+// or ?secret=) against the device. It returns an error message when denied.
+func (a *SubscriberAuth) Check(r *http.Request, device *model.Device) string {
+	if device.SubscribeSecret == "" {
+		if a.requireSecret.Load() {
+			return "subscribe secret not issued, register the device again with proof of ownership"
+		}
+		return ""
+	}
+
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		secret = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(device.SubscribeSecret)) != 1 {
+		return "invalid subscribe secret"
+	}
+	return ""
+}
+
+// Issue generates the subscriber secret of a device that has none yet, so
+// devices registered before secrets existed get one when they prove
+// ownership or an admin issues it. It returns "" when the device already has
+// a secret.
+func (a *SubscriberAuth) Issue(device *model.Device) (string, error) {
+	if device.SubscribeSecret != "" {
+		return "", nil
+	}
+	secret, err := a.crypto.GenerateDeviceKey()
+	if err != nil {
+		return "", err
+	}
+	if device.ID != 0 {
+		claimed, err := a.storage.ClaimSubscribeSecret(device.ID, secret)
+		if err != nil || !claimed {
+			return "", err
+		}
+	}
+	device.SubscribeSecret = secret
+	return secret, nil
+}
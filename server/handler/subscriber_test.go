@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+func TestSubscriberAuthCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		secret        string // of the device
+		requireSecret bool
+		query         string
+		header        string
+		wantDenied    bool
+	}{
+		{"secret in query", "s3cret", false, "?secret=s3cret", "", false},
+		{"secret in header", "s3cret", false, "", "Bearer s3cret", false},
+		{"wrong secret", "s3cret", false, "?secret=wrong", "", true},
+		{"missing secret", "s3cret", false, "", "", true},
+		{"device key is not the secret", "s3cret", false, "?secret=device", "", true},
+		{"legacy device", "", false, "", "", false},
+		{"legacy device when secrets are required", "", true, "?secret=anything", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := NewSubscriberAuth(nil, tt.requireSecret)
+			r := httptest.NewRequest("GET", "/ws"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			device := &model.Device{DeviceKey: "device", SubscribeSecret: tt.secret}
+			if msg := auth.Check(r, device); (msg != "") != tt.wantDenied {
+				t.Errorf("Check() = %q, want denied %v", msg, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func TestSubscriberAuthSetRequireSecret(t *testing.T) {
+	auth := NewSubscriberAuth(nil, false)
+	r := httptest.NewRequest("GET", "/ws", nil)
+	legacy := &model.Device{DeviceKey: "device"}
+
+	auth.SetRequireSecret(true)
+	if auth.Check(r, legacy) == "" {
+		t.Error("legacy device accepted after requiring secrets")
+	}
+	auth.SetRequireSecret(false)
+	if msg := auth.Check(r, legacy); msg != "" {
+		t.Errorf("legacy device denied after the reload: %s", msg)
+	}
+}
+
+func TestSubscriberAuthIssue(t *testing.T) {
+	store, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "abnotify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	device := &model.Device{DeviceKey: "device", DeviceType: "android"}
+	if err := store.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	auth := NewSubscriberAuth(store, false)
+
+	// A concurrent request may still hold the device without a secret
+	stale := *device
+	secret, err := auth.Issue(device)
+	if err != nil || secret == "" {
+		t.Fatalf("Issue() = %q, %v, want a secret", secret, err)
+	}
+	if secret == device.DeviceKey {
+		t.Error("Issue() returned the device key")
+	}
+	if again, err := auth.Issue(&stale); err != nil || again != "" {
+		t.Errorf("Issue(stale device) = %q, %v, want no new secret", again, err)
+	}
+	if again, err := auth.Issue(device); err != nil || again != "" {
+		t.Errorf("Issue(device with a secret) = %q, %v, want none", again, err)
+	}
+
+	stored, err := store.GetDeviceByKey(device.DeviceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SubscribeSecret != secret {
+		t.Error("stored secret differs from the issued one")
+	}
+}
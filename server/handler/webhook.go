@@ -7,26 +7,23 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/abnotify/server/crypto"
 	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/notify"
 	"github.com/abnotify/server/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 // WebhookHandler handles webhook requests from various services
 type WebhookHandler struct {
-	storage *storage.SQLiteStorage
-	hub     *Hub
-	crypto  *crypto.Crypto
+	storage    storage.Storage
+	dispatcher *notify.Dispatcher
 }
 
 // NewWebhookHandler creates a new webhook handler
-func NewWebhookHandler(storage *storage.SQLiteStorage, hub *Hub) *WebhookHandler {
+func NewWebhookHandler(storage storage.Storage, dispatcher *notify.Dispatcher) *WebhookHandler {
 	return &WebhookHandler{
-		storage: storage,
-		hub:     hub,
-		crypto:  crypto.NewCrypto(),
+		storage:    storage,
+		dispatcher: dispatcher,
 	}
 }
 
@@ -43,6 +40,9 @@ func (h *WebhookHandler) HandleGenericWebhook(c *gin.Context) {
 
 	// Verify device exists
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -171,6 +171,9 @@ func (h *WebhookHandler) HandleGitHubWebhook(c *gin.Context) {
 	}
 
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -206,6 +209,9 @@ func (h *WebhookHandler) HandleGitLabWebhook(c *gin.Context) {
 	}
 
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -238,6 +244,9 @@ func (h *WebhookHandler) HandleDockerHubWebhook(c *gin.Context) {
 	}
 
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -270,6 +279,9 @@ func (h *WebhookHandler) HandleGiteaWebhook(c *gin.Context) {
 	}
 
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if rejectRetiredKey(c, err) {
+		return
+	}
 	if err != nil || device == nil {
 		c.JSON(http.StatusNotFound, model.PushResponse{
 			Success: false,
@@ -293,61 +305,21 @@ func (h *WebhookHandler) HandleGiteaWebhook(c *gin.Context) {
 
 // sendWebhookMessage sends a webhook message to device
 func (h *WebhookHandler) sendWebhookMessage(deviceKey string, device *model.Device, title, body string, c *gin.Context) {
-	messageID := uuid.New().String()
-
-	msg := &model.Message{
-		DeviceID:  device.ID,
-		MessageID: messageID,
-		Title:     title,
-		Body:      body,
-		Group:     "webhook",
-	}
-
-	// Encrypt if device has public key
-	var encryptedContent string
-	if device.PublicKey != "" {
-		publicKey, err := h.crypto.ParsePublicKey(device.PublicKey)
-		if err == nil {
-			payload := map[string]interface{}{
-				"title": title,
-				"body":  body,
-				"group": "webhook",
-			}
-			payloadBytes, _ := json.Marshal(payload)
-			encryptedContent, _ = h.crypto.EncryptMessage(publicKey, payloadBytes)
-			msg.EncryptedPayload = []byte(encryptedContent)
+	req := &model.PushRequest{
+		Title: title,
+		Body:  body,
+		Group: "webhook",
+	}
+	// GitHub and Gitea keep the delivery ID when a webhook is redelivered
+	applyIdempotencyKey(c, req)
+	for _, header := range []string{"X-GitHub-Delivery", "X-Gitea-Delivery"} {
+		if req.IdempotencyKey == "" {
+			req.IdempotencyKey = c.GetHeader(header)
 		}
 	}
 
-	if err := h.storage.CreateMessage(msg); err != nil {
-		c.JSON(http.StatusInternalServerError, model.PushResponse{
-			Success: false,
-			Error:   "Failed to store message",
-		})
-		return
-	}
-
-	wsMsg := &model.WSMessage{
-		Type:      model.WSTypeMessage,
-		ID:        messageID,
-		Timestamp: 0, // Will be set in hub
-		Data: map[string]interface{}{
-			"title":             title,
-			"body":              body,
-			"group":             "webhook",
-			"encrypted_content": encryptedContent,
-		},
-	}
-
-	delivered := h.hub.SendToDevice(deviceKey, wsMsg)
-	if delivered {
-		h.storage.MarkMessageDelivered(messageID)
-	}
-
-	c.JSON(http.StatusOK, model.PushResponse{
-		Success:   true,
-		MessageID: messageID,
-	})
+	result, err := h.dispatcher.Dispatch(c.Request.Context(), device, req)
+	writePushResult(c, result, err)
 }
 
 // formatGitHubWebhook formats GitHub webhook into readable message
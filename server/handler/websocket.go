@@ -1,30 +1,66 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/abnotify/server/logging"
 	"github.com/abnotify/server/model"
 	"github.com/abnotify/server/storage"
+	"github.com/gorilla/websocket"
 )
 
 const (
 	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = 30 * time.Second
 	maxMessageSize = 512 * 1024 // 512KB
+
+	// Defaults until SetTimeouts is called
+	defaultPingPeriod = 30 * time.Second
+	defaultPongWait   = 60 * time.Second
+
+	// Unacked messages are resent after ackTimeout; after maxSendAttempts
+	// the connection is considered dead and closed so the client reconnects
+	ackTimeout      = 30 * time.Second
+	ackCheckPeriod  = 10 * time.Second
+	maxSendAttempts = 3
 )
 
 // Client represents a WebSocket client connection
 type Client struct {
 	hub       *Hub
 	conn      *websocket.Conn
-	send      chan []byte
-	deviceKey string
+	send      chan *outboundFrame
+	deviceKey string // set on connect and never changed
 	deviceID  int64
+	requestID string // ID of the upgrade request, to correlate connection logs
+
+	// Closed to stop the write pump. send is never closed, so writers on
+	// other goroutines cannot panic on a disconnected client.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Messages written to the connection but not yet acked, by message ID
+	inflight   map[string]*inflightMessage
+	inflightMu sync.Mutex
+}
+
+// outboundFrame is a frame queued for a client.
+// MessageID is set for message frames that the client must ack.
+type outboundFrame struct {
+	MessageID string
+	Data      []byte
+	Close     bool // close the connection once written
+}
+
+// inflightMessage is a message frame awaiting a client ack
+type inflightMessage struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
 }
 
 // Hub manages all WebSocket connections
@@ -33,65 +69,102 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *BroadcastMessage
-	storage    *storage.SQLiteStorage
+	storage    storage.Storage
 	mu         sync.RWMutex
+
+	// onRead is called when a client reports a message as read
+	onRead func(ctx context.Context, deviceID int64, messageID string)
+
+	// How often clients are pinged and how long they may stay silent
+	pingPeriod atomic.Int64
+	pongWait   atomic.Int64
 }
 
 // BroadcastMessage represents a message to be sent to a specific device
 type BroadcastMessage struct {
 	DeviceKey string
+	MessageID string // set for frames that expect an ack
 	Message   []byte
 }
 
 // NewHub creates a new WebSocket hub
-func NewHub(storage *storage.SQLiteStorage) *Hub {
-	return &Hub{
+func NewHub(storage storage.Storage) *Hub {
+	h := &Hub{
 		clients:    make(map[string]*Client),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan *BroadcastMessage, 256),
 		storage:    storage,
 	}
+	h.SetTimeouts(defaultPingPeriod, defaultPongWait)
+	return h
+}
+
+// SetTimeouts sets how often clients are pinged and how long a connection may
+// stay silent before it is closed. Connected clients pick up new values at
+// their next ping and pong.
+func (h *Hub) SetTimeouts(pingPeriod, pongWait time.Duration) {
+	h.pingPeriod.Store(int64(pingPeriod))
+	h.pongWait.Store(int64(pongWait))
+}
+
+// SetReadHandler sets the callback for read frames from clients.
+// It must be set before clients connect.
+func (h *Hub) SetReadHandler(onRead func(ctx context.Context, deviceID int64, messageID string)) {
+	h.onRead = onRead
 }
 
 // Run starts the hub's main loop
 func (h *Hub) Run() {
+	// Devices that connected since startup, to count reconnects
+	seen := make(map[int64]bool)
+
 	for {
 		select {
 		case client := <-h.register:
+			wsConnects.Inc()
+			if seen[client.deviceID] {
+				wsReconnects.Inc()
+			}
+			seen[client.deviceID] = true
+
 			h.mu.Lock()
 			// Close existing connection if any
 			if existing, ok := h.clients[client.deviceKey]; ok {
-				close(existing.send)
+				existing.close()
 				existing.conn.Close()
 			}
 			h.clients[client.deviceKey] = client
 			h.mu.Unlock()
-			log.Printf("Client registered: %s", client.deviceKey)
+			client.logger().Info("WebSocket client registered", logging.Key(client.deviceKey))
 
-			// Send undelivered messages
-			go h.sendUndeliveredMessages(client)
+			// Replay before handling further broadcasts, so stored messages
+			// are queued ahead of live ones. Live sends racing the replay may
+			// repeat a replayed message; the write pump skips those.
+			h.sendUndeliveredMessages(client)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if existing, ok := h.clients[client.deviceKey]; ok && existing == client {
 				delete(h.clients, client.deviceKey)
-				close(client.send)
+				client.close()
 			}
 			h.mu.Unlock()
-			log.Printf("Client unregistered: %s", client.deviceKey)
+			client.logger().Info("WebSocket client unregistered", logging.Key(client.deviceKey))
 
 		case msg := <-h.broadcast:
 			h.mu.RLock()
 			if client, ok := h.clients[msg.DeviceKey]; ok {
-				select {
-				case client.send <- msg.Message:
-				default:
+				if !client.enqueue(&outboundFrame{MessageID: msg.MessageID, Data: msg.Message}) {
 					// Client buffer full, disconnect
+					wsBufferFull.Inc()
+					client.logger().Warn("WebSocket client buffer full, disconnecting")
 					h.mu.RUnlock()
 					h.mu.Lock()
-					delete(h.clients, msg.DeviceKey)
-					close(client.send)
+					if h.clients[msg.DeviceKey] == client {
+						delete(h.clients, msg.DeviceKey)
+					}
+					client.close()
 					h.mu.Unlock()
 					continue
 				}
@@ -101,46 +174,38 @@ func (h *Hub) Run() {
 	}
 }
 
-// sendUndeliveredMessages sends all undelivered messages to a newly connected client
+// sendUndeliveredMessages queues all undelivered messages for a newly
+// connected client. It runs on the hub loop.
 func (h *Hub) sendUndeliveredMessages(client *Client) {
+	// Purge expired messages instead of flooding the client with stale alerts
+	if purged, err := h.storage.DeleteExpiredMessages(client.deviceID); err != nil {
+		client.logger().Error("failed to purge expired messages", "error", err)
+	} else if purged > 0 {
+		client.logger().Info("purged expired messages", "purged", purged)
+	}
+
 	messages, err := h.storage.GetUndeliveredMessages(client.deviceID)
 	if err != nil {
-		log.Printf("Error getting undelivered messages: %v", err)
+		client.logger().Error("failed to get undelivered messages", "error", err)
 		return
 	}
 
 	for _, msg := range messages {
-		wsMsg := model.WSMessage{
-			Type:      model.WSTypeMessage,
-			ID:        msg.MessageID,
-			Timestamp: msg.CreatedAt.Unix(),
-			Data: map[string]interface{}{
-				"title":             msg.Title,
-				"body":              msg.Body,
-				"group":             msg.Group,
-				"icon":              msg.Icon,
-				"url":               msg.URL,
-				"sound":             msg.Sound,
-				"badge":             msg.Badge,
-				"encrypted_content": string(msg.EncryptedPayload),
-			},
-		}
+		wsMsg := msg.ToWSMessage()
 
 		data, err := json.Marshal(wsMsg)
 		if err != nil {
 			continue
 		}
 
-		select {
-		case client.send <- data:
-		default:
+		if !client.enqueue(&outboundFrame{MessageID: msg.MessageID, Data: data}) {
 			return
 		}
 	}
 }
 
 // SendToDevice sends a message to a specific device
-func (h *Hub) SendToDevice(deviceKey string, msg *model.WSMessage) bool {
+func (h *Hub) SendToDevice(ctx context.Context, deviceKey string, msg *model.WSMessage) bool {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return false
@@ -151,15 +216,90 @@ func (h *Hub) SendToDevice(deviceKey string, msg *model.WSMessage) bool {
 	h.mu.RUnlock()
 
 	if online {
-		h.broadcast <- &BroadcastMessage{
+		bm := &BroadcastMessage{
 			DeviceKey: deviceKey,
 			Message:   data,
 		}
+		if msg.Type == model.WSTypeMessage {
+			bm.MessageID = msg.ID
+		}
+		select {
+		case h.broadcast <- bm:
+		default:
+			hubBroadcastBlocked.Inc()
+			logging.FromContext(ctx).Warn("hub broadcast channel full, waiting")
+			h.broadcast <- bm
+		}
 	}
+	logging.FromContext(ctx).Debug("WebSocket send",
+		logging.Key(deviceKey), "type", msg.Type, "id", msg.ID, "online", online)
 
 	return online
 }
 
+// DropInflight stops redelivery of the given messages to a connected device,
+// e.g. after they were recalled
+func (h *Hub) DropInflight(deviceKey string, messageIDs ...string) {
+	h.mu.RLock()
+	client, ok := h.clients[deviceKey]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	client.inflightMu.Lock()
+	for _, id := range messageIDs {
+		delete(client.inflight, id)
+	}
+	client.inflightMu.Unlock()
+}
+
+// RekeyDevice tells the connected client of a device its new key after a key
+// rotation and then closes the connection, so the client reconnects and
+// authenticates with the new key. It reports whether the device was online.
+func (h *Hub) RekeyDevice(ctx context.Context, oldKey, newKey string) bool {
+	h.mu.RLock()
+	client, ok := h.clients[oldKey]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	data, err := json.Marshal(&model.WSMessage{
+		Type:      model.WSTypeKeyRotated,
+		Timestamp: time.Now().Unix(),
+		Data:      map[string]interface{}{"device_key": newKey},
+	})
+	if err != nil {
+		return false
+	}
+	if !client.enqueue(&outboundFrame{Data: data, Close: true}) {
+		h.unregister <- client
+	}
+	logging.FromContext(ctx).Info("WebSocket client told to reconnect with rotated key", "device_id", client.deviceID,
+		"old_key", logging.RedactKey(oldKey), "new_key", logging.RedactKey(newKey))
+	return true
+}
+
+// Disconnect closes the connection of a device, e.g. after it was deleted
+func (h *Hub) Disconnect(deviceKey string) bool {
+	h.mu.RLock()
+	client, ok := h.clients[deviceKey]
+	h.mu.RUnlock()
+	if ok {
+		// Removed by the hub loop, like a client that went away
+		h.unregister <- client
+	}
+	return ok
+}
+
+// OnlineCount returns the number of connected devices
+func (h *Hub) OnlineCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
 // IsOnline checks if a device is currently connected
 func (h *Hub) IsOnline(deviceKey string) bool {
 	h.mu.RLock()
@@ -168,6 +308,33 @@ func (h *Hub) IsOnline(deviceKey string) bool {
 	return ok
 }
 
+// enqueue queues a frame for the write pump. It returns false when the
+// client is closed or its buffer is full.
+func (c *Client) enqueue(frame *outboundFrame) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the write pump, which closes the connection. It is safe to
+// call from any goroutine and more than once.
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// logger returns a logger tagged with the connection's request and device
+func (c *Client) logger() *slog.Logger {
+	return slog.Default().With("request_id", c.requestID, "device_id", c.deviceID)
+}
+
 // readPump pumps messages from the WebSocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
@@ -176,9 +343,9 @@ func (c *Client) readPump() {
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.extendDeadline()
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.extendDeadline()
 		return nil
 	})
 
@@ -186,7 +353,7 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.logger().Warn("WebSocket read failed", "error", err)
 			}
 			break
 		}
@@ -199,43 +366,75 @@ func (c *Client) readPump() {
 
 		switch wsMsg.Type {
 		case model.WSTypeAck:
-			// Mark message as delivered
+			// Only an ack marks a message as delivered
 			if wsMsg.ID != "" {
-				c.hub.storage.MarkMessageDelivered(wsMsg.ID)
+				c.acked(wsMsg.ID)
+			}
+		case model.WSTypeRead:
+			// Sync to linked devices off the read loop, it may push to APNs
+			if wsMsg.ID != "" && c.hub.onRead != nil {
+				go c.hub.onRead(logging.WithRequestID(context.Background(), c.requestID), c.deviceID, wsMsg.ID)
 			}
 		case model.WSTypePong:
 			// Client responded to ping
+			c.extendDeadline()
 		}
 	}
 }
 
+// extendDeadline gives the client another pong timeout to respond
+func (c *Client) extendDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.hub.pongWait.Load())))
+}
+
 // writePump pumps messages from the hub to the WebSocket connection
 func (c *Client) writePump() {
+	pingPeriod := time.Duration(c.hub.pingPeriod.Load())
 	ticker := time.NewTicker(pingPeriod)
+	ackTicker := time.NewTicker(ackCheckPeriod)
 	defer func() {
 		ticker.Stop()
+		ackTicker.Stop()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+
+		case frame := <-c.send:
+			// Already written and awaiting an ack, resent by resendUnacked
+			if frame.MessageID != "" && c.isInflight(frame.MessageID) {
+				continue
 			}
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(frame.Data)
 
 			if err := w.Close(); err != nil {
 				return
 			}
 
+			if frame.MessageID != "" {
+				c.sent(frame.MessageID, frame.Data)
+			}
+			if frame.Close {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+		case <-ackTicker.C:
+			if !c.resendUnacked() {
+				return
+			}
+
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			pingMsg := model.WSMessage{
@@ -246,6 +445,76 @@ func (c *Client) writePump() {
 			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
 				return
 			}
+			if p := time.Duration(c.hub.pingPeriod.Load()); p != pingPeriod {
+				pingPeriod = p
+				ticker.Reset(pingPeriod)
+			}
+		}
+	}
+}
+
+// sent records a message frame written to the connection as awaiting an ack
+func (c *Client) sent(messageID string, data []byte) {
+	c.inflightMu.Lock()
+	m, ok := c.inflight[messageID]
+	if !ok {
+		m = &inflightMessage{data: data}
+		c.inflight[messageID] = m
+	}
+	m.sentAt = time.Now()
+	m.attempts++
+	c.inflightMu.Unlock()
+
+	c.hub.storage.MarkMessageSent(c.deviceID, messageID)
+}
+
+// isInflight reports whether a message was written and awaits an ack
+func (c *Client) isInflight(messageID string) bool {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	_, ok := c.inflight[messageID]
+	return ok
+}
+
+// acked removes an acked message from the in-flight set and marks it delivered
+func (c *Client) acked(messageID string) {
+	c.inflightMu.Lock()
+	delete(c.inflight, messageID)
+	c.inflightMu.Unlock()
+
+	if err := c.hub.storage.MarkMessageAcked(c.deviceID, messageID); err != nil {
+		c.logger().Error("failed to mark message acked", "message_id", messageID, "error", err)
+	}
+}
+
+// resendUnacked rewrites messages whose ack timed out. It returns false when a
+// message exhausted its attempts, meaning the connection should be dropped;
+// unacked messages are then replayed when the client reconnects.
+func (c *Client) resendUnacked() bool {
+	now := time.Now()
+	var due []*inflightMessage
+
+	c.inflightMu.Lock()
+	for id, m := range c.inflight {
+		if now.Sub(m.sentAt) < ackTimeout {
+			continue
+		}
+		if m.attempts >= maxSendAttempts {
+			c.inflightMu.Unlock()
+			c.logger().Warn("message not acked, closing connection", "message_id", id, "attempts", m.attempts)
+			return false
+		}
+		m.sentAt = now
+		m.attempts++
+		due = append(due, m)
+	}
+	c.inflightMu.Unlock()
+
+	for _, m := range due {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteMessage(websocket.TextMessage, m.data); err != nil {
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub starts a hub on a fresh SQLite database with one device
+func newTestHub(t *testing.T) (*Hub, storage.Storage, *model.Device) {
+	t.Helper()
+	store, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "abnotify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	device := &model.Device{DeviceKey: "device", DeviceType: "android"}
+	if err := store.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub(store)
+	go hub.Run()
+	return hub, store, device
+}
+
+// newTestConn returns both ends of a WebSocket connection
+func newTestConn(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server = <-conns
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+// newTestClient returns a hub client on the server end of a connection
+func newTestClient(t *testing.T, hub *Hub, device *model.Device) (*Client, *websocket.Conn) {
+	t.Helper()
+	server, conn := newTestConn(t)
+	return &Client{
+		hub:       hub,
+		conn:      server,
+		send:      make(chan *outboundFrame, 256),
+		done:      make(chan struct{}),
+		deviceKey: device.DeviceKey,
+		deviceID:  device.ID,
+		inflight:  make(map[string]*inflightMessage),
+	}, conn
+}
+
+// connectTestClient registers a client with the hub and starts its pumps
+func connectTestClient(t *testing.T, hub *Hub, device *model.Device) (*Client, *websocket.Conn) {
+	t.Helper()
+	client, conn := newTestClient(t, hub, device)
+	hub.register <- client
+	go client.writePump()
+	go client.readPump()
+	return client, conn
+}
+
+// readMessageIDs reads message frames until want arrived or the connection
+// stayed silent for wait, and returns their IDs in order
+func readMessageIDs(t *testing.T, conn *websocket.Conn, want int, wait time.Duration) []string {
+	t.Helper()
+	var ids []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return ids
+		}
+		var msg model.WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == model.WSTypeMessage {
+			ids = append(ids, msg.ID)
+		}
+		if len(ids) > want {
+			return ids
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubReplaysBeforeLiveSends(t *testing.T) {
+	hub, store, device := newTestHub(t)
+
+	stored := []*model.Message{
+		{DeviceID: device.ID, MessageID: "m1", Title: "t", Body: "first"},
+		{DeviceID: device.ID, MessageID: "m2", Title: "t", Body: "second"},
+	}
+	for _, msg := range stored {
+		if err := store.CreateMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, conn := connectTestClient(t, hub, device)
+	waitFor(t, "registration", func() bool { return hub.IsOnline(device.DeviceKey) })
+
+	// A live send of a stored message, as when it is dispatched while the
+	// client connects, and a new message
+	ctx := context.Background()
+	hub.SendToDevice(ctx, device.DeviceKey, stored[1].ToWSMessage())
+	live := &model.Message{MessageID: "m3", Title: "t", Body: "live"}
+	if !hub.SendToDevice(ctx, device.DeviceKey, live.ToWSMessage()) {
+		t.Fatal("SendToDevice() reported the client offline")
+	}
+
+	ids := readMessageIDs(t, conn, 3, 300*time.Millisecond)
+	if strings.Join(ids, ",") != "m1,m2,m3" {
+		t.Errorf("received %v, want m1,m2,m3 once each in order", ids)
+	}
+}
+
+func TestClientAcked(t *testing.T) {
+	hub, store, device := newTestHub(t)
+	if err := store.CreateMessage(&model.Message{DeviceID: device.ID, MessageID: "m1", Title: "t", Body: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := connectTestClient(t, hub, device)
+	if ids := readMessageIDs(t, conn, 1, time.Second); len(ids) != 1 {
+		t.Fatalf("received %v, want m1", ids)
+	}
+	if delivered, _, _ := store.GetMessageDelivered("m1"); delivered {
+		t.Fatal("message delivered before the client acked it")
+	}
+
+	if err := conn.WriteJSON(&model.WSMessage{Type: model.WSTypeAck, ID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "ack", func() bool {
+		delivered, _, _ := store.GetMessageDelivered("m1")
+		return delivered
+	})
+	if client.isInflight("m1") {
+		t.Error("acked message still in flight")
+	}
+}
+
+func TestResendUnacked(t *testing.T) {
+	due := time.Now().Add(-ackTimeout - time.Second)
+
+	tests := []struct {
+		name         string
+		sentAt       time.Time
+		attempts     int
+		want         bool
+		wantResent   bool
+		wantAttempts int
+	}{
+		{"within the ack timeout", time.Now(), 1, true, false, 1},
+		{"ack timed out", due, 1, true, true, 2},
+		{"last attempt", due, maxSendAttempts - 1, true, true, maxSendAttempts},
+		{"attempts exhausted", due, maxSendAttempts, false, false, maxSendAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, _, device := newTestHub(t)
+			client, conn := newTestClient(t, hub, device)
+			data, _ := json.Marshal((&model.Message{MessageID: "m1"}).ToWSMessage())
+			client.inflight["m1"] = &inflightMessage{data: data, sentAt: tt.sentAt, attempts: tt.attempts}
+
+			if got := client.resendUnacked(); got != tt.want {
+				t.Errorf("resendUnacked() = %v, want %v", got, tt.want)
+			}
+			if m := client.inflight["m1"]; m.attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", m.attempts, tt.wantAttempts)
+			}
+			resent := len(readMessageIDs(t, conn, 1, 100*time.Millisecond)) == 1
+			if resent != tt.wantResent {
+				t.Errorf("resent = %v, want %v", resent, tt.wantResent)
+			}
+		})
+	}
+}
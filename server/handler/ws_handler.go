@@ -1,11 +1,26 @@
 package handler
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
 	"github.com/abnotify/server/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed for the client to answer the authentication challenge
+	authTimeout = 10 * time.Second
+
+	// Close code sent when the challenge is not answered correctly
+	closeAuthFailed = 4401
 )
 
 var upgrader = websocket.Upgrader{
@@ -18,20 +33,35 @@ var upgrader = websocket.Upgrader{
 
 // WSHandler handles WebSocket upgrade requests
 type WSHandler struct {
-	hub     *Hub
-	storage *storage.SQLiteStorage
+	hub         *Hub
+	storage     storage.Storage
+	subscribers *SubscriberAuth
+	crypto      *crypto.Crypto
+	// Challenge devices with a public key, off until their clients answer it
+	requireAuth atomic.Bool
 }
 
 // NewWSHandler creates a new WebSocket handler
-func NewWSHandler(hub *Hub, storage *storage.SQLiteStorage) *WSHandler {
-	return &WSHandler{
-		hub:     hub,
-		storage: storage,
+func NewWSHandler(hub *Hub, storage storage.Storage, subscribers *SubscriberAuth, requireAuth bool) *WSHandler {
+	h := &WSHandler{
+		hub:         hub,
+		storage:     storage,
+		subscribers: subscribers,
+		crypto:      crypto.NewCrypto(),
 	}
+	h.requireAuth.Store(requireAuth)
+	return h
+}
+
+// SetRequireAuth sets whether devices with a public key must answer the RSA
+// challenge. It applies to new connections.
+func (h *WSHandler) SetRequireAuth(requireAuth bool) {
+	h.requireAuth.Store(requireAuth)
 }
 
 // HandleConnect handles the WebSocket connection upgrade
 func (h *WSHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	deviceKey := r.URL.Query().Get("key")
 	if deviceKey == "" {
 		http.Error(w, "Missing device key", http.StatusBadRequest)
@@ -40,6 +70,10 @@ func (h *WSHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 
 	// Verify device exists
 	device, err := h.storage.GetDeviceByKey(deviceKey)
+	if errors.Is(err, storage.ErrDeviceKeyRetired) {
+		http.Error(w, "Device key has been retired", http.StatusGone)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -48,24 +82,57 @@ func (h *WSHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid device key", http.StatusUnauthorized)
 		return
 	}
+	// The device key only allows sending; receiving needs the subscriber secret
+	if msg := h.subscribers.Check(r, device); msg != "" {
+		logger.Warn("WebSocket connect rejected", logging.Key(deviceKey), "device_id", device.ID, "reason", msg)
+		http.Error(w, msg, http.StatusUnauthorized)
+		return
+	}
 
 	// Upgrade to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		logger.Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
 
+	// Devices with an RSA key must prove possession of the private key
+	// before they are registered and receive anything
+	if device.PublicKey != "" && h.requireAuth.Load() {
+		if err := h.authenticate(conn, deviceKey, device); err != nil {
+			logger.Warn("WebSocket authentication failed", logging.Key(deviceKey), "device_id", device.ID, "error", err)
+			wsAuthFailures.Inc()
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(closeAuthFailed, "authentication failed"),
+				time.Now().Add(writeWait))
+			conn.Close()
+			return
+		}
+	}
+
 	// Update last seen
-	h.storage.UpdateDeviceLastSeen(deviceKey)
+	h.storage.UpdateDeviceLastSeen(device.DeviceKey)
 
 	// Create client
 	client := &Client{
 		hub:       h.hub,
 		conn:      conn,
-		send:      make(chan []byte, 256),
-		deviceKey: deviceKey,
+		send:      make(chan *outboundFrame, 256),
+		done:      make(chan struct{}),
+		deviceKey: device.DeviceKey,
 		deviceID:  device.ID,
+		requestID: logging.RequestID(r.Context()),
+		inflight:  make(map[string]*inflightMessage),
+	}
+
+	// Connected with a rotated key during its grace period
+	if deviceKey != device.DeviceKey {
+		data, _ := json.Marshal(&model.WSMessage{
+			Type:      model.WSTypeKeyRotated,
+			Timestamp: time.Now().Unix(),
+			Data:      map[string]interface{}{"device_key": device.DeviceKey},
+		})
+		client.enqueue(&outboundFrame{Data: data})
 	}
 
 	// Register client
@@ -75,3 +142,52 @@ func (h *WSHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 	go client.writePump()
 	go client.readPump()
 }
+
+// authenticate sends a random challenge and verifies that the client signs it
+// with the private key matching the device's public key. deviceKey is the key
+// the client connected with, which differs from the device's after a rotation.
+func (h *WSHandler) authenticate(conn *websocket.Conn, deviceKey string, device *model.Device) error {
+	publicKey, err := h.crypto.ParsePublicKey(device.PublicKey)
+	if err != nil {
+		return err
+	}
+	nonce, err := h.crypto.GenerateChallenge()
+	if err != nil {
+		return err
+	}
+
+	challenge := &model.WSMessage{
+		Type:      model.WSTypeChallenge,
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().Unix(),
+		Data: map[string]interface{}{
+			"nonce":     nonce,
+			"algorithm": "SHA256withRSA",
+		},
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteJSON(challenge); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	var reply struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		return err
+	}
+	if reply.Type != model.WSTypeAuth || reply.ID != challenge.ID {
+		return errors.New("expected auth reply to challenge")
+	}
+	if err := h.crypto.VerifySignature(publicKey, crypto.ChallengeMessage(deviceKey, nonce), reply.Data.Signature); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	return nil
+}
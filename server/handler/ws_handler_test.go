@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	abcrypto "github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/model"
+	"github.com/gorilla/websocket"
+)
+
+// newTestKey returns an RSA key and its public key in PEM
+func newTestKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestHandleConnectChallenge(t *testing.T) {
+	key, publicKey := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+
+	tests := []struct {
+		name          string
+		requireAuth   bool
+		publicKey     string
+		signer        *rsa.PrivateKey // answers the challenge, nil to expect none
+		wantDelivered bool
+	}{
+		{"challenge off", false, publicKey, nil, true},
+		{"device without a public key", true, "", nil, true},
+		{"correct signature", true, publicKey, key, true},
+		{"signature of another key", true, publicKey, otherKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, store, _ := newTestHub(t)
+			device := &model.Device{DeviceKey: "signed-device", DeviceType: "android", PublicKey: tt.publicKey}
+			if err := store.CreateDevice(device); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateMessage(&model.Message{DeviceID: device.ID, MessageID: "m1", Title: "t", Body: "b"}); err != nil {
+				t.Fatal(err)
+			}
+
+			h := NewWSHandler(hub, store, NewSubscriberAuth(store, false), tt.requireAuth)
+			srv := httptest.NewServer(http.HandlerFunc(h.HandleConnect))
+			defer srv.Close()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?key="+device.DeviceKey, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tt.signer != nil {
+				answerChallenge(t, conn, device.DeviceKey, tt.signer)
+			}
+
+			ids := readMessageIDs(t, conn, 1, time.Second)
+			if delivered := len(ids) == 1 && ids[0] == "m1"; delivered != tt.wantDelivered {
+				t.Errorf("received %v, want delivered %v", ids, tt.wantDelivered)
+			}
+			if !tt.wantDelivered {
+				_, _, err := conn.ReadMessage()
+				var closeErr *websocket.CloseError
+				if !errors.As(err, &closeErr) || closeErr.Code != closeAuthFailed {
+					t.Errorf("connection ended with %v, want close code %d", err, closeAuthFailed)
+				}
+			}
+		})
+	}
+}
+
+// answerChallenge reads the challenge and replies with a signature of key
+func answerChallenge(t *testing.T, conn *websocket.Conn, deviceKey string, key *rsa.PrivateKey) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var challenge struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Data struct {
+			Nonce string `json:"nonce"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if challenge.Type != model.WSTypeChallenge {
+		t.Fatalf("first frame is %s, want a challenge", challenge.Type)
+	}
+
+	hash := sha256.Sum256(abcrypto.ChallengeMessage(deviceKey, challenge.Data.Nonce))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &model.WSMessage{
+		Type: model.WSTypeAuth,
+		ID:   challenge.ID,
+		Data: map[string]interface{}{"signature": base64.StdEncoding.EncodeToString(sig)},
+	}
+	if err := conn.WriteJSON(reply); err != nil {
+		t.Fatal(err)
+	}
+}
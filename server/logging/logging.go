@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Options configures the default logger
+type Options struct {
+	Level     string // debug, info, warn or error
+	Format    string // logfmt or json
+	Sensitive bool   // log message content and full device keys
+}
+
+var (
+	level     slog.LevelVar
+	sensitive atomic.Bool
+)
+
+// Setup installs the default logger. Output of the standard log package is
+// routed through it at info level.
+func Setup(w io.Writer, opts Options) error {
+	if err := SetLevel(opts.Level); err != nil {
+		return err
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", "logfmt", "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return fmt.Errorf("invalid log format %q (logfmt or json)", opts.Format)
+	}
+
+	SetSensitive(opts.Sensitive)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level of the default logger
+func SetLevel(name string) error {
+	if name == "" {
+		name = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("invalid log level %q (debug, info, warn or error)", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+// SetSensitive turns logging of message content and full device keys on or off
+func SetSensitive(on bool) {
+	sensitive.Store(on)
+}
+
+// Sensitive reports whether message content and device keys are logged
+func Sensitive() bool {
+	return sensitive.Load()
+}
+
+// Key returns a device_key attribute. Device keys allow pushing to a device,
+// so only a prefix is logged unless sensitive logging is on.
+func Key(key string) slog.Attr {
+	return slog.String("device_key", RedactKey(key))
+}
+
+// RedactKey shortens a device key to a prefix that still tells devices apart
+func RedactKey(key string) string {
+	if sensitive.Load() || key == "" {
+		return key
+	}
+	if len(key) <= 8 {
+		return "***"
+	}
+	return key[:4] + "***"
+}
+
+// Text returns an attribute for message content, replaced by its length
+// unless sensitive logging is on
+func Text(name, value string) slog.Attr {
+	if sensitive.Load() || value == "" {
+		return slog.String(name, value)
+	}
+	return slog.String(name, fmt.Sprintf("[redacted %d bytes]", len(value)))
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger, tagged with the request ID carried
+// by the context
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx == nil {
+		return slog.Default()
+	}
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,56 +13,166 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/abnotify/server/apns"
 	"github.com/abnotify/server/config"
 	"github.com/abnotify/server/handler"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/metrics"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/retention"
 	"github.com/abnotify/server/storage"
+	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.LoadFromEnv()
+	configPath := flag.String("config", os.Getenv("ABNOTIFY_CONFIG"), "YAML or TOML config file")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Load configuration: defaults, then the config file, then environment variables
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	// Initialize logging
+	if err := setupLogging(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(cfg, flag.Args()))
+	}
 
 	// Initialize storage
-	store, err := storage.NewSQLiteStorage(cfg.DBPath)
+	store, err := storage.Open(cfg.DBDriver, cfg.DatabaseSource())
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		fatal("failed to initialize storage", err)
 	}
 	defer store.Close()
+	slog.Info("storage opened", "driver", cfg.DBDriver)
 
 	// Initialize WebSocket hub
 	hub := handler.NewHub(store)
+	hub.SetTimeouts(time.Duration(cfg.WSPingInterval)*time.Second, time.Duration(cfg.WSPongTimeout)*time.Second)
 	go hub.Run()
 
-	// Initialize APNs client (if configured)
-	var apnsClient *apns.Client
-	if cfg.APNSKeyID != "" && cfg.APNSTeamID != "" && cfg.APNSPrivateKey != "" {
-		apnsClient, err = apns.NewClient(cfg.APNSKeyID, cfg.APNSTeamID, cfg.APNSPrivateKey, cfg.APNSProduction)
+	// Initialize dispatcher (APNs first, WebSocket as fallback)
+	apnsNotifier := notify.NewAPNsNotifier(newAPNsClient(cfg), store)
+	dispatcher := notify.NewDispatcher(store,
+		apnsNotifier,
+		notify.NewWebSocketNotifier(hub),
+	)
+	dispatcher.SetDefaultTTL(time.Duration(cfg.MessageTTL) * time.Second)
+	dispatcher.SetDedupe(time.Duration(cfg.IdempotencyWindow)*time.Second, time.Duration(cfg.DedupeWindow)*time.Second)
+
+	// Sync read state reported over WebSocket to linked devices
+	hub.SetReadHandler(func(ctx context.Context, deviceID int64, messageID string) {
+		device, err := store.GetDeviceByID(deviceID)
+		if err != nil || device == nil {
+			return
+		}
+		if _, err := dispatcher.MarkRead(ctx, device, messageID); err != nil {
+			logging.FromContext(ctx).Error("failed to mark message read", "message_id", messageID, "error", err)
+		}
+	})
+
+	// Start scheduler for delayed messages
+	scheduler := notify.NewScheduler(store, dispatcher)
+	go scheduler.Run()
+
+	// Start retention worker for stored messages
+	retentionWorker := retention.NewWorker(store, retentionPolicy(cfg))
+	go retentionWorker.Run()
+
+	// Gauges read when metrics are scraped
+	metrics.NewGaugeFunc("abnotify_ws_connections", "Connected WebSocket clients.", func() float64 {
+		return float64(hub.OnlineCount())
+	})
+	metrics.NewGaugeFunc("abnotify_hub_broadcast_queue_length", "Frames waiting in the hub broadcast channel.", func() float64 {
+		n, _ := hub.BroadcastQueue()
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("abnotify_hub_broadcast_queue_capacity", "Capacity of the hub broadcast channel.", func() float64 {
+		_, n := hub.BroadcastQueue()
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("abnotify_offline_queue_depth", "Stored messages not yet delivered to their device.", func() float64 {
+		n, err := store.CountQueuedMessages()
 		if err != nil {
-			log.Printf("Warning: Failed to initialize APNs client: %v", err)
-		} else {
-			log.Println("APNs client initialized successfully")
+			return math.NaN()
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("abnotify_devices", "Registered devices.", func() float64 {
+		n, err := store.CountDevices()
+		if err != nil {
+			return math.NaN()
 		}
-	} else {
-		log.Println("APNs not configured, iOS push disabled")
+		return float64(n)
+	})
+	if err := metrics.Err(); err != nil {
+		fatal("invalid metrics", err)
 	}
 
 	// Initialize handlers
-	pushHandler := handler.NewPushHandler(store, hub)
-	barkHandler := handler.NewBarkHandler(store, hub, apnsClient)
-	wsHandler := handler.NewWSHandler(hub, store)
-	webhookHandler := handler.NewWebhookHandler(store, hub)
+	subscribers := handler.NewSubscriberAuth(store, cfg.RequireSubscribeSecret)
+	owners := handler.NewOwnershipGuard(store, cfg.QuarantineRegistrations)
+	pushHandler := handler.NewPushHandler(store, dispatcher, subscribers, owners)
+	rateLimiter := handler.NewRateLimiter(rateLimiters(cfg))
+	barkHandler := handler.NewBarkHandler(store, dispatcher, subscribers, owners, rateLimiter)
+	wsHandler := handler.NewWSHandler(hub, store, subscribers, cfg.RequireWSAuth)
+	webhookHandler := handler.NewWebhookHandler(store, dispatcher)
+	groupHandler := handler.NewGroupHandler(store, dispatcher, rateLimiter)
+	scheduleHandler := handler.NewScheduleHandler(store)
+	messageHandler := handler.NewMessageHandler(store, dispatcher, subscribers)
+	linkHandler := handler.NewLinkHandler(store, subscribers)
+	adminHandler := handler.NewAdminHandler(store, hub, retentionWorker, owners, subscribers)
+	rotateHandler := handler.NewRotateHandler(store, hub, subscribers, time.Duration(cfg.KeyRotationMaxGrace)*time.Second)
 
 	// Setup Gin router
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
+	router := gin.New()
+	router.Use(handler.RequestLogger(), gin.Recovery())
+	// Forwarded client IPs are only honored from configured proxies, otherwise
+	// anyone could pick the IP the per-IP rate limit applies to
+	trustedProxies := cfg.TrustedProxies
+	if len(trustedProxies) == 0 {
+		trustedProxies = nil
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		fatal("invalid server.trusted_proxies", err)
+	}
+	if trustedProxies == nil && cfg.RateLimitIP > 0 {
+		// Behind a reverse proxy every client would share the proxy's bucket
+		slog.Warn("per-IP rate limit applies to connecting addresses, set server.trusted_proxies when behind a reverse proxy",
+			"rate_limit_ip", cfg.RateLimitIP)
+	}
+
+	// Rate limiting for push, register and WebSocket routes
+	limit := rateLimiter.Middleware()
+
+	// Settings reloaded on SIGHUP
+	reloadable := &settings{
+		path:        *configPath,
+		hub:         hub,
+		dispatcher:  dispatcher,
+		apns:        apnsNotifier,
+		retention:   retentionWorker,
+		limiter:     rateLimiter,
+		subscribers: subscribers,
+		ws:          wsHandler,
+		owners:      owners,
+		rotate:      rotateHandler,
+		cfg:         cfg,
+	}
 
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -68,36 +180,94 @@ func main() {
 		c.Next()
 	})
 
+	// Request counts and latency by route
+	router.Use(handler.Metrics())
+
 	// Health check
 	router.GET("/health", barkHandler.HandleHealth)
 	router.GET("/healthz", func(c *gin.Context) { c.String(200, "ok") })
-	router.GET("/ping", func(c *gin.Context) { c.JSON(200, gin.H{"code": 200, "message": "pong", "timestamp": time.Now().Unix()}) })
+	router.GET("/ping", func(c *gin.Context) {
+		c.JSON(200, gin.H{"code": 200, "message": "pong", "timestamp": time.Now().Unix()})
+	})
+
+	// Prometheus metrics
+	router.GET("/metrics", handler.MetricsAuth(reloadable.metricsToken), gin.WrapH(metrics.Handler()))
 
 	// Register
-	router.POST("/register", barkHandler.HandleRegister)
-	router.GET("/register", barkHandler.HandleRegister)
+	router.POST("/register", limit, barkHandler.HandleRegister)
+	router.GET("/register", limit, barkHandler.HandleRegister)
 
 	// Info
 	router.GET("/info", barkHandler.HandleInfo)
 
 	// Push routes (Abnotify style)
-	router.POST("/push/:device_key", pushHandler.HandlePush)
-	router.GET("/push/:device_key/*params", handleSimplePushParams(pushHandler))
+	router.POST("/push/:device_key", limit, pushHandler.HandlePush)
+	router.GET("/push/:device_key/*params", limit, handleSimplePushParams(pushHandler))
+
+	// Message status and history
+	router.GET("/message/:message_id", messageHandler.HandleStatus)
+	router.DELETE("/message/:message_id", messageHandler.HandleRecall)
+	router.POST("/message/:message_id/read", messageHandler.HandleRead)
+	router.GET("/history/:device_key", messageHandler.HandleHistory)
+	router.DELETE("/history/:device_key", messageHandler.HandleDeleteHistory)
+	router.DELETE("/history/:device_key/:message_id", messageHandler.HandleDeleteMessage)
+	router.GET("/search/:device_key", messageHandler.HandleSearch)
+
+	// Device links for read-state sync
+	router.GET("/link/:device_key", linkHandler.HandleGet)
+	router.POST("/link/:device_key", linkHandler.HandleLink)
+	router.DELETE("/link/:device_key", linkHandler.HandleUnlink)
+
+	// Device key rotation
+	router.POST("/rotate/:device_key", limit, rotateHandler.HandleRotate)
+
+	// Scheduled messages
+	router.GET("/schedule/:device_key", scheduleHandler.HandleList)
+	router.DELETE("/schedule/:device_key/:schedule_id", scheduleHandler.HandleCancel)
+
+	// Device groups
+	router.POST("/groups", groupHandler.HandleCreate)
+	router.GET("/groups/:name", groupHandler.HandleGet)
+	router.DELETE("/groups/:name", groupHandler.HandleDelete)
+	router.POST("/groups/:name/members", groupHandler.HandleAddMembers)
+	router.DELETE("/groups/:name/members/:device_key", groupHandler.HandleRemoveMember)
+	router.GET("/groups/:name/pushes/:push_id", groupHandler.HandleGetPush)
+	router.POST("/group/:name", limit, groupHandler.HandlePush)
+	router.GET("/group/:name", limit, groupHandler.HandlePush)
+
+	// Admin API (disabled unless ABNOTIFY_ADMIN_TOKEN is set)
+	if cfg.AdminToken == "" {
+		slog.Info("admin token not set, admin API disabled")
+	}
+	adminGroup := router.Group("/admin", handler.AdminAuth(reloadable.adminToken))
+	{
+		adminGroup.GET("/devices", adminHandler.HandleListDevices)
+		adminGroup.GET("/devices/:id", adminHandler.HandleGetDevice)
+		adminGroup.PATCH("/devices/:id", adminHandler.HandleRenameDevice)
+		adminGroup.DELETE("/devices/:id", adminHandler.HandleDeleteDevice)
+		adminGroup.POST("/devices/:id/secret", adminHandler.HandleIssueSecret)
+		adminGroup.GET("/retention", adminHandler.HandleRetentionStatus)
+		adminGroup.POST("/retention/run", adminHandler.HandleRetentionRun)
+		adminGroup.GET("/registrations", adminHandler.HandleListRegistrations)
+		adminGroup.POST("/registrations/:id/approve", adminHandler.HandleApproveRegistration)
+		adminGroup.POST("/registrations/:id/dismiss", adminHandler.HandleDismissRegistration)
+	}
 
 	// Bark-compatible routes
-	router.POST("/:device_key", barkHandler.HandlePush)
-	router.GET("/:device_key", barkHandler.HandlePush)
+	router.POST("/push", limit, barkHandler.HandleBatchPush)
+	router.POST("/:device_key", limit, barkHandler.HandlePush)
+	router.GET("/:device_key", limit, barkHandler.HandlePush)
 	// Use wildcard to handle variable path segments: /:device_key/:body, /:device_key/:title/:body, etc.
-	router.GET("/:device_key/*params", handleBarkParams(barkHandler))
-	router.POST("/:device_key/*params", handleBarkParams(barkHandler))
+	router.GET("/:device_key/*params", limit, handleBarkParams(barkHandler))
+	router.POST("/:device_key/*params", limit, handleBarkParams(barkHandler))
 
 	// WebSocket
-	router.GET("/ws", func(c *gin.Context) {
+	router.GET("/ws", limit, func(c *gin.Context) {
 		wsHandler.HandleConnect(c.Writer, c.Request)
 	})
 
 	// Webhook routes
-	webhookGroup := router.Group("/webhook/:device_key")
+	webhookGroup := router.Group("/webhook/:device_key", limit)
 	{
 		webhookGroup.POST("", webhookHandler.HandleGenericWebhook)
 		webhookGroup.POST("/github", webhookHandler.HandleGitHubWebhook)
@@ -118,8 +288,7 @@ func main() {
 
 	// Start server in goroutine
 	go func() {
-		log.Printf("Abnotify server starting on %s", addr)
-		log.Printf("Supporting both iOS (APNs) and Android (WebSocket) devices")
+		slog.Info("Abnotify server starting", "addr", addr, "https", cfg.EnableHTTPS)
 		var err error
 		if cfg.EnableHTTPS {
 			err = srv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
@@ -127,25 +296,35 @@ func main() {
 			err = srv.ListenAndServe()
 		}
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+			fatal("server error", err)
 		}
 	}()
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	// Reload settings on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadable.reload()
+		}
+	}()
+
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("shutting down server")
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		fatal("server forced to shutdown", err)
 	}
 
-	log.Println("Server exited")
+	slog.Info("server exited")
 }
 
 // handleSimplePushParams handles /push/:device_key/*params
@@ -157,10 +336,10 @@ func handleSimplePushParams(h *handler.PushHandler) gin.HandlerFunc {
 		if len(params) > 0 && params[0] == '/' {
 			params = params[1:]
 		}
-		
+
 		// Split by /
 		parts := strings.SplitN(params, "/", 2)
-		
+
 		var title, body string
 		if len(parts) == 1 {
 			// Only body provided
@@ -171,7 +350,7 @@ func handleSimplePushParams(h *handler.PushHandler) gin.HandlerFunc {
 			title = parts[0]
 			body = parts[1]
 		}
-		
+
 		c.Params = append(c.Params, gin.Param{Key: "title", Value: title})
 		c.Params = append(c.Params, gin.Param{Key: "body", Value: body})
 		h.HandleSimplePush(c)
@@ -187,16 +366,16 @@ func handleBarkParams(h *handler.BarkHandler) gin.HandlerFunc {
 		if len(params) > 0 && params[0] == '/' {
 			params = params[1:]
 		}
-		
+
 		if params == "" {
 			// No additional params, just /:device_key
 			h.HandlePush(c)
 			return
 		}
-		
+
 		// Split by /
 		parts := strings.Split(params, "/")
-		
+
 		// Set params based on number of segments
 		switch len(parts) {
 		case 1:
@@ -222,7 +401,13 @@ func handleBarkParams(h *handler.BarkHandler) gin.HandlerFunc {
 				c.Params = append(c.Params, gin.Param{Key: "body", Value: strings.Join(parts[1:], "/")})
 			}
 		}
-		
+
 		h.HandleSimplePush(c)
 	}
 }
+
+// fatal logs an error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
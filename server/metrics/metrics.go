@@ -0,0 +1,346 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets in seconds suited to request latency
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family written in the Prometheus text format
+type collector interface {
+	name() string
+	labelNames() []string
+	write(w io.Writer)
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// registry holds the collectors served by a handler
+type registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+	errs       []error // registrations that failed
+}
+
+func newRegistry() *registry {
+	return &registry{collectors: map[string]collector{}}
+}
+
+var defaultRegistry = newRegistry()
+
+// register adds a collector. Names must be unique and valid. A failed
+// registration is also recorded for Err, since constructors do not return it.
+func (r *registry) register(c collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := validate(c)
+	if err == nil {
+		if _, ok := r.collectors[c.name()]; ok {
+			err = fmt.Errorf("metrics: duplicate metric %s", c.name())
+		}
+	}
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return err
+	}
+	r.collectors[c.name()] = c
+	return nil
+}
+
+// validate checks the metric and label names of a collector
+func validate(c collector) error {
+	if !metricNameRE.MatchString(c.name()) {
+		return fmt.Errorf("metrics: invalid metric name %q", c.name())
+	}
+	_, histogram := c.(*HistogramVec)
+	seen := make(map[string]bool, len(c.labelNames()))
+	for _, label := range c.labelNames() {
+		switch {
+		case !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__"):
+			return fmt.Errorf("metrics: %s has invalid label name %q", c.name(), label)
+		case seen[label]:
+			return fmt.Errorf("metrics: %s has duplicate label %q", c.name(), label)
+		case histogram && label == "le":
+			return fmt.Errorf("metrics: histogram %s cannot use the label le", c.name())
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// err returns the failed registrations
+func (r *registry) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(r.errs...)
+}
+
+// Err returns the metrics that failed to register, e.g. because of a duplicate
+// or invalid name. Those metrics still count but are not served.
+func Err() error {
+	return defaultRegistry.err()
+}
+
+// Handler serves all registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return defaultRegistry.handler()
+}
+
+func (r *registry) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.write(w)
+	})
+}
+
+// write writes all collectors sorted by name
+func (r *registry) write(w io.Writer) {
+	r.mu.Lock()
+	collectors := make([]collector, 0, len(r.collectors))
+	for _, name := range sortedKeys(r.collectors) {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// family holds what all metric types share
+type family struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (f *family) name() string         { return f.metricName }
+func (f *family) labelNames() []string { return f.labels }
+
+func (f *family) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, helpEscaper.Replace(f.help), f.metricName, kind)
+}
+
+// key joins label values into a map key. A wrong number of values is logged
+// and the sample dropped, like a failed scrape of one series.
+func (f *family) key(values []string) (string, bool) {
+	if len(values) != len(f.labels) {
+		slog.Error("metrics: wrong number of label values, sample dropped",
+			"metric", f.metricName, "want", len(f.labels), "got", len(values))
+		return "", false
+	}
+	return strings.Join(values, "\xff"), true
+}
+
+// labelPairs formats label values for the key, with extra pairs appended
+func (f *family) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, f.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escaping of the text format: label values escape quotes, help text does not
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter. Registration errors are
+// reported by Err.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := newCounterVec(name, help, labels...)
+	defaultRegistry.register(c)
+	return c
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		family: family{metricName: name, help: help, labels: labels},
+		values: map[string]float64{},
+	}
+	if len(labels) == 0 {
+		// Expose counters without labels from the start
+		c.values[""] = 0
+	}
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n to the counter with the given label values
+func (c *CounterVec) Add(n float64, labelValues ...string) {
+	key, ok := c.key(labelValues)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bounds. Registration errors are reported by Err.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := newHistogramVec(name, help, buckets, labels...)
+	defaultRegistry.register(h)
+	return h
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		family:  family{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+// Observe records a value with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key, ok := h.key(labelValues)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelPairs(key), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelPairs(key), hist.count)
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are collected
+type GaugeFunc struct {
+	family
+	fn func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge reporting fn's result.
+// Registration errors are reported by Err.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := newGaugeFunc(name, help, fn)
+	defaultRegistry.register(g)
+	return g
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{
+		family: family{metricName: name, help: help},
+		fn:     fn,
+	}
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
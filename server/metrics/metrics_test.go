@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// exposition returns what the registry serves
+func exposition(r *registry) string {
+	var b strings.Builder
+	r.write(&b)
+	return b.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	r := newRegistry()
+	c := newCounterVec("test_total", "Requests.\nBy \"route\" in C:\\.", "route")
+	if err := r.register(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Inc("/b")
+	c.Add(2, "/a\n\"x\"\\")
+
+	want := `# HELP test_total Requests.\nBy "route" in C:\\.
+# TYPE test_total counter
+test_total{route="/a\n\"x\"\\"} 2
+test_total{route="/b"} 1
+`
+	if got := exposition(r); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	r := newRegistry()
+	r.register(newCounterVec("idle_total", "Never incremented."))
+
+	want := "# HELP idle_total Never incremented.\n# TYPE idle_total counter\nidle_total 0\n"
+	if got := exposition(r); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	r := newRegistry()
+	h := newHistogramVec("test_seconds", "Latency.", []float64{.1, 1}, "op")
+	r.register(h)
+	h.Observe(.05, "read")
+	h.Observe(.5, "read")
+	h.Observe(5, "read")
+
+	want := `# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="read",le="0.1"} 1
+test_seconds_bucket{op="read",le="1"} 2
+test_seconds_bucket{op="read",le="+Inf"} 3
+test_seconds_sum{op="read"} 5.55
+test_seconds_count{op="read"} 3
+`
+	if got := exposition(r); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGaugeFuncExposition(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{3, "3"},
+		{math.NaN(), "NaN"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, tt := range tests {
+		r := newRegistry()
+		r.register(newGaugeFunc("test_gauge", "Value.", func() float64 { return tt.value }))
+		if got := exposition(r); !strings.HasSuffix(got, "\ntest_gauge "+tt.want+"\n") {
+			t.Errorf("exposition of %v =\n%s\nwant value %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		c    collector
+	}{
+		{"invalid metric name", newCounterVec("test-total", "Dash.")},
+		{"metric name starting with a digit", newCounterVec("1_total", "Digit.")},
+		{"invalid label name", newCounterVec("test_total", "Label.", "a-b")},
+		{"reserved label name", newCounterVec("test_total", "Label.", "__name")},
+		{"duplicate label", newCounterVec("test_total", "Label.", "op", "op")},
+		{"le on a histogram", newHistogramVec("test_seconds", "Le.", DefaultBuckets, "le")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry()
+			if err := r.register(tt.c); err == nil {
+				t.Fatal("register() accepted an invalid metric")
+			}
+			if r.err() == nil {
+				t.Error("err() = nil after a failed registration")
+			}
+			if got := exposition(r); got != "" {
+				t.Errorf("invalid metric was served:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	r := newRegistry()
+	if err := r.register(newCounterVec("test_total", "First.")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.register(newGaugeFunc("test_total", "Second.", func() float64 { return 1 })); err == nil {
+		t.Fatal("register() accepted a duplicate name")
+	}
+	if got := exposition(r); !strings.Contains(got, "First.") || strings.Contains(got, "Second.") {
+		t.Errorf("exposition =\n%s\nwant only the first metric", got)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	r := newRegistry()
+	c := newCounterVec("test_total", "Requests.", "route", "code")
+	h := newHistogramVec("test_seconds", "Latency.", DefaultBuckets, "op")
+	r.register(c)
+	r.register(h)
+
+	// Dropped instead of panicking
+	c.Inc("/only-route")
+	h.Observe(1)
+	h.Observe(1, "read", "extra")
+
+	if got := exposition(r); strings.Contains(got, "test_total{") || strings.Contains(got, "test_seconds_count") {
+		t.Errorf("samples with wrong label counts were recorded:\n%s", got)
+	}
+}
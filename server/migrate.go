@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/abnotify/server/config"
+	"github.com/abnotify/server/storage"
+)
+
+// usage describes the command line
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [-config file] [command]
+
+Without a command the server is started.
+
+Commands:
+  migrate status  show the applied and pending schema migrations
+  migrate up      apply pending schema migrations and exit
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// runCommand runs a command given on the command line instead of the server
+// and returns the exit code
+func runCommand(cfg *config.Config, args []string) int {
+	switch strings.Join(args, " ") {
+	case "migrate status":
+		return migrateStatus(cfg)
+	case "migrate up":
+		return migrateUp(cfg)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+	flag.Usage()
+	return 2
+}
+
+// migrateStatus prints the schema version and every migration of the database
+func migrateStatus(cfg *config.Config) int {
+	migrations, err := storage.SchemaStatus(cfg.DBDriver, cfg.DatabaseSource())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read schema status: %v\n", err)
+		return 1
+	}
+
+	current, pending := 0, 0
+	for _, m := range migrations {
+		if m.AppliedAt == nil {
+			pending++
+		} else if m.Version > current {
+			current = m.Version
+		}
+	}
+	latest := storage.LatestSchemaVersion()
+
+	fmt.Printf("Database:       %s %s\n", cfg.DBDriver, databaseName(cfg))
+	fmt.Printf("Schema version: %d (this server: %d)\n", current, latest)
+	switch {
+	case current > latest:
+		fmt.Println("Status:         schema is newer than this server, upgrade the server")
+	case pending > 0:
+		fmt.Printf("Status:         %d pending, applied on startup or by \"migrate up\"\n", pending)
+	default:
+		fmt.Println("Status:         up to date")
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = m.AppliedAt.UTC().Format("2006-01-02 15:04:05 UTC")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	w.Flush()
+	return 0
+}
+
+// migrateUp applies the pending migrations, as the server does on startup
+func migrateUp(cfg *config.Config) int {
+	store, err := storage.Open(cfg.DBDriver, cfg.DatabaseSource())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+	store.Close()
+	fmt.Printf("Schema is up to date at version %d\n", storage.LatestSchemaVersion())
+	return 0
+}
+
+// databaseName returns the database file, or the PostgreSQL URL without its
+// password
+func databaseName(cfg *config.Config) string {
+	if cfg.DBDriver != storage.DriverPostgres {
+		return cfg.DBPath
+	}
+	u, err := url.Parse(cfg.DatabaseURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
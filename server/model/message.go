@@ -1,6 +1,9 @@
 package model
 
 import (
+	"encoding/json"
+	"errors"
+	"strconv"
 	"time"
 )
 
@@ -24,39 +27,267 @@ type Device struct {
 	// Android device fields
 	PublicKey string `json:"public_key,omitempty"` // RSA public key
 
+	// Secret required to receive the device's messages; the device key only
+	// allows sending. Empty for devices registered before it was introduced.
+	SubscribeSecret string `json:"-"`
+
 	Name      string    `json:"name,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	LastSeen  time.Time `json:"last_seen"`
 }
 
+// DeviceLink is a set of devices of the same user that share read state.
+// Devices join a link by presenting its token.
+type DeviceLink struct {
+	Token   string          `json:"token"`
+	Devices []*LinkedDevice `json:"devices"`
+}
+
+// LinkedDevice describes a member of a device link without its credentials
+type LinkedDevice struct {
+	DeviceType DeviceType `json:"device_type"`
+	Name       string     `json:"name,omitempty"`
+	LastSeen   time.Time  `json:"last_seen"`
+	Current    bool       `json:"current,omitempty"` // the requesting device
+}
+
+// DeviceStats describes a device for administration, without its credentials
+type DeviceStats struct {
+	ID          int64      `json:"id"`
+	DeviceKey   string     `json:"device_key"`
+	DeviceType  DeviceType `json:"device_type"`
+	Name        string     `json:"name,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastSeen    time.Time  `json:"last_seen"`
+	Online      bool       `json:"online"`
+	Messages    int64      `json:"messages"`    // stored messages
+	Undelivered int64      `json:"undelivered"` // not yet delivered
+	Unread      int64      `json:"unread"`
+}
+
+// DeviceList is a page of devices for administration
+type DeviceList struct {
+	Devices []*DeviceStats `json:"devices"`
+	Total   int            `json:"total"`  // all devices
+	Online  int            `json:"online"` // devices connected over WebSocket
+}
+
+// DeviceGroup represents a named set of devices addressed together
+type DeviceGroup struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Token     string    `json:"token,omitempty"` // secret required to manage and push to the group
+	CreatedAt time.Time `json:"created_at"`
+	Members   []string  `json:"members"` // device keys
+}
+
+// HistoryFilter selects stored messages of a device
+type HistoryFilter struct {
+	Group     string
+	Since     time.Time // zero for no lower bound
+	Until     time.Time // zero for no upper bound
+	Delivered *bool     // nil for both states
+	Before    int64     // cursor: only messages with a smaller row ID (0 for the newest)
+	Limit     int
+}
+
+// HistoryPage is a page of message history
+type HistoryPage struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// SearchResult is a message matched by full-text search.
+// Highlights wrap matched terms in <mark></mark>.
+type SearchResult struct {
+	*Message
+	TitleHighlight string  `json:"title_highlight,omitempty"`
+	BodyHighlight  string  `json:"body_highlight,omitempty"`
+	Rank           float64 `json:"rank"`
+}
+
+// SearchPage is a page of search results, best match first
+type SearchPage struct {
+	Query      string          `json:"query"`
+	Results    []*SearchResult `json:"results"`
+	NextOffset int             `json:"next_offset,omitempty"`
+}
+
+// RetentionReport describes what a retention run removed
+type RetentionReport struct {
+	StartedAt            time.Time        `json:"started_at"`
+	FinishedAt           time.Time        `json:"finished_at"`
+	Expired              int64            `json:"expired"`
+	GroupExpired         map[string]int64 `json:"group_expired,omitempty"`
+	Trimmed              int64            `json:"trimmed"`
+	Events               int64            `json:"events"`
+	RegistrationAttempts int64            `json:"registration_attempts"` // audit records deleted
+	Vacuumed             bool             `json:"vacuumed"`
+	Error                string           `json:"error,omitempty"`
+}
+
+// Removed returns the total number of messages removed
+func (r *RetentionReport) Removed() int64 {
+	total := r.Expired + r.Trimmed
+	for _, n := range r.GroupExpired {
+		total += n
+	}
+	return total
+}
+
+// RetentionStatus is the retention policy with the results of past runs
+type RetentionStatus struct {
+	MaxAge          int64            `json:"max_age"`
+	MaxMessages     int              `json:"max_messages"`
+	GroupMaxAge     map[string]int64 `json:"group_max_age,omitempty"`
+	KeepUndelivered bool             `json:"keep_undelivered"`
+	Interval        int64            `json:"interval"`
+	AuditMaxAge     int64            `json:"audit_max_age"`
+	LastRun         *RetentionReport `json:"last_run,omitempty"`
+	LastVacuum      *time.Time       `json:"last_vacuum,omitempty"`
+	TotalRemoved    int64            `json:"total_removed"`
+}
+
+// Registration attempt states
+const (
+	AttemptRejected    = "rejected"
+	AttemptQuarantined = "quarantined" // awaiting admin review
+	AttemptApproved    = "approved"
+	AttemptDismissed   = "dismissed"
+)
+
+// RegistrationAttempt is a change to an existing device that failed the
+// ownership check, kept for audit
+type RegistrationAttempt struct {
+	ID          int64      `json:"id"`
+	DeviceID    int64      `json:"device_id"`
+	DeviceKey   string     `json:"device_key"`
+	DeviceType  DeviceType `json:"device_type,omitempty"`
+	DeviceToken string     `json:"device_token,omitempty"`
+	PublicKey   string     `json:"public_key,omitempty"`
+	ClientIP    string     `json:"client_ip"`
+	UserAgent   string     `json:"user_agent,omitempty"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// DedupeKey identifies repeats of a push to a device within a window
+type DedupeKey struct {
+	Key    string
+	Window time.Duration
+}
+
+// Message lifecycle states recorded as message events
+const (
+	MessageStateScheduled    = "scheduled"
+	MessageStateCancelled    = "cancelled"
+	MessageStateStored       = "stored"
+	MessageStateQueued       = "queued" // device offline, waiting for reconnect
+	MessageStateSent         = "sent"   // written to a WebSocket connection
+	MessageStateAcked        = "acked"  // acked by the client
+	MessageStateAPNsAccepted = "apns_accepted"
+	MessageStateAPNsRejected = "apns_rejected"
+	MessageStateFailed       = "failed"
+	MessageStateExpired      = "expired"
+	MessageStateRecalled     = "recalled" // removed by the sender and dismissed on the device
+	MessageStateReplaced     = "replaced" // superseded by a newer message with the same notification ID
+	MessageStateRead         = "read"     // read on this or a linked device
+)
+
+// MessageEvent records a lifecycle transition of a message
+type MessageEvent struct {
+	MessageID string    `json:"-"`
+	DeviceID  int64     `json:"-"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	ApnsID    string    `json:"apns_id,omitempty"`
+	CreatedAt time.Time `json:"at"`
+}
+
+// MessageStatus represents the current state and history of a message
+type MessageStatus struct {
+	MessageID string          `json:"message_id"`
+	State     string          `json:"state"`
+	Delivered bool            `json:"delivered"`
+	Reason    string          `json:"reason,omitempty"`
+	ApnsID    string          `json:"apns_id,omitempty"`
+	Events    []*MessageEvent `json:"events"`
+}
+
+// Scheduled message states
+const (
+	ScheduleStatusPending   = "pending"
+	ScheduleStatusSent      = "sent"
+	ScheduleStatusCancelled = "cancelled"
+	ScheduleStatusFailed    = "failed"
+)
+
+// ScheduledMessage represents a push request stored for delivery at a later time
+type ScheduledMessage struct {
+	ID         int64        `json:"-"`
+	ScheduleID string       `json:"schedule_id"`
+	DeviceID   int64        `json:"-"`
+	MessageID  string       `json:"message_id"`
+	Title      string       `json:"title,omitempty"`
+	Body       string       `json:"body,omitempty"`
+	Group      string       `json:"group,omitempty"`
+	SendAt     time.Time    `json:"send_at"`
+	Status     string       `json:"status"`
+	CreatedAt  time.Time    `json:"created_at"`
+	Request    *PushRequest `json:"-"`
+	Dedupe     []DedupeKey  `json:"-"` // claimed when the message is stored
+}
+
+// GroupPush records a fan-out push to a group and its per-member results
+type GroupPush struct {
+	PushID    string            `json:"push_id"`
+	Group     string            `json:"group"`
+	CreatedAt time.Time         `json:"created_at"`
+	Results   []*DeliveryResult `json:"results"`
+}
+
 // Message represents a notification message
 type Message struct {
-	ID               int64     `json:"id"`
-	DeviceID         int64     `json:"device_id"`
-	MessageID        string    `json:"message_id"`
-	Title            string    `json:"title,omitempty"`
-	Body             string    `json:"body,omitempty"`
-	Group            string    `json:"group,omitempty"`
-	Icon             string    `json:"icon,omitempty"`
-	URL              string    `json:"url,omitempty"`
-	Sound            string    `json:"sound,omitempty"`
-	Badge            int       `json:"badge,omitempty"`
-	EncryptedPayload []byte    `json:"-"`
-	CreatedAt        time.Time `json:"created_at"`
-	Delivered        bool      `json:"delivered"`
+	ID               int64       `json:"id"`
+	DeviceID         int64       `json:"device_id"`
+	MessageID        string      `json:"message_id"`
+	NotificationID   string      `json:"notification_id,omitempty"` // sender-supplied id, recall and collapse key
+	Title            string      `json:"title,omitempty"`
+	Body             string      `json:"body,omitempty"`
+	Group            string      `json:"group,omitempty"`
+	Icon             string      `json:"icon,omitempty"`
+	URL              string      `json:"url,omitempty"`
+	Sound            string      `json:"sound,omitempty"`
+	Badge            int         `json:"badge,omitempty"`
+	EncryptedPayload []byte      `json:"-"`
+	CreatedAt        time.Time   `json:"created_at"`
+	ExpiresAt        *time.Time  `json:"expires_at,omitempty"`
+	SentAt           *time.Time  `json:"sent_at,omitempty"`  // last written to a WebSocket
+	AckedAt          *time.Time  `json:"acked_at,omitempty"` // acked by the client
+	ReadAt           *time.Time  `json:"read_at,omitempty"`  // read on this or a linked device
+	Delivered        bool        `json:"delivered"`          // acked by the client or accepted by APNs
+	Dedupe           []DedupeKey `json:"-"`                  // claimed when the message is stored
+	ScheduleID       string      `json:"-"`                  // scheduled message marked sent when the message is stored
+}
+
+// Expired reports whether the message has expired at the given time
+func (m *Message) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
 }
 
 // PushRequest represents an incoming push request
 type PushRequest struct {
 	// Basic fields
-	Title   string `json:"title" form:"title"`
-	Body    string `json:"body" form:"body"`
-	Group   string `json:"group,omitempty" form:"group,omitempty"`
-	Icon    string `json:"icon,omitempty" form:"icon,omitempty"`
-	URL     string `json:"url,omitempty" form:"url,omitempty"`
-	Sound   string `json:"sound,omitempty" form:"sound,omitempty"`
-	Badge   int    `json:"badge,omitempty" form:"badge,omitempty"`
-	Level   string `json:"level,omitempty" form:"level,omitempty"`
+	Title    string `json:"title" form:"title"`
+	Body     string `json:"body" form:"body"`
+	Group    string `json:"group,omitempty" form:"group,omitempty"`
+	Icon     string `json:"icon,omitempty" form:"icon,omitempty"`
+	URL      string `json:"url,omitempty" form:"url,omitempty"`
+	Sound    string `json:"sound,omitempty" form:"sound,omitempty"`
+	Badge    int    `json:"badge,omitempty" form:"badge,omitempty"`
+	Level    string `json:"level,omitempty" form:"level,omitempty"`
 	Subtitle string `json:"subtitle,omitempty" form:"subtitle,omitempty"`
 
 	// For SMS Forwarder compatibility (uses "content" instead of "body")
@@ -89,6 +320,141 @@ type PushRequest struct {
 
 	// Android encrypted content
 	EncryptedContent string `json:"encrypted_content,omitempty" form:"encrypted_content,omitempty"`
+
+	// Scheduled delivery: absolute time (RFC 3339 or unix) or relative delay (duration or seconds)
+	SendAt FlexString `json:"send_at,omitempty" form:"send_at,omitempty"`
+	Delay  FlexString `json:"delay,omitempty" form:"delay,omitempty"`
+
+	// Expiry for offline delivery: absolute time (RFC 3339 or unix) or TTL (duration or seconds)
+	ExpiresAt FlexString `json:"expires_at,omitempty" form:"expires_at,omitempty"`
+	TTL       FlexString `json:"ttl,omitempty" form:"ttl,omitempty"`
+
+	// Repeats with the same key return the original message instead of a new one
+	IdempotencyKey string `json:"idempotency_key,omitempty" form:"idempotency_key,omitempty"`
+}
+
+// MaxScheduleAhead is how far in the future a message may be scheduled
+const MaxScheduleAhead = 365 * 24 * time.Hour
+
+// ScheduleTime returns when the request should be delivered.
+// The zero time means the request should be delivered immediately.
+func (r *PushRequest) ScheduleTime(now time.Time) (time.Time, error) {
+	var at time.Time
+	switch {
+	case r.SendAt != "":
+		t, err := ParseTime(string(r.SendAt))
+		if err != nil {
+			return time.Time{}, errors.New("invalid send_at, expected RFC 3339 or unix time")
+		}
+		at = t
+	case r.Delay != "":
+		delay, err := ParseDuration(string(r.Delay))
+		if err != nil {
+			return time.Time{}, errors.New("invalid delay, expected duration (e.g. 10m) or seconds")
+		}
+		if delay < 0 {
+			return time.Time{}, errors.New("invalid delay, must not be negative")
+		}
+		at = now.Add(delay)
+	default:
+		return time.Time{}, nil
+	}
+
+	if !at.After(now) {
+		return time.Time{}, nil
+	}
+	if at.After(now.Add(MaxScheduleAhead)) {
+		return time.Time{}, errors.New("send_at is too far in the future")
+	}
+	return at, nil
+}
+
+// ExpiryTime returns when an undelivered message should be discarded.
+// defaultTTL applies when the request has neither expires_at nor ttl;
+// the zero time means the message never expires.
+func (r *PushRequest) ExpiryTime(now time.Time, defaultTTL time.Duration) (time.Time, error) {
+	switch {
+	case r.ExpiresAt != "":
+		t, err := ParseTime(string(r.ExpiresAt))
+		if err != nil {
+			return time.Time{}, errors.New("invalid expires_at, expected RFC 3339 or unix time")
+		}
+		return t, nil
+	case r.TTL != "":
+		ttl, err := ParseDuration(string(r.TTL))
+		if err != nil || ttl <= 0 {
+			return time.Time{}, errors.New("invalid ttl, expected positive duration (e.g. 1h) or seconds")
+		}
+		return now.Add(ttl), nil
+	case defaultTTL > 0:
+		return now.Add(defaultTTL), nil
+	}
+	return time.Time{}, nil
+}
+
+// ParseTime parses RFC 3339 or unix time in seconds or milliseconds
+func ParseTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if unix > 1e12 {
+			return time.UnixMilli(unix), nil
+		}
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ParseDuration parses a Go duration or a number of seconds
+func ParseDuration(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// FlexString is a string that also accepts JSON numbers
+type FlexString string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *FlexString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*s = FlexString(v)
+		return nil
+	}
+	*s = FlexString(data)
+	return nil
+}
+
+// Normalize fills Body from alternative field names and applies the default title
+func (r *PushRequest) Normalize() {
+	// SMS Forwarder compatibility: check alternative field names for body
+	// Common field names: body, content, msg, message, text, desp, description
+	if r.Body == "" {
+		if r.Content != "" {
+			r.Body = r.Content
+		} else if r.Msg != "" {
+			r.Body = r.Msg
+		} else if r.Message != "" {
+			r.Body = r.Message
+		} else if r.Text != "" {
+			r.Body = r.Text
+		} else if r.Desp != "" {
+			r.Body = r.Desp
+		} else if r.Description != "" {
+			r.Body = r.Description
+		}
+	}
+	// Default title if empty
+	if r.Title == "" {
+		r.Title = "Abnotify"
+	}
 }
 
 // WSMessage represents a WebSocket message
@@ -99,13 +465,46 @@ type WSMessage struct {
 	Data      interface{} `json:"data,omitempty"`
 }
 
+// ToWSMessage converts a stored message into a WebSocket message frame
+func (m *Message) ToWSMessage() *WSMessage {
+	data := map[string]interface{}{
+		"title": m.Title,
+		"body":  m.Body,
+		"group": m.Group,
+		"icon":  m.Icon,
+		"url":   m.URL,
+		"sound": m.Sound,
+		"badge": m.Badge,
+	}
+	if len(m.EncryptedPayload) > 0 {
+		data["encrypted_content"] = string(m.EncryptedPayload)
+	}
+	if m.ExpiresAt != nil {
+		data["expires_at"] = m.ExpiresAt.Unix()
+	}
+	if m.NotificationID != "" {
+		data["notification_id"] = m.NotificationID
+	}
+	return &WSMessage{
+		Type:      WSTypeMessage,
+		ID:        m.MessageID,
+		Timestamp: m.CreatedAt.Unix(),
+		Data:      data,
+	}
+}
+
 // WSMessageType constants
 const (
-	WSTypeMessage  = "message"
-	WSTypePing     = "ping"
-	WSTypePong     = "pong"
-	WSTypeAck      = "ack"
-	WSTypeRegister = "register"
+	WSTypeMessage    = "message"
+	WSTypePing       = "ping"
+	WSTypePong       = "pong"
+	WSTypeAck        = "ack"
+	WSTypeRegister   = "register"
+	WSTypeRecall     = "recall"      // server asks the client to dismiss notifications
+	WSTypeRead       = "read"        // client reports a message read; server syncs it to linked devices
+	WSTypeChallenge  = "challenge"   // server asks the client to sign a nonce with its RSA key
+	WSTypeAuth       = "auth"        // client answers a challenge with the signature
+	WSTypeKeyRotated = "key_rotated" // server tells the client its new device key
 )
 
 // RegisterRequest represents a device registration request
@@ -120,13 +519,51 @@ type RegisterRequest struct {
 	PublicKey string `json:"public_key,omitempty"`
 
 	Name string `json:"name,omitempty"`
+
+	// Proof of ownership required to change an existing device: its
+	// subscribe secret, or a signature by its public key
+	Secret    string `json:"secret,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // unix seconds covered by the signature
 }
 
 // PushResponse represents the response after pushing a message
 type PushResponse struct {
-	Success   bool   `json:"success"`
+	Success    bool   `json:"success"`
+	MessageID  string `json:"message_id,omitempty"`
+	ScheduleID string `json:"schedule_id,omitempty"`
+	Duplicate  bool   `json:"duplicate,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Transport names reported in delivery results
+const (
+	TransportAPNs      = "apns"
+	TransportWebSocket = "websocket"
+)
+
+// DeliveryResult represents the outcome of dispatching a message to one device
+type DeliveryResult struct {
+	DeviceKey string `json:"device_key"`
 	MessageID string `json:"message_id,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	Delivered bool   `json:"delivered"`        // accepted by APNs; WebSocket messages are delivered once the client acks
+	Sent      bool   `json:"sent,omitempty"`   // written to a connected WebSocket client, awaiting its ack
+	Queued    bool   `json:"queued,omitempty"` // stored for later delivery
+	Code      int    `json:"code"`
 	Error     string `json:"error,omitempty"`
+
+	// Set when the message was scheduled instead of delivered
+	ScheduleID string `json:"schedule_id,omitempty"`
+	SendAt     int64  `json:"send_at,omitempty"`
+
+	// Set when the request repeated an earlier push; MessageID is the original
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// OK reports whether the message was delivered or queued for delivery
+func (r *DeliveryResult) OK() bool {
+	return r.Error == ""
 }
 
 // BarkResponse represents Bark-compatible response format
@@ -156,6 +593,35 @@ func NewBarkError(code int64, message string) *BarkResponse {
 	}
 }
 
+// GroupRequest represents a group creation or membership request
+type GroupRequest struct {
+	Name       string   `json:"name" form:"name"`
+	DeviceKeys []string `json:"device_keys" form:"device_keys"`
+}
+
+// LinkRequest represents a request to create or join a device link
+type LinkRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// RenameDeviceRequest sets the display name of a device
+type RenameDeviceRequest struct {
+	Name string `json:"name" form:"name"`
+}
+
+// RotateKeyRequest represents a device key rotation request
+type RotateKeyRequest struct {
+	NewKey      string     `json:"new_key" form:"new_key"`           // generated when empty
+	GracePeriod FlexString `json:"grace_period" form:"grace_period"` // how long the old key keeps working
+}
+
+// KeyRotation is the result of a device key rotation
+type KeyRotation struct {
+	DeviceKey  string     `json:"device_key"`
+	OldKey     string     `json:"old_key"`
+	GraceUntil *time.Time `json:"grace_until,omitempty"` // old key accepted until then
+}
+
 // WebhookRequest represents a generic webhook request
 type WebhookRequest struct {
 	DeviceKey string `json:"device_key" binding:"required"`
@@ -175,9 +641,9 @@ type GitHubWebhook struct {
 		HTMLURL  string `json:"html_url"`
 	} `json:"repository"`
 	Pusher struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Login    string `json:"login"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		Login string `json:"login"`
 	} `json:"pusher"`
 	Sender struct {
 		Login string `json:"login"`
@@ -196,8 +662,8 @@ type GitLabWebhook struct {
 	ObjectKind string `json:"object_kind"`
 	Ref        string `json:"ref"`
 	Project    struct {
-		Name     string `json:"name"`
-		WebURL   string `json:"web_url"`
+		Name   string `json:"name"`
+		WebURL string `json:"web_url"`
 	} `json:"project"`
 	UserUsername string `json:"user_username"`
 	UserName     string `json:"user_name"`
@@ -212,15 +678,15 @@ type GitLabWebhook struct {
 // DockerHubWebhook represents a Docker Hub webhook payload
 type DockerHubWebhook struct {
 	PushData struct {
-		PushedAt int64  `json:"pushed_at"`
+		PushedAt int64    `json:"pushed_at"`
 		Images   []string `json:"images"`
-		Pusher   string `json:"pusher"`
-		Tag      string `json:"tag"`
+		Pusher   string   `json:"pusher"`
+		Tag      string   `json:"tag"`
 	} `json:"push_data"`
 	Repository struct {
-		Name       string `json:"name"`
-		RepoName   string `json:"repo_name"`
-		RepoURL    string `json:"repo_url"`
+		Name     string `json:"name"`
+		RepoName string `json:"repo_name"`
+		RepoURL  string `json:"repo_url"`
 	} `json:"repository"`
 }
 
@@ -233,8 +699,8 @@ type GiteaWebhook struct {
 		HTMLURL  string `json:"html_url"`
 	} `json:"repository"`
 	Pusher struct {
-		Name     string `json:"name"`
-		Login    string `json:"login"`
+		Name  string `json:"name"`
+		Login string `json:"login"`
 	} `json:"pusher"`
 	Sender struct {
 		Login string `json:"login"`
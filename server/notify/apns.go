@@ -0,0 +1,224 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/abnotify/server/apns"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+// APNsNotifier delivers messages to iOS devices through APNs
+type APNsNotifier struct {
+	storage storage.Storage
+
+	mu     sync.RWMutex
+	client *apns.Client
+}
+
+// NewAPNsNotifier creates a new APNs notifier. A nil client disables it.
+func NewAPNsNotifier(client *apns.Client, storage storage.Storage) *APNsNotifier {
+	return &APNsNotifier{
+		client:  client,
+		storage: storage,
+	}
+}
+
+// SetClient replaces the APNs client, e.g. after the credentials changed.
+// A nil client disables the notifier.
+func (n *APNsNotifier) SetClient(client *apns.Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.client = client
+}
+
+// apnsClient returns the current APNs client
+func (n *APNsNotifier) apnsClient() *apns.Client {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.client
+}
+
+// Name implements Notifier
+func (n *APNsNotifier) Name() string {
+	return model.TransportAPNs
+}
+
+// Accepts implements Notifier. Without APNs credentials iOS devices fall
+// through to the next notifier.
+func (n *APNsNotifier) Accepts(device *model.Device) bool {
+	return n.apnsClient() != nil && device.DeviceType == model.DeviceTypeIOS
+}
+
+// Notify implements Notifier
+func (n *APNsNotifier) Notify(ctx context.Context, device *model.Device, notification *Notification, result *model.DeliveryResult) {
+	if device.DeviceToken == "" {
+		result.Code = http.StatusBadRequest
+		result.Error = "device token not found"
+		return
+	}
+
+	req := notification.Request
+	payload := buildPayload(req)
+
+	// Always set a notification identifier so the message can be recalled
+	collapseID := req.ID
+	if collapseID == "" {
+		collapseID = notification.Message.MessageID
+	}
+	payload.ID = collapseID
+	headers := map[string]string{
+		"apns-collapse-id": collapseID,
+	}
+	if expiresAt := notification.Message.ExpiresAt; expiresAt != nil {
+		headers["apns-expiration"] = strconv.FormatInt(expiresAt.Unix(), 10)
+	}
+
+	event := &model.MessageEvent{
+		MessageID: notification.Message.MessageID,
+		DeviceID:  device.ID,
+	}
+
+	// The client may have been removed by a reload since Accepts
+	client := n.apnsClient()
+	if client == nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = "APNs not configured"
+		return
+	}
+	resp, err := client.Push(ctx, device.DeviceToken, payload, headers)
+	if err != nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = "APNs push failed: " + err.Error()
+		event.State = model.MessageStateFailed
+		event.Reason = err.Error()
+		n.storage.AddMessageEvent(event)
+		return
+	}
+
+	event.ApnsID = resp.ApnsID
+	if resp.StatusCode == 200 {
+		result.Delivered = true
+		n.storage.MarkMessageDelivered(notification.Message.MessageID)
+		event.State = model.MessageStateAPNsAccepted
+		n.storage.AddMessageEvent(event)
+		return
+	}
+
+	event.State = model.MessageStateAPNsRejected
+	event.Reason = fmt.Sprintf("%d %s", resp.StatusCode, resp.Reason)
+	n.storage.AddMessageEvent(event)
+
+	// Handle errors
+	if resp.StatusCode == 410 || strings.Contains(resp.Reason, "BadDeviceToken") {
+		// Device token invalid, clear it
+		n.storage.UpdateDeviceToken(device.DeviceKey, "")
+	}
+
+	result.Code = resp.StatusCode
+	result.Error = "APNs push failed: " + resp.Reason
+}
+
+// Recall implements Notifier by removing the recalled notifications
+func (n *APNsNotifier) Recall(ctx context.Context, device *model.Device, r *Recall, result *model.DeliveryResult) {
+	n.pushDelete(ctx, device, r.NotificationIDs(), result)
+}
+
+// SyncRead implements Notifier by removing the notifications read elsewhere
+func (n *APNsNotifier) SyncRead(ctx context.Context, device *model.Device, messages []*model.Message, result *model.DeliveryResult) {
+	n.pushDelete(ctx, device, notificationIDs(messages), result)
+}
+
+// pushDelete sends a background delete push for each notification identifier
+func (n *APNsNotifier) pushDelete(ctx context.Context, device *model.Device, ids []string, result *model.DeliveryResult) {
+	if device.DeviceToken == "" {
+		result.Code = http.StatusBadRequest
+		result.Error = "device token not found"
+		return
+	}
+
+	client := n.apnsClient()
+	if client == nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = "APNs not configured"
+		return
+	}
+
+	headers := map[string]string{
+		// Background pushes must use low priority
+		"apns-priority": "5",
+	}
+	for _, id := range ids {
+		payload := &apns.Payload{
+			Aps:    apns.Aps{ContentAvailable: 1},
+			ID:     id,
+			Delete: true,
+		}
+		resp, err := client.Push(ctx, device.DeviceToken, payload, headers)
+		if err != nil {
+			result.Code = http.StatusInternalServerError
+			result.Error = "APNs push failed: " + err.Error()
+			return
+		}
+		if resp.StatusCode != 200 {
+			if resp.StatusCode == 410 || strings.Contains(resp.Reason, "BadDeviceToken") {
+				n.storage.UpdateDeviceToken(device.DeviceKey, "")
+			}
+			result.Code = resp.StatusCode
+			result.Error = "APNs push failed: " + resp.Reason
+			return
+		}
+	}
+	result.Delivered = true
+}
+
+// buildPayload builds the Bark-compatible APNs payload for a request
+func buildPayload(req *model.PushRequest) *apns.Payload {
+	sound := req.Sound
+	if sound != "" && !strings.HasSuffix(sound, ".caf") {
+		sound += ".caf"
+	}
+	if sound == "" {
+		sound = "1107.caf"
+	}
+
+	// Handle call (持续响铃)
+	if req.Call {
+		sound = "alarm.caf"
+	}
+
+	// Prepare badge
+	var badge *int
+	if req.Badge > 0 {
+		badge = &req.Badge
+	}
+
+	return &apns.Payload{
+		Aps: apns.Aps{
+			Alert: apns.Alert{
+				Title:    req.Title,
+				Subtitle: req.Subtitle,
+				Body:     req.Body,
+			},
+			Badge:          badge,
+			Sound:          sound,
+			ThreadID:       req.Group,
+			Category:       "myNotificationCategory",
+			MutableContent: 1,
+		},
+		Group:     req.Group,
+		Icon:      req.Icon,
+		Image:     req.Image,
+		URL:       req.URL,
+		Badge:     req.Badge,
+		Call:      req.Call,
+		IsArchive: req.IsArchive,
+		Level:     req.Level,
+		Delete:    req.Delete,
+	}
+}
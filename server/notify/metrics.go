@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"github.com/abnotify/server/metrics"
+	"github.com/abnotify/server/model"
+)
+
+var deliveries = metrics.NewCounterVec(
+	"abnotify_deliveries_total",
+	"Messages dispatched to devices by transport and outcome.",
+	"transport", "outcome",
+)
+
+// recordDelivery counts a dispatch result, if any
+func recordDelivery(result *model.DeliveryResult) {
+	if result == nil {
+		return
+	}
+	transport := result.Transport
+	if transport == "" {
+		transport = "none"
+	}
+	deliveries.Inc(transport, deliveryOutcome(result))
+}
+
+// deliveryOutcome classifies a dispatch result for metrics
+func deliveryOutcome(result *model.DeliveryResult) string {
+	switch {
+	case result.Duplicate:
+		return "duplicate"
+	case result.ScheduleID != "":
+		return "scheduled"
+	case result.Delivered:
+		return "delivered"
+	case result.Sent:
+		return "sent"
+	case result.Queued:
+		return "queued"
+	case result.Code >= 400 && result.Code < 500:
+		return "rejected"
+	}
+	return "failed"
+}
@@ -0,0 +1,508 @@
+package notify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abnotify/server/crypto"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+	"github.com/google/uuid"
+)
+
+// Notifier delivers messages to devices over a single transport
+type Notifier interface {
+	// Name returns the transport name reported in delivery results
+	Name() string
+	// Accepts reports whether this notifier can deliver to the device
+	Accepts(device *model.Device) bool
+	// Notify delivers the notification and records the outcome in result
+	Notify(ctx context.Context, device *model.Device, n *Notification, result *model.DeliveryResult)
+	// Recall asks the device to dismiss notifications and records the outcome in result
+	Recall(ctx context.Context, device *model.Device, r *Recall, result *model.DeliveryResult)
+	// SyncRead tells the device that messages were read on a linked device
+	SyncRead(ctx context.Context, device *model.Device, messages []*model.Message, result *model.DeliveryResult)
+}
+
+// Notification is a normalized, already persisted message handed to a notifier
+type Notification struct {
+	Message  *model.Message
+	Request  *model.PushRequest
+	Replaced []string // IDs of older messages with the same notification ID
+}
+
+// Recall is a request to dismiss notifications on a device
+type Recall struct {
+	ID       string           // message ID or notification ID given by the sender
+	Messages []*model.Message // stored messages removed by the recall
+}
+
+// NotificationIDs returns the identifiers the device shows the recalled
+// notifications under
+func (r *Recall) NotificationIDs() []string {
+	if len(r.Messages) == 0 {
+		return []string{r.ID}
+	}
+	return notificationIDs(r.Messages)
+}
+
+// notificationIDs returns the identifiers devices show messages under: the
+// notification ID when the sender set one, otherwise the message ID
+func notificationIDs(messages []*model.Message) []string {
+	seen := make(map[string]bool, len(messages))
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		id := msg.NotificationID
+		if id == "" {
+			id = msg.MessageID
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// messageIDs returns the message IDs of messages
+func messageIDs(messages []*model.Message) []string {
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.MessageID)
+	}
+	return ids
+}
+
+// Dispatcher persists messages and delivers them through the first notifier
+// that accepts the target device
+type Dispatcher struct {
+	storage   storage.Storage
+	crypto    *crypto.Crypto
+	notifiers []Notifier
+
+	mu                sync.RWMutex // guards the settings below, which may be reloaded
+	defaultTTL        time.Duration
+	idempotencyWindow time.Duration // how long idempotency keys are remembered
+	dedupeWindow      time.Duration // content dedupe window (0 = disabled)
+}
+
+// NewDispatcher creates a new dispatcher. Notifiers are tried in order.
+func NewDispatcher(storage storage.Storage, notifiers ...Notifier) *Dispatcher {
+	return &Dispatcher{
+		storage:   storage,
+		crypto:    crypto.NewCrypto(),
+		notifiers: notifiers,
+	}
+}
+
+// SetDefaultTTL sets the expiry applied to messages without ttl or expires_at
+func (d *Dispatcher) SetDefaultTTL(ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.defaultTTL = ttl
+}
+
+// ttl returns the current default expiry
+func (d *Dispatcher) ttl() time.Duration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.defaultTTL
+}
+
+// SetDedupe sets how long idempotency keys are remembered and the window in
+// which identical content to the same device is collapsed (0 disables it)
+func (d *Dispatcher) SetDedupe(idempotencyWindow, contentWindow time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.idempotencyWindow = idempotencyWindow
+	d.dedupeWindow = contentWindow
+}
+
+// Dispatch stores the request as a message for the device and delivers it,
+// or schedules it when the request carries send_at or delay.
+// The returned error is only set when the message could not be stored;
+// transport failures are reported in the result.
+func (d *Dispatcher) Dispatch(ctx context.Context, device *model.Device, req *model.PushRequest) (*model.DeliveryResult, error) {
+	result, err := d.dispatch(ctx, device, req)
+	recordDelivery(result)
+	return result, err
+}
+
+// dispatch implements Dispatch
+func (d *Dispatcher) dispatch(ctx context.Context, device *model.Device, req *model.PushRequest) (*model.DeliveryResult, error) {
+	// Bark-compatible recall: delete=1&id=...
+	if req.Delete {
+		if req.ID == "" {
+			return &model.DeliveryResult{
+				DeviceKey: device.DeviceKey,
+				Code:      http.StatusBadRequest,
+				Error:     "id is required to delete a notification",
+			}, nil
+		}
+		return d.Recall(ctx, device, req.ID)
+	}
+
+	now := time.Now()
+	sendAt, err := req.ScheduleTime(now)
+	if err == nil {
+		_, err = req.ExpiryTime(now, d.ttl())
+	}
+	if err != nil {
+		return &model.DeliveryResult{
+			DeviceKey: device.DeviceKey,
+			Code:      http.StatusBadRequest,
+			Error:     err.Error(),
+		}, nil
+	}
+	if !sendAt.IsZero() {
+		return d.schedule(ctx, device, req, sendAt)
+	}
+
+	return d.deliver(ctx, device, req, uuid.New().String(), "")
+}
+
+// schedule stores the request for delivery by the scheduler at sendAt
+func (d *Dispatcher) schedule(ctx context.Context, device *model.Device, req *model.PushRequest, sendAt time.Time) (*model.DeliveryResult, error) {
+	sm := &model.ScheduledMessage{
+		ScheduleID: uuid.New().String(),
+		DeviceID:   device.ID,
+		MessageID:  uuid.New().String(),
+		SendAt:     sendAt,
+		Request:    req,
+		Dedupe:     d.dedupeKeys(req, nil),
+	}
+	if err := d.storage.CreateScheduledMessage(sm); err != nil {
+		return d.duplicate(ctx, device, err)
+	}
+
+	logging.FromContext(ctx).Info("message scheduled",
+		logging.Key(device.DeviceKey), "schedule_id", sm.ScheduleID, "send_at", sendAt.Format(time.RFC3339))
+	return &model.DeliveryResult{
+		DeviceKey:  device.DeviceKey,
+		MessageID:  sm.MessageID,
+		Code:       http.StatusOK,
+		ScheduleID: sm.ScheduleID,
+		SendAt:     sendAt.Unix(),
+	}, nil
+}
+
+// deliver stores the request as a message with the given ID and delivers it.
+// A scheduled message is marked sent as its message is stored; it returns
+// storage.ErrScheduleNotPending when it was cancelled or delivered meanwhile.
+func (d *Dispatcher) deliver(ctx context.Context, device *model.Device, req *model.PushRequest, messageID, scheduleID string) (*model.DeliveryResult, error) {
+	msg := &model.Message{
+		DeviceID:       device.ID,
+		MessageID:      messageID,
+		ScheduleID:     scheduleID,
+		NotificationID: req.ID,
+		Title:          req.Title,
+		Body:           req.Body,
+		Group:          req.Group,
+		Icon:           req.Icon,
+		URL:            req.URL,
+		Sound:          req.Sound,
+		Badge:          req.Badge,
+	}
+
+	// TTL is relative to delivery, so scheduled messages expire after their send time
+	now := time.Now()
+	if expiresAt, _ := req.ExpiryTime(now, d.ttl()); !expiresAt.IsZero() {
+		if !expiresAt.After(now) {
+			return &model.DeliveryResult{
+				DeviceKey: device.DeviceKey,
+				MessageID: messageID,
+				Code:      http.StatusBadRequest,
+				Error:     "message already expired",
+			}, nil
+		}
+		msg.ExpiresAt = &expiresAt
+	}
+
+	// Encrypt if device has public key
+	if device.PublicKey != "" {
+		msg.EncryptedPayload = d.encrypt(ctx, device, msg)
+	}
+
+	// A notification ID updates the previous version in place
+	msg.Dedupe = d.dedupeKeys(req, msg)
+	notification := &Notification{Message: msg, Request: req}
+	if msg.NotificationID != "" {
+		replaced, err := d.storage.ReplaceMessage(msg)
+		if err != nil {
+			return d.duplicate(ctx, device, err)
+		}
+		notification.Replaced = replaced
+	} else if err := d.storage.CreateMessage(msg); err != nil {
+		return d.duplicate(ctx, device, err)
+	}
+
+	result := &model.DeliveryResult{
+		DeviceKey: device.DeviceKey,
+		MessageID: msg.MessageID,
+		Code:      http.StatusOK,
+	}
+
+	notifier := d.notifierFor(device)
+	if notifier == nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = "no transport available for device"
+		return result, nil
+	}
+
+	result.Transport = notifier.Name()
+	notifier.Notify(ctx, device, notification, result)
+	if result.Queued {
+		d.storage.AddMessageEvent(&model.MessageEvent{MessageID: msg.MessageID, DeviceID: device.ID, State: model.MessageStateQueued})
+	}
+	logging.FromContext(ctx).Info("message dispatched",
+		logging.Key(device.DeviceKey), "message_id", msg.MessageID, "transport", result.Transport,
+		"delivered", result.Delivered, "sent", result.Sent, "queued", result.Queued, "error", result.Error)
+
+	return result, nil
+}
+
+// dedupeKeys returns the keys identifying repeats of the request: its
+// idempotency key and, when msg is given and content dedupe is enabled, a hash
+// of the message content
+func (d *Dispatcher) dedupeKeys(req *model.PushRequest, msg *model.Message) []model.DedupeKey {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var keys []model.DedupeKey
+	if req.IdempotencyKey != "" && d.idempotencyWindow > 0 {
+		keys = append(keys, model.DedupeKey{Key: "key:" + req.IdempotencyKey, Window: d.idempotencyWindow})
+	}
+	if msg != nil && d.dedupeWindow > 0 {
+		sum := sha256.Sum256([]byte(msg.Title + "\x00" + msg.Body + "\x00" + msg.Group))
+		keys = append(keys, model.DedupeKey{Key: "content:" + hex.EncodeToString(sum[:]), Window: d.dedupeWindow})
+	}
+	return keys
+}
+
+// duplicate turns a storage duplicate error into a result carrying the
+// original message ID. Other errors are returned as is.
+func (d *Dispatcher) duplicate(ctx context.Context, device *model.Device, err error) (*model.DeliveryResult, error) {
+	var dup *storage.DuplicateError
+	if !errors.As(err, &dup) {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("duplicate message dropped",
+		logging.Key(device.DeviceKey), "message_id", dup.MessageID, "schedule_id", dup.ScheduleID)
+	return &model.DeliveryResult{
+		DeviceKey:  device.DeviceKey,
+		MessageID:  dup.MessageID,
+		ScheduleID: dup.ScheduleID,
+		Code:       http.StatusOK,
+		Duplicate:  true,
+	}, nil
+}
+
+// Recall deletes the stored messages of the device matching id (a message ID
+// or notification ID) and asks the device to dismiss them. Matching scheduled
+// messages still pending are cancelled. The device is notified even when
+// nothing is stored, as the notification may still be shown.
+func (d *Dispatcher) Recall(ctx context.Context, device *model.Device, id string) (*model.DeliveryResult, error) {
+	// Cancel first, so a scheduled message cannot be stored after the recall
+	cancelled, err := d.cancelScheduled(device, id)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := d.storage.RecallMessages(device.ID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.DeliveryResult{
+		DeviceKey: device.DeviceKey,
+		MessageID: id,
+		Code:      http.StatusOK,
+	}
+
+	notifier := d.notifierFor(device)
+	if notifier == nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = "no transport available for device"
+		return result, nil
+	}
+
+	result.Transport = notifier.Name()
+	notifier.Recall(ctx, device, &Recall{ID: id, Messages: messages}, result)
+	logging.FromContext(ctx).Info("message recalled",
+		logging.Key(device.DeviceKey), "id", id, "removed", len(messages), "cancelled", cancelled,
+		"transport", result.Transport, "delivered", result.Delivered, "sent", result.Sent, "error", result.Error)
+
+	return result, nil
+}
+
+// cancelScheduled cancels the pending scheduled messages of the device
+// matching id (a message ID or notification ID) and returns how many it
+// cancelled
+func (d *Dispatcher) cancelScheduled(device *model.Device, id string) (int, error) {
+	pending, err := d.storage.GetPendingScheduledMessages(device.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, sm := range pending {
+		if sm.MessageID != id && sm.Request.ID != id {
+			continue
+		}
+		cancelled, err := d.storage.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusPending, model.ScheduleStatusCancelled)
+		if err != nil {
+			return n, err
+		}
+		// Already being delivered, RecallMessages removes it once stored
+		if !cancelled {
+			continue
+		}
+		d.storage.AddMessageEvent(&model.MessageEvent{
+			MessageID: sm.MessageID,
+			DeviceID:  device.ID,
+			State:     model.MessageStateCancelled,
+			Reason:    "recalled",
+		})
+		n++
+	}
+	return n, nil
+}
+
+// readSyncWindow bounds how far apart copies of a message pushed separately
+// to linked devices may have been created to be considered the same message
+const readSyncWindow = 5 * time.Minute
+
+// MarkRead marks a message of the device as read and syncs the read state to
+// the devices linked with it. It reports whether the message exists.
+func (d *Dispatcher) MarkRead(ctx context.Context, device *model.Device, messageID string) (bool, error) {
+	msg, changed, err := d.storage.MarkMessageRead(device.ID, messageID)
+	if err != nil || msg == nil {
+		return false, err
+	}
+	// Already read: the linked devices were synced the first time
+	if !changed {
+		return true, nil
+	}
+
+	token, err := d.storage.GetDeviceLink(device.ID)
+	if err != nil || token == "" {
+		return true, err
+	}
+	linked, err := d.storage.GetLinkedDevices(token)
+	if err != nil {
+		return true, err
+	}
+
+	for _, other := range linked {
+		if other.ID == device.ID {
+			continue
+		}
+		messages, err := d.storage.MarkMatchingMessagesRead(other.ID, msg, readSyncWindow)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to mark linked messages read", logging.Key(other.DeviceKey), "error", err)
+			continue
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		notifier := d.notifierFor(other)
+		if notifier == nil {
+			continue
+		}
+		result := &model.DeliveryResult{DeviceKey: other.DeviceKey, Transport: notifier.Name(), Code: http.StatusOK}
+		notifier.SyncRead(ctx, other, messages, result)
+		logging.FromContext(ctx).Info("read state synced",
+			"from", logging.RedactKey(device.DeviceKey), "to", logging.RedactKey(other.DeviceKey), "messages", len(messages),
+			"transport", result.Transport, "delivered", result.Delivered, "sent", result.Sent, "error", result.Error)
+	}
+
+	return true, nil
+}
+
+// DispatchToKey looks up the device by key and dispatches the request to it.
+// Lookup and storage failures are reported in the result.
+func (d *Dispatcher) DispatchToKey(ctx context.Context, deviceKey string, req *model.PushRequest) *model.DeliveryResult {
+	device, err := d.storage.GetDeviceByKey(deviceKey)
+	if errors.Is(err, storage.ErrDeviceKeyRetired) {
+		return &model.DeliveryResult{DeviceKey: deviceKey, Code: http.StatusGone, Error: err.Error()}
+	}
+	if err != nil {
+		return &model.DeliveryResult{DeviceKey: deviceKey, Code: http.StatusInternalServerError, Error: "database error"}
+	}
+	if device == nil {
+		return &model.DeliveryResult{DeviceKey: deviceKey, Code: http.StatusNotFound, Error: "device not found"}
+	}
+
+	result, err := d.Dispatch(ctx, device, req)
+	if err != nil {
+		return &model.DeliveryResult{DeviceKey: deviceKey, Code: http.StatusInternalServerError, Error: "failed to store message"}
+	}
+	return result
+}
+
+// DispatchToKeys dispatches the request to every device key concurrently.
+// Duplicate keys are delivered once; results keep the order of first appearance.
+func (d *Dispatcher) DispatchToKeys(ctx context.Context, deviceKeys []string, req *model.PushRequest) []*model.DeliveryResult {
+	seen := make(map[string]bool, len(deviceKeys))
+	unique := make([]string, 0, len(deviceKeys))
+	for _, key := range deviceKeys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, key)
+	}
+
+	results := make([]*model.DeliveryResult, len(unique))
+	var wg sync.WaitGroup
+	for i, key := range unique {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			results[i] = d.DispatchToKey(ctx, key, req)
+		}(i, key)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// notifierFor returns the first notifier accepting the device
+func (d *Dispatcher) notifierFor(device *model.Device) Notifier {
+	for _, n := range d.notifiers {
+		if n.Accepts(device) {
+			return n
+		}
+	}
+	return nil
+}
+
+// encrypt encrypts the message content with the device public key
+func (d *Dispatcher) encrypt(ctx context.Context, device *model.Device, msg *model.Message) []byte {
+	publicKey, err := d.crypto.ParsePublicKey(device.PublicKey)
+	if err != nil {
+		logging.FromContext(ctx).Error("invalid device public key", logging.Key(device.DeviceKey), "error", err)
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"title": msg.Title,
+		"body":  msg.Body,
+		"group": msg.Group,
+	}
+	payloadBytes, _ := json.Marshal(payload)
+	encryptedContent, err := d.crypto.EncryptMessage(publicKey, payloadBytes)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to encrypt message", logging.Key(device.DeviceKey), "error", err)
+		return nil
+	}
+	return []byte(encryptedContent)
+}
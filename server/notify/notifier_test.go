@@ -0,0 +1,372 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+// fakeNotifier records what it is asked to deliver
+type fakeNotifier struct {
+	mu       sync.Mutex
+	notified []*Notification
+	recalls  []*Recall
+	reads    [][]*model.Message
+	fail     string // error reported for every notification, "" to queue them
+}
+
+func (f *fakeNotifier) Name() string                      { return "fake" }
+func (f *fakeNotifier) Accepts(device *model.Device) bool { return true }
+
+func (f *fakeNotifier) Notify(ctx context.Context, device *model.Device, n *Notification, result *model.DeliveryResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notified = append(f.notified, n)
+	if f.fail != "" {
+		result.Code = http.StatusInternalServerError
+		result.Error = f.fail
+		return
+	}
+	result.Queued = true
+}
+
+func (f *fakeNotifier) Recall(ctx context.Context, device *model.Device, r *Recall, result *model.DeliveryResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recalls = append(f.recalls, r)
+}
+
+func (f *fakeNotifier) SyncRead(ctx context.Context, device *model.Device, messages []*model.Message, result *model.DeliveryResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads = append(f.reads, messages)
+}
+
+// notifiedIDs returns the IDs of the notified messages in order
+func (f *fakeNotifier) notifiedIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, len(f.notified))
+	for i, n := range f.notified {
+		ids[i] = n.Message.MessageID
+	}
+	return ids
+}
+
+// openTestStorage opens a migrated SQLite database in a temporary directory
+func openTestStorage(t *testing.T, path string) storage.Storage {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "abnotify.db")
+	}
+	store, err := storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// createTestDevice registers an Android device
+func createTestDevice(t *testing.T, store storage.Storage, key string) *model.Device {
+	t.Helper()
+	device := &model.Device{DeviceKey: key, DeviceType: "android"}
+	if err := store.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+// newTestDispatcher returns a dispatcher delivering through a fake notifier
+// and a device to deliver to
+func newTestDispatcher(t *testing.T) (*Dispatcher, storage.Storage, *fakeNotifier, *model.Device) {
+	t.Helper()
+	store := openTestStorage(t, "")
+	notifier := &fakeNotifier{}
+	return NewDispatcher(store, notifier), store, notifier, createTestDevice(t, store, "device")
+}
+
+func TestDispatchSchedule(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       model.PushRequest
+		scheduled bool
+		code      int
+	}{
+		{"immediate", model.PushRequest{Title: "t", Body: "now"}, false, http.StatusOK},
+		{"delay", model.PushRequest{Title: "t", Body: "later", Delay: "10m"}, true, http.StatusOK},
+		{"send_at", model.PushRequest{Title: "t", Body: "later", SendAt: model.FlexString(time.Now().Add(time.Hour).Format(time.RFC3339))}, true, http.StatusOK},
+		{"send_at in the past", model.PushRequest{Title: "t", Body: "late", SendAt: "1"}, false, http.StatusOK},
+		{"invalid delay", model.PushRequest{Title: "t", Body: "bad", Delay: "soon"}, false, http.StatusBadRequest},
+		{"too far ahead", model.PushRequest{Title: "t", Body: "far", Delay: "9000h"}, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, store, notifier, device := newTestDispatcher(t)
+
+			result, err := d.Dispatch(context.Background(), device, &tt.req)
+			if err != nil {
+				t.Fatalf("Dispatch() error = %v", err)
+			}
+			if result.Code != tt.code {
+				t.Fatalf("Dispatch() code = %d (%s), want %d", result.Code, result.Error, tt.code)
+			}
+			if (result.ScheduleID != "") != tt.scheduled {
+				t.Errorf("Dispatch() schedule ID = %q, want scheduled %v", result.ScheduleID, tt.scheduled)
+			}
+
+			delivered := len(notifier.notifiedIDs()) > 0
+			if wantDelivered := !tt.scheduled && tt.code == http.StatusOK; delivered != wantDelivered {
+				t.Errorf("delivered now = %v, want %v", delivered, wantDelivered)
+			}
+			if !tt.scheduled {
+				return
+			}
+
+			sm, err := store.GetScheduledMessage(result.ScheduleID)
+			if err != nil || sm == nil {
+				t.Fatalf("GetScheduledMessage() = %v, %v", sm, err)
+			}
+			if sm.Status != model.ScheduleStatusPending || sm.MessageID != result.MessageID || sm.Body != tt.req.Body {
+				t.Errorf("scheduled message = %+v, want pending %s", sm, result.MessageID)
+			}
+		})
+	}
+}
+
+func TestRecall(t *testing.T) {
+	tests := []struct {
+		name              string
+		pushes            []model.PushRequest
+		recall            func(ids []string) string // picks the ID to recall from the pushed message IDs
+		wantRemoved       int
+		wantNotifications []string
+		wantCancelled     bool
+	}{
+		{
+			name:              "by message ID",
+			pushes:            []model.PushRequest{{Title: "t", Body: "a"}, {Title: "t", Body: "b"}},
+			recall:            func(ids []string) string { return ids[0] },
+			wantRemoved:       1,
+			wantNotifications: nil, // the recalled message ID
+		},
+		{
+			name:              "by notification ID",
+			pushes:            []model.PushRequest{{Title: "t", Body: "a", ID: "n1"}, {Title: "t", Body: "b"}},
+			recall:            func(ids []string) string { return "n1" },
+			wantRemoved:       1,
+			wantNotifications: []string{"n1"},
+		},
+		{
+			name:              "scheduled message",
+			pushes:            []model.PushRequest{{Title: "t", Body: "later", ID: "n1", Delay: "10m"}},
+			recall:            func(ids []string) string { return "n1" },
+			wantNotifications: []string{"n1"},
+			wantCancelled:     true,
+		},
+		{
+			name:              "nothing stored",
+			recall:            func(ids []string) string { return "shown-earlier" },
+			wantNotifications: []string{"shown-earlier"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, store, notifier, device := newTestDispatcher(t)
+			var ids, scheduleIDs []string
+			for i := range tt.pushes {
+				result, err := d.Dispatch(context.Background(), device, &tt.pushes[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, result.MessageID)
+				if result.ScheduleID != "" {
+					scheduleIDs = append(scheduleIDs, result.ScheduleID)
+				}
+			}
+			id := tt.recall(ids)
+
+			result, err := d.Dispatch(context.Background(), device, &model.PushRequest{Delete: true, ID: id})
+			if err != nil || result.Code != http.StatusOK {
+				t.Fatalf("Dispatch(delete) = %+v, %v", result, err)
+			}
+
+			if len(notifier.recalls) != 1 {
+				t.Fatalf("device received %d recalls, want 1", len(notifier.recalls))
+			}
+			r := notifier.recalls[0]
+			if len(r.Messages) != tt.wantRemoved {
+				t.Errorf("recall removed %d messages, want %d", len(r.Messages), tt.wantRemoved)
+			}
+			want := tt.wantNotifications
+			if want == nil {
+				want = []string{id}
+			}
+			if got := r.NotificationIDs(); !slices.Equal(got, want) {
+				t.Errorf("recalled notification IDs = %v, want %v", got, want)
+			}
+
+			left, err := store.GetUndeliveredMessages(device.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(ids) - len(scheduleIDs) - tt.wantRemoved; len(left) != want {
+				t.Errorf("%d messages left to replay, want %d", len(left), want)
+			}
+			for _, scheduleID := range scheduleIDs {
+				if status := scheduleStatus(t, store, scheduleID); (status == model.ScheduleStatusCancelled) != tt.wantCancelled {
+					t.Errorf("scheduled message is %s, want cancelled %v", status, tt.wantCancelled)
+				}
+			}
+		})
+	}
+}
+
+func TestRecallRequiresID(t *testing.T) {
+	d, _, notifier, device := newTestDispatcher(t)
+	result, err := d.Dispatch(context.Background(), device, &model.PushRequest{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != http.StatusBadRequest {
+		t.Errorf("Dispatch(delete without id) code = %d, want %d", result.Code, http.StatusBadRequest)
+	}
+	if len(notifier.recalls) != 0 {
+		t.Error("device was asked to recall without an id")
+	}
+}
+
+func TestDispatchCollapse(t *testing.T) {
+	d, store, notifier, device := newTestDispatcher(t)
+	other := createTestDevice(t, store, "other")
+
+	first, err := d.Dispatch(context.Background(), device, &model.PushRequest{Title: "t", Body: "v1", ID: "n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same notification ID on another device is a different notification
+	kept, err := d.Dispatch(context.Background(), other, &model.PushRequest{Title: "t", Body: "v1", ID: "n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Dispatch(context.Background(), device, &model.PushRequest{Title: "t", Body: "v2", ID: "n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := notifier.notified[len(notifier.notified)-1]
+	if !slices.Equal(n.Replaced, []string{first.MessageID}) {
+		t.Errorf("update replaced %v, want %v", n.Replaced, []string{first.MessageID})
+	}
+
+	for _, tt := range []struct {
+		device *model.Device
+		want   string
+	}{
+		{device, second.MessageID},
+		{other, kept.MessageID},
+	} {
+		messages, err := store.GetUndeliveredMessages(tt.device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := messageIDs(messages); !slices.Equal(ids, []string{tt.want}) {
+			t.Errorf("%s replays %v, want only %s", tt.device.DeviceKey, ids, tt.want)
+		}
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		push   model.PushRequest
+		linked model.PushRequest // the copy pushed separately to the linked device
+	}{
+		{"same content", model.PushRequest{Title: "t", Body: "b"}, model.PushRequest{Title: "t", Body: "b"}},
+		{"same notification ID", model.PushRequest{Title: "t", Body: "v1", ID: "n1"}, model.PushRequest{Title: "t", Body: "v2", ID: "n1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, store, notifier, device := newTestDispatcher(t)
+			tablet := createTestDevice(t, store, "tablet")
+			unlinked := createTestDevice(t, store, "unlinked")
+			for _, linked := range []*model.Device{device, tablet} {
+				if err := store.SetDeviceLink(linked.ID, "link"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			read, err := d.Dispatch(context.Background(), device, &tt.push)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := map[*model.Device][]string{}
+			for _, req := range []struct {
+				device *model.Device
+				req    model.PushRequest
+			}{
+				{tablet, tt.linked},
+				{tablet, model.PushRequest{Title: "t", Body: "unrelated"}},
+				{unlinked, tt.linked},
+			} {
+				result, err := d.Dispatch(context.Background(), req.device, &req.req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[req.device] = append(ids[req.device], result.MessageID)
+			}
+
+			found, err := d.MarkRead(context.Background(), device, read.MessageID)
+			if err != nil || !found {
+				t.Fatalf("MarkRead() = %v, %v", found, err)
+			}
+			if len(notifier.reads) != 1 || !slices.Equal(messageIDs(notifier.reads[0]), ids[tablet][:1]) {
+				t.Fatalf("read syncs = %v, want one for %v", notifier.reads, ids[tablet][:1])
+			}
+
+			// Read messages are no longer replayed, on the linked device only
+			for _, w := range []struct {
+				device *model.Device
+				want   []string
+			}{
+				{device, nil},
+				{tablet, ids[tablet][1:]},
+				{unlinked, ids[unlinked]},
+			} {
+				messages, err := store.GetUndeliveredMessages(w.device.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := messageIDs(messages); !slices.Equal(got, w.want) {
+					t.Errorf("%s replays %v, want %v", w.device.DeviceKey, got, w.want)
+				}
+			}
+
+			// Reading again does not sync again
+			if found, err := d.MarkRead(context.Background(), device, read.MessageID); err != nil || !found {
+				t.Fatalf("MarkRead(again) = %v, %v", found, err)
+			}
+			if len(notifier.reads) != 1 {
+				t.Errorf("read again synced %d times, want once", len(notifier.reads))
+			}
+		})
+	}
+}
+
+func TestMarkReadMissing(t *testing.T) {
+	d, _, notifier, device := newTestDispatcher(t)
+	found, err := d.MarkRead(context.Background(), device, "missing")
+	if err != nil || found {
+		t.Errorf("MarkRead(missing) = %v, %v, want false, nil", found, err)
+	}
+	if len(notifier.reads) != 0 {
+		t.Error("missing message was synced")
+	}
+}
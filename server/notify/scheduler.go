@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+const (
+	schedulerInterval  = time.Second
+	schedulerBatchSize = 100
+)
+
+// Scheduler delivers scheduled messages once they are due.
+// Pending messages live in storage, so they survive restarts.
+type Scheduler struct {
+	storage    storage.Storage
+	dispatcher *Dispatcher
+}
+
+// NewScheduler creates a new scheduler
+func NewScheduler(storage storage.Storage, dispatcher *Dispatcher) *Scheduler {
+	return &Scheduler{
+		storage:    storage,
+		dispatcher: dispatcher,
+	}
+}
+
+// Run starts the scheduler's main loop
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.deliverDue()
+	}
+}
+
+// deliverDue delivers all scheduled messages that are due
+func (s *Scheduler) deliverDue() {
+	due, err := s.storage.GetDueScheduledMessages(time.Now(), schedulerBatchSize)
+	if err != nil {
+		slog.Error("failed to get due scheduled messages", "error", err)
+		return
+	}
+
+	for _, sm := range due {
+		// Deliveries are logged under the schedule ID returned to the sender
+		ctx := logging.WithRequestID(context.Background(), sm.ScheduleID)
+		logger := logging.FromContext(ctx)
+
+		device, err := s.storage.GetDeviceByID(sm.DeviceID)
+		if err != nil || device == nil {
+			logger.Warn("scheduled message device not found", "device_id", sm.DeviceID)
+			s.fail(sm, "device not found")
+			continue
+		}
+
+		sm.Request.SendAt = ""
+		sm.Request.Delay = ""
+		// Storing the message marks it sent, so it is kept pending until then
+		// and delivered after a restart
+		result, err := s.dispatcher.deliver(ctx, device, sm.Request, sm.MessageID, sm.ScheduleID)
+		if errors.Is(err, storage.ErrScheduleNotPending) {
+			continue
+		}
+		recordDelivery(result)
+		if err != nil {
+			logger.Error("failed to store scheduled message", "error", err)
+			s.fail(sm, "failed to store message")
+			continue
+		}
+		if !result.OK() {
+			logger.Warn("scheduled delivery failed", "error", result.Error)
+			s.fail(sm, result.Error)
+		}
+	}
+}
+
+// fail marks a scheduled message as failed, whether or not its message was
+// stored
+func (s *Scheduler) fail(sm *model.ScheduledMessage, reason string) {
+	failed, _ := s.storage.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusPending, model.ScheduleStatusFailed)
+	if !failed {
+		failed, _ = s.storage.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusSent, model.ScheduleStatusFailed)
+	}
+	if !failed {
+		return
+	}
+	s.storage.AddMessageEvent(&model.MessageEvent{
+		MessageID: sm.MessageID,
+		DeviceID:  sm.DeviceID,
+		State:     model.MessageStateFailed,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+// scheduleTestMessage stores a push request for delivery at sendAt
+func scheduleTestMessage(t *testing.T, store storage.Storage, device *model.Device, id string, sendAt time.Time, req *model.PushRequest) *model.ScheduledMessage {
+	t.Helper()
+	sm := &model.ScheduledMessage{
+		ScheduleID: "schedule-" + id,
+		DeviceID:   device.ID,
+		MessageID:  id,
+		SendAt:     sendAt,
+		Request:    req,
+	}
+	if err := store.CreateScheduledMessage(sm); err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+// scheduleStatus returns the status of a scheduled message
+func scheduleStatus(t *testing.T, store storage.Storage, scheduleID string) string {
+	t.Helper()
+	sm, err := store.GetScheduledMessage(scheduleID)
+	if err != nil || sm == nil {
+		t.Fatalf("GetScheduledMessage(%s) = %v, %v", scheduleID, sm, err)
+	}
+	return sm.Status
+}
+
+func TestDeliverDue(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		sendAt     time.Time
+		req        model.PushRequest
+		cancel     bool
+		fail       string
+		wantSent   bool
+		wantStatus string
+	}{
+		{"due", past, model.PushRequest{Title: "t", Body: "due"}, false, "", true, model.ScheduleStatusSent},
+		{"not due", future, model.PushRequest{Title: "t", Body: "later"}, false, "", false, model.ScheduleStatusPending},
+		{"cancelled", past, model.PushRequest{Title: "t", Body: "cancelled"}, true, "", false, model.ScheduleStatusCancelled},
+		{"expired before its send time", past, model.PushRequest{Title: "t", Body: "stale", ExpiresAt: "1"}, false, "", false, model.ScheduleStatusFailed},
+		{"transport failure", past, model.PushRequest{Title: "t", Body: "fails"}, false, "unreachable", true, model.ScheduleStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, store, notifier, device := newTestDispatcher(t)
+			notifier.fail = tt.fail
+			sm := scheduleTestMessage(t, store, device, "m1", tt.sendAt, &tt.req)
+			if tt.cancel {
+				store.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusPending, model.ScheduleStatusCancelled)
+			}
+
+			NewScheduler(store, d).deliverDue()
+
+			if sent := len(notifier.notifiedIDs()) == 1; sent != tt.wantSent {
+				t.Errorf("notified = %v, want %v", notifier.notifiedIDs(), tt.wantSent)
+			}
+			if status := scheduleStatus(t, store, sm.ScheduleID); status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", status, tt.wantStatus)
+			}
+
+			// The message is stored exactly when the schedule is marked sent
+			_, stored, err := store.GetMessageDelivered(sm.MessageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantStored := tt.wantSent; stored != wantStored {
+				t.Errorf("message stored = %v, want %v", stored, wantStored)
+			}
+		})
+	}
+}
+
+func TestDeliverDueOnce(t *testing.T) {
+	d, store, notifier, device := newTestDispatcher(t)
+	scheduleTestMessage(t, store, device, "m1", time.Now().Add(-time.Second), &model.PushRequest{Title: "t", Body: "once"})
+
+	scheduler := NewScheduler(store, d)
+	scheduler.deliverDue()
+	scheduler.deliverDue()
+
+	if ids := notifier.notifiedIDs(); len(ids) != 1 || ids[0] != "m1" {
+		t.Errorf("notified %v, want m1 once", ids)
+	}
+}
+
+func TestDeliverDueAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abnotify.db")
+
+	before, err := storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := createTestDevice(t, before, "device")
+	scheduleTestMessage(t, before, device, "m1", time.Now().Add(-time.Second), &model.PushRequest{Title: "t", Body: "survives"})
+	before.Close()
+
+	store := openTestStorage(t, path)
+	notifier := &fakeNotifier{}
+	NewScheduler(store, NewDispatcher(store, notifier)).deliverDue()
+
+	if ids := notifier.notifiedIDs(); len(ids) != 1 || ids[0] != "m1" {
+		t.Errorf("notified %v after restart, want m1", ids)
+	}
+}
+
+func TestStoreClaimsScheduledMessage(t *testing.T) {
+	_, store, _, device := newTestDispatcher(t)
+	sm := scheduleTestMessage(t, store, device, "m1", time.Now(), &model.PushRequest{Title: "t", Body: "b"})
+	store.UpdateScheduledMessageStatus(sm.ScheduleID, model.ScheduleStatusPending, model.ScheduleStatusCancelled)
+
+	msg := &model.Message{DeviceID: device.ID, MessageID: "m1", Title: "t", Body: "b", ScheduleID: sm.ScheduleID}
+	if err := store.CreateMessage(msg); !errors.Is(err, storage.ErrScheduleNotPending) {
+		t.Fatalf("CreateMessage() error = %v, want ErrScheduleNotPending", err)
+	}
+	if _, stored, _ := store.GetMessageDelivered("m1"); stored {
+		t.Error("message of a cancelled schedule was stored")
+	}
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// DeviceSender sends WebSocket frames to connected devices
+type DeviceSender interface {
+	SendToDevice(ctx context.Context, deviceKey string, msg *model.WSMessage) bool
+	DropInflight(deviceKey string, messageIDs ...string)
+}
+
+// WebSocketNotifier delivers messages through the WebSocket hub.
+// It accepts every device, so it should be registered last as the fallback.
+type WebSocketNotifier struct {
+	hub DeviceSender
+}
+
+// NewWebSocketNotifier creates a new WebSocket notifier
+func NewWebSocketNotifier(hub DeviceSender) *WebSocketNotifier {
+	return &WebSocketNotifier{hub: hub}
+}
+
+// Name implements Notifier
+func (n *WebSocketNotifier) Name() string {
+	return model.TransportWebSocket
+}
+
+// Accepts implements Notifier
+func (n *WebSocketNotifier) Accepts(device *model.Device) bool {
+	return true
+}
+
+// Notify implements Notifier. Messages written to a connected client are
+// reported as sent, and the hub marks them delivered once the client acks;
+// offline devices receive the stored message on reconnect.
+func (n *WebSocketNotifier) Notify(ctx context.Context, device *model.Device, notification *Notification, result *model.DeliveryResult) {
+	wsMsg := notification.Message.ToWSMessage()
+	if req := notification.Request; req != nil {
+		data := wsMsg.Data.(map[string]interface{})
+		data["subtitle"] = req.Subtitle
+		data["image"] = req.Image
+		data["level"] = req.Level
+		data["call"] = req.Call
+		data["isArchive"] = req.IsArchive
+	}
+
+	// Older versions must not be redelivered over the new one
+	if len(notification.Replaced) > 0 {
+		n.hub.DropInflight(device.DeviceKey, notification.Replaced...)
+	}
+
+	if n.hub.SendToDevice(ctx, device.DeviceKey, wsMsg) {
+		result.Sent = true
+	} else {
+		result.Queued = true
+	}
+}
+
+// Recall implements Notifier. Recalls are not queued: messages still waiting
+// for an offline device were removed from storage and will not be replayed.
+func (n *WebSocketNotifier) Recall(ctx context.Context, device *model.Device, r *Recall, result *model.DeliveryResult) {
+	ids := messageIDs(r.Messages)
+	n.hub.DropInflight(device.DeviceKey, ids...)
+
+	wsMsg := &model.WSMessage{
+		Type:      model.WSTypeRecall,
+		ID:        r.ID,
+		Timestamp: time.Now().Unix(),
+		Data: map[string]interface{}{
+			"message_ids":      ids,
+			"notification_ids": r.NotificationIDs(),
+		},
+	}
+	result.Sent = n.hub.SendToDevice(ctx, device.DeviceKey, wsMsg)
+}
+
+// SyncRead implements Notifier. Like recalls, read syncs are not queued for
+// offline devices.
+func (n *WebSocketNotifier) SyncRead(ctx context.Context, device *model.Device, messages []*model.Message, result *model.DeliveryResult) {
+	ids := messageIDs(messages)
+	n.hub.DropInflight(device.DeviceKey, ids...)
+
+	wsMsg := &model.WSMessage{
+		Type:      model.WSTypeRead,
+		Timestamp: time.Now().Unix(),
+		Data: map[string]interface{}{
+			"message_ids":      ids,
+			"notification_ids": notificationIDs(messages),
+		},
+	}
+	result.Sent = n.hub.SendToDevice(ctx, device.DeviceKey, wsMsg)
+}
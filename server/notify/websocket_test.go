@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/abnotify/server/model"
+)
+
+// fakeHub is a DeviceSender with a fixed online state
+type fakeHub struct {
+	online  bool
+	sent    []*model.WSMessage
+	dropped []string
+}
+
+func (h *fakeHub) SendToDevice(ctx context.Context, deviceKey string, msg *model.WSMessage) bool {
+	if h.online {
+		h.sent = append(h.sent, msg)
+	}
+	return h.online
+}
+
+func (h *fakeHub) DropInflight(deviceKey string, messageIDs ...string) {
+	h.dropped = append(h.dropped, messageIDs...)
+}
+
+func TestWebSocketNotify(t *testing.T) {
+	tests := []struct {
+		name       string
+		online     bool
+		wantSent   bool
+		wantQueued bool
+	}{
+		{"online device", true, true, false},
+		{"offline device", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &fakeHub{online: tt.online}
+			device := &model.Device{DeviceKey: "device", DeviceType: "android"}
+			n := &Notification{Message: &model.Message{MessageID: "m1", Title: "t", Body: "b"}}
+			result := &model.DeliveryResult{}
+
+			NewWebSocketNotifier(hub).Notify(context.Background(), device, n, result)
+
+			// Only the client's ack marks a WebSocket message delivered
+			if result.Delivered {
+				t.Error("Notify() reported the message delivered before an ack")
+			}
+			if result.Sent != tt.wantSent || result.Queued != tt.wantQueued {
+				t.Errorf("Notify() sent = %v, queued = %v, want %v, %v", result.Sent, result.Queued, tt.wantSent, tt.wantQueued)
+			}
+			if got := deliveryOutcome(result); tt.wantSent && got != "sent" {
+				t.Errorf("deliveryOutcome() = %s, want sent", got)
+			}
+		})
+	}
+}
+
+func TestWebSocketNotifyReplaces(t *testing.T) {
+	hub := &fakeHub{online: true}
+	device := &model.Device{DeviceKey: "device", DeviceType: "android"}
+	n := &Notification{
+		Message:  &model.Message{MessageID: "m2", NotificationID: "n1", Title: "t", Body: "v2"},
+		Replaced: []string{"m1"},
+	}
+
+	NewWebSocketNotifier(hub).Notify(context.Background(), device, n, &model.DeliveryResult{})
+
+	// The older version must not be resent over the update
+	if !slices.Equal(hub.dropped, []string{"m1"}) {
+		t.Errorf("dropped in-flight %v, want [m1]", hub.dropped)
+	}
+	if len(hub.sent) != 1 {
+		t.Fatalf("sent %d frames, want 1", len(hub.sent))
+	}
+	if data := hub.sent[0].Data.(map[string]interface{}); data["notification_id"] != "n1" {
+		t.Errorf("frame notification_id = %v, want n1", data["notification_id"])
+	}
+}
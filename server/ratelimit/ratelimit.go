@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are dropped
+const sweepInterval = time.Minute
+
+// Limiter is a keyed token-bucket rate limiter.
+// A nil *Limiter allows everything.
+type Limiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing perMinute requests per key on average with
+// bursts of up to burst requests. It returns nil when perMinute is not positive.
+func New(perMinute, burst int) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil || key == "" {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, as they are
+// indistinguishable from new ones
+func (l *Limiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
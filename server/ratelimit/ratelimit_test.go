@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		wantNil   bool
+		wantBurst float64
+	}{
+		{"disabled", 0, 5, true, 0},
+		{"negative rate", -1, 5, true, 0},
+		{"burst", 60, 5, false, 5},
+		{"burst defaults to one", 60, 0, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.perMinute, tt.burst)
+			if (l == nil) != tt.wantNil {
+				t.Fatalf("New() = %v, want nil %v", l, tt.wantNil)
+			}
+			if l != nil && l.burst != tt.wantBurst {
+				t.Errorf("burst = %v, want %v", l.burst, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter *Limiter
+		key     string
+		calls   int
+		allowed int
+	}{
+		{"nil limiter allows everything", nil, "k", 10, 10},
+		{"empty key is not limited", New(60, 2), "", 10, 10},
+		{"burst then denied", New(60, 3), "k", 5, 3},
+		{"single burst", New(1, 1), "k", 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := 0
+			for i := 0; i < tt.calls; i++ {
+				if ok, _ := tt.limiter.Allow(tt.key); ok {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d of %d calls, want %d", allowed, tt.calls, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestAllowWait(t *testing.T) {
+	l := New(60, 1)
+	if ok, wait := l.Allow("k"); !ok || wait != 0 {
+		t.Fatalf("first Allow() = %v, %v, want true, 0", ok, wait)
+	}
+	ok, wait := l.Allow("k")
+	if ok {
+		t.Fatal("second Allow() allowed, want denied")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %v, want within (0, 1s]", wait)
+	}
+}
+
+func TestAllowKeysIndependent(t *testing.T) {
+	l := New(60, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("Allow(a) denied")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("second Allow(a) allowed")
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("Allow(b) denied by the bucket of a")
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l := New(60, 2)
+	l.Allow("k")
+	l.Allow("k")
+	if ok, _ := l.Allow("k"); ok {
+		t.Fatal("Allow() allowed with an empty bucket")
+	}
+
+	// One token refills per second
+	l.buckets["k"].last = time.Now().Add(-1500 * time.Millisecond)
+	if ok, _ := l.Allow("k"); !ok {
+		t.Error("Allow() denied after a token refilled")
+	}
+	if ok, _ := l.Allow("k"); ok {
+		t.Error("Allow() allowed more than the refilled tokens")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New(60, 2)
+	l.Allow("idle")
+	l.Allow("busy")
+
+	now := time.Now()
+	l.buckets["idle"].last = now.Add(-time.Minute)
+	l.sweep(now)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket was not swept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("partially used bucket was swept")
+	}
+}
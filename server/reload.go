@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abnotify/server/apns"
+	"github.com/abnotify/server/config"
+	"github.com/abnotify/server/handler"
+	"github.com/abnotify/server/logging"
+	"github.com/abnotify/server/notify"
+	"github.com/abnotify/server/ratelimit"
+	"github.com/abnotify/server/retention"
+)
+
+// settings applies configuration changes on SIGHUP to the running server.
+// Listener and database settings only take effect on restart; everything
+// else is applied in place, so WebSocket clients stay connected.
+type settings struct {
+	path string // config file, empty when configured by environment only
+
+	hub         *handler.Hub
+	dispatcher  *notify.Dispatcher
+	apns        *notify.APNsNotifier
+	retention   *retention.Worker
+	limiter     *handler.RateLimiter
+	subscribers *handler.SubscriberAuth
+	ws          *handler.WSHandler
+	owners      *handler.OwnershipGuard
+	rotate      *handler.RotateHandler
+
+	mu  sync.RWMutex
+	cfg *config.Config
+}
+
+// current returns the configuration in effect
+func (s *settings) current() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// adminToken returns the admin API token in effect
+func (s *settings) adminToken() string {
+	return s.current().AdminToken
+}
+
+// metricsToken returns the metrics token in effect
+func (s *settings) metricsToken() string {
+	return s.current().MetricsToken
+}
+
+// reload loads the configuration again and applies it. An invalid
+// configuration is reported and the current one kept.
+func (s *settings) reload() {
+	cfg, err := config.Load(s.path)
+	if err != nil {
+		slog.Error("configuration reload failed, keeping current settings", "error", err)
+		return
+	}
+
+	old := s.current()
+	if changed := old.RestartRequired(cfg); len(changed) > 0 {
+		slog.Warn("configuration changes require a restart", "settings", changed)
+		cfg.Host, cfg.Port = old.Host, old.Port
+		cfg.EnableHTTPS, cfg.CertFile, cfg.KeyFile = old.EnableHTTPS, old.CertFile, old.KeyFile
+		cfg.TrustedProxies = old.TrustedProxies
+		cfg.DBDriver, cfg.DBPath, cfg.DatabaseURL = old.DBDriver, old.DBPath, old.DatabaseURL
+	}
+
+	if err := setupLogging(cfg); err != nil {
+		slog.Error("configuration reload failed, keeping current settings", "error", err)
+		return
+	}
+	if cfg.APNSKeyID != old.APNSKeyID || cfg.APNSTeamID != old.APNSTeamID ||
+		cfg.APNSPrivateKey != old.APNSPrivateKey || cfg.APNSProduction != old.APNSProduction {
+		s.apns.SetClient(newAPNsClient(cfg))
+	}
+
+	s.hub.SetTimeouts(time.Duration(cfg.WSPingInterval)*time.Second, time.Duration(cfg.WSPongTimeout)*time.Second)
+	s.dispatcher.SetDefaultTTL(time.Duration(cfg.MessageTTL) * time.Second)
+	s.dispatcher.SetDedupe(time.Duration(cfg.IdempotencyWindow)*time.Second, time.Duration(cfg.DedupeWindow)*time.Second)
+	s.retention.SetPolicy(retentionPolicy(cfg))
+	s.limiter.SetLimiters(rateLimiters(cfg))
+	s.subscribers.SetRequireSecret(cfg.RequireSubscribeSecret)
+	s.ws.SetRequireAuth(cfg.RequireWSAuth)
+	s.owners.SetQuarantine(cfg.QuarantineRegistrations)
+	s.rotate.SetMaxGrace(time.Duration(cfg.KeyRotationMaxGrace) * time.Second)
+
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	slog.Info("configuration reloaded")
+}
+
+// setupLogging configures the default logger from cfg
+func setupLogging(cfg *config.Config) error {
+	err := logging.Setup(os.Stderr, logging.Options{
+		Level:     cfg.LogLevel,
+		Format:    cfg.LogFormat,
+		Sensitive: cfg.LogSensitive,
+	})
+	if err == nil && cfg.LogSensitive {
+		slog.Warn("sensitive logging is on, message content and device keys are logged")
+	}
+	return err
+}
+
+// newAPNsClient creates the APNs client, or returns nil when APNs is not
+// configured or the credentials are invalid
+func newAPNsClient(cfg *config.Config) *apns.Client {
+	if !cfg.APNSEnabled() {
+		slog.Info("APNs not configured, iOS push disabled")
+		return nil
+	}
+	client, err := apns.NewClient(cfg.APNSKeyID, cfg.APNSTeamID, cfg.APNSPrivateKey, cfg.APNSProduction)
+	if err != nil {
+		slog.Warn("failed to initialize APNs client", "error", err)
+		return nil
+	}
+	slog.Info("APNs client initialized", "production", cfg.APNSProduction)
+	return client
+}
+
+// retentionPolicy returns the retention policy configured by cfg
+func retentionPolicy(cfg *config.Config) retention.Policy {
+	groupMaxAge := make(map[string]time.Duration, len(cfg.RetentionGroupMaxAge))
+	for group, age := range cfg.RetentionGroupMaxAge {
+		groupMaxAge[group] = time.Duration(age) * time.Second
+	}
+	return retention.Policy{
+		MaxAge:          time.Duration(cfg.RetentionMaxAge) * time.Second,
+		MaxMessages:     cfg.RetentionMaxMessages,
+		GroupMaxAge:     groupMaxAge,
+		KeepUndelivered: cfg.RetentionKeepUndelivered,
+		Interval:        time.Duration(cfg.RetentionInterval) * time.Second,
+		VacuumInterval:  time.Duration(cfg.VacuumInterval) * time.Second,
+		AuditMaxAge:     time.Duration(cfg.RetentionAuditMaxAge) * time.Second,
+	}
+}
+
+// rateLimiters returns the IP, device and token limiters configured by cfg
+func rateLimiters(cfg *config.Config) (ip, device, token *ratelimit.Limiter) {
+	return ratelimit.New(cfg.RateLimitIP, cfg.RateLimitIPBurst),
+		ratelimit.New(cfg.RateLimitDevice, cfg.RateLimitDeviceBurst),
+		ratelimit.New(cfg.RateLimitToken, cfg.RateLimitTokenBurst)
+}
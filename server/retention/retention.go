@@ -0,0 +1,210 @@
+package retention
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abnotify/server/model"
+	"github.com/abnotify/server/storage"
+)
+
+// Policy configures what the worker removes
+type Policy struct {
+	MaxAge          time.Duration            // delete messages older than this (0 = keep forever)
+	MaxMessages     int                      // keep only the newest N messages per device (0 = unlimited)
+	GroupMaxAge     map[string]time.Duration // per-group max age overrides (0 = keep forever)
+	KeepUndelivered bool                     // never delete messages not yet delivered
+	Interval        time.Duration            // time between runs
+	VacuumInterval  time.Duration            // time between VACUUM runs (0 = never)
+	AuditMaxAge     time.Duration            // delete resolved registration attempts older than this (0 = keep forever)
+}
+
+// Worker periodically removes old messages and compacts the database
+type Worker struct {
+	storage storage.Storage
+	reset   chan struct{} // signals Run that the interval changed
+
+	mu           sync.Mutex // serializes runs and guards the fields below
+	policy       Policy
+	last         *model.RetentionReport
+	lastVacuum   time.Time  // start of the current vacuum interval
+	vacuumedAt   *time.Time // last successful VACUUM
+	totalRemoved int64
+}
+
+// NewWorker creates a new retention worker
+func NewWorker(storage storage.Storage, policy Policy) *Worker {
+	if policy.Interval <= 0 {
+		policy.Interval = time.Hour
+	}
+	return &Worker{
+		storage: storage,
+		reset:   make(chan struct{}, 1),
+		policy:  policy,
+		// Do not vacuum right after startup
+		lastVacuum: time.Now(),
+	}
+}
+
+// Run starts the worker's main loop
+func (w *Worker) Run() {
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.RunOnce()
+		case <-w.reset:
+			ticker.Reset(w.interval())
+		}
+	}
+}
+
+// SetPolicy replaces the policy. It takes effect from the next run.
+func (w *Worker) SetPolicy(policy Policy) {
+	if policy.Interval <= 0 {
+		policy.Interval = time.Hour
+	}
+
+	w.mu.Lock()
+	changed := policy.Interval != w.policy.Interval
+	w.policy = policy
+	w.mu.Unlock()
+
+	if changed {
+		select {
+		case w.reset <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// interval returns the time between runs
+func (w *Worker) interval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.policy.Interval
+}
+
+// RunOnce applies the policy immediately and returns its report
+func (w *Worker) RunOnce() *model.RetentionReport {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := w.policy
+	report := &model.RetentionReport{StartedAt: time.Now()}
+	fail := func(step string, err error) {
+		slog.Error("retention step failed", "step", step, "error", err)
+		if report.Error == "" {
+			report.Error = step + ": " + err.Error()
+		}
+	}
+
+	groups := make([]string, 0, len(p.GroupMaxAge))
+	for group := range p.GroupMaxAge {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	if p.MaxAge > 0 {
+		n, err := w.storage.DeleteOldMessages(p.MaxAge, p.KeepUndelivered, groups...)
+		report.Expired = n
+		if err != nil {
+			fail("expire", err)
+		}
+	}
+	for _, group := range groups {
+		if p.GroupMaxAge[group] <= 0 {
+			continue
+		}
+		n, err := w.storage.DeleteOldGroupMessages(group, p.GroupMaxAge[group], p.KeepUndelivered)
+		if n > 0 {
+			if report.GroupExpired == nil {
+				report.GroupExpired = map[string]int64{}
+			}
+			report.GroupExpired[group] = n
+		}
+		if err != nil {
+			fail("expire group "+group, err)
+		}
+	}
+	if p.MaxMessages > 0 {
+		n, err := w.storage.TrimDeviceMessages(p.MaxMessages, p.KeepUndelivered)
+		report.Trimmed = n
+		if err != nil {
+			fail("trim", err)
+		}
+	}
+	if p.MaxAge > 0 {
+		n, err := w.storage.DeleteOldMessageEvents(p.MaxAge)
+		report.Events = n
+		if err != nil {
+			fail("events", err)
+		}
+	}
+
+	if p.AuditMaxAge > 0 {
+		n, err := w.storage.DeleteOldRegistrationAttempts(p.AuditMaxAge)
+		report.RegistrationAttempts = n
+		if err != nil {
+			fail("registration attempts", err)
+		}
+	}
+
+	if _, err := w.storage.DeleteExpiredDedupeKeys(); err != nil {
+		fail("dedupe keys", err)
+	}
+
+	if err := w.storage.Optimize(); err != nil {
+		fail("optimize", err)
+	}
+	if p.VacuumInterval > 0 && time.Since(w.lastVacuum) >= p.VacuumInterval {
+		if err := w.storage.Vacuum(); err != nil {
+			fail("vacuum", err)
+		} else {
+			now := time.Now()
+			w.lastVacuum = now
+			w.vacuumedAt = &now
+			report.Vacuumed = true
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	w.last = report
+	w.totalRemoved += report.Removed()
+
+	if report.Removed() > 0 || report.Events > 0 || report.Vacuumed {
+		slog.Info("retention run finished",
+			"removed", report.Removed(), "expired", report.Expired, "group_expired", report.GroupExpired,
+			"trimmed", report.Trimmed, "events", report.Events, "vacuumed", report.Vacuumed,
+			"duration", report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond))
+	}
+	return report
+}
+
+// Status returns the policy and the results of past runs
+func (w *Worker) Status() *model.RetentionStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := &model.RetentionStatus{
+		MaxAge:          int64(w.policy.MaxAge.Seconds()),
+		MaxMessages:     w.policy.MaxMessages,
+		KeepUndelivered: w.policy.KeepUndelivered,
+		Interval:        int64(w.policy.Interval.Seconds()),
+		AuditMaxAge:     int64(w.policy.AuditMaxAge.Seconds()),
+		LastRun:         w.last,
+		LastVacuum:      w.vacuumedAt,
+		TotalRemoved:    w.totalRemoved,
+	}
+	if len(w.policy.GroupMaxAge) > 0 {
+		status.GroupMaxAge = map[string]int64{}
+		for group, age := range w.policy.GroupMaxAge {
+			status.GroupMaxAge[group] = int64(age.Seconds())
+		}
+	}
+	return status
+}
@@ -0,0 +1,70 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/storage"
+)
+
+// fakeStorage records the retention calls made by the worker
+type fakeStorage struct {
+	storage.Storage
+	messageMaxAge time.Duration
+	auditMaxAge   time.Duration
+}
+
+func (f *fakeStorage) DeleteOldMessages(olderThan time.Duration, keepUndelivered bool, excludeGroups ...string) (int64, error) {
+	f.messageMaxAge = olderThan
+	return 0, nil
+}
+
+func (f *fakeStorage) DeleteOldGroupMessages(group string, olderThan time.Duration, keepUndelivered bool) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeStorage) TrimDeviceMessages(maxMessages int, keepUndelivered bool) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeStorage) DeleteOldMessageEvents(olderThan time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeStorage) DeleteOldRegistrationAttempts(olderThan time.Duration) (int64, error) {
+	f.auditMaxAge = olderThan
+	return 2, nil
+}
+
+func (f *fakeStorage) DeleteExpiredDedupeKeys() (int64, error) { return 0, nil }
+func (f *fakeStorage) Optimize() error                         { return nil }
+func (f *fakeStorage) Vacuum() error                           { return nil }
+
+func TestRunOnceAuditRetention(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      Policy
+		wantAudit   time.Duration
+		wantCounted int64
+	}{
+		{"message retention leaves the audit log", Policy{MaxAge: time.Hour}, 0, 0},
+		{"audit retention", Policy{AuditMaxAge: 90 * 24 * time.Hour}, 90 * 24 * time.Hour, 2},
+		{"both", Policy{MaxAge: time.Hour, AuditMaxAge: 24 * time.Hour}, 24 * time.Hour, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStorage{}
+			report := NewWorker(store, tt.policy).RunOnce()
+
+			if store.messageMaxAge != tt.policy.MaxAge {
+				t.Errorf("messages pruned after %v, want %v", store.messageMaxAge, tt.policy.MaxAge)
+			}
+			if store.auditMaxAge != tt.wantAudit {
+				t.Errorf("registration attempts pruned after %v, want %v", store.auditMaxAge, tt.wantAudit)
+			}
+			if report.RegistrationAttempts != tt.wantCounted {
+				t.Errorf("report counts %d registration attempts, want %d", report.RegistrationAttempts, tt.wantCounted)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Deduplication operations
+
+// DuplicateError is returned when a message repeats an earlier push to the
+// same device within the dedupe window
+type DuplicateError struct {
+	MessageID  string // the original message
+	ScheduleID string // set when the original was scheduled
+}
+
+func (e *DuplicateError) Error() string {
+	return "duplicate of message " + e.MessageID
+}
+
+// claimDedupeKeys records the keys for a message within a transaction. It
+// returns a *DuplicateError when a key is already held by another message.
+// A key held by the same message ID is renewed, so scheduled messages keep
+// their keys when they are delivered.
+func claimDedupeKeys(tx *dbTx, deviceID int64, messageID, scheduleID string, keys []model.DedupeKey) error {
+	// Store UTC so expires_at compares correctly as text
+	now := time.Now().UTC()
+	for _, key := range keys {
+		dup := &DuplicateError{}
+		err := tx.QueryRow(
+			`SELECT message_id, COALESCE(schedule_id, '') FROM dedupe_keys
+			 WHERE device_id = ? AND dedupe_key = ? AND expires_at > ?`,
+			deviceID, key.Key, now,
+		).Scan(&dup.MessageID, &dup.ScheduleID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if dup.MessageID != messageID {
+			return dup
+		}
+	}
+
+	for _, key := range keys {
+		_, err := tx.Exec(
+			`INSERT INTO dedupe_keys (device_id, dedupe_key, message_id, schedule_id, created_at, expires_at)
+			 VALUES (?, ?, ?, NULLIF(?, ''), ?, ?)
+			 ON CONFLICT (device_id, dedupe_key) DO UPDATE SET
+			   schedule_id = CASE WHEN dedupe_keys.message_id = excluded.message_id
+			     THEN COALESCE(excluded.schedule_id, dedupe_keys.schedule_id) ELSE excluded.schedule_id END,
+			   message_id = excluded.message_id,
+			   created_at = excluded.created_at,
+			   expires_at = excluded.expires_at`,
+			deviceID, key.Key, messageID, scheduleID, now, now.Add(key.Window),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredDedupeKeys deletes dedupe keys whose window has passed
+func (s *SQLStorage) DeleteExpiredDedupeKeys() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM dedupe_keys WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
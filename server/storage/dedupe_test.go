@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+func TestClaimDedupeKeys(t *testing.T) {
+	s, _ := openTestStorage(t)
+
+	key := func(k string) model.DedupeKey { return model.DedupeKey{Key: k, Window: time.Minute} }
+	expired := model.DedupeKey{Key: "expired", Window: -time.Second}
+
+	// Steps run in order against the same database
+	steps := []struct {
+		name         string
+		deviceID     int64
+		messageID    string
+		scheduleID   string
+		keys         []model.DedupeKey
+		wantDup      string // original message ID, "" for no duplicate
+		wantSchedule string
+	}{
+		{"first claim", 1, "m1", "", []model.DedupeKey{key("a")}, "", ""},
+		{"repeat on the same device", 1, "m2", "", []model.DedupeKey{key("a")}, "m1", ""},
+		{"same key on another device", 2, "m2", "", []model.DedupeKey{key("a")}, "", ""},
+		{"same message renews its key", 1, "m1", "", []model.DedupeKey{key("a")}, "", ""},
+		{"any held key is a duplicate", 1, "m3", "", []model.DedupeKey{key("b"), key("a")}, "m1", ""},
+		{"keys of a duplicate are not claimed", 1, "m4", "", []model.DedupeKey{key("b")}, "", ""},
+		{"scheduled claim", 1, "m5", "s1", []model.DedupeKey{key("c")}, "", ""},
+		{"repeat of a scheduled message", 1, "m6", "", []model.DedupeKey{key("c")}, "m5", "s1"},
+		{"delivered scheduled message keeps its key", 1, "m5", "", []model.DedupeKey{key("c")}, "", ""},
+		{"repeat after delivery", 1, "m7", "", []model.DedupeKey{key("c")}, "m5", "s1"},
+		{"claim with a passed window", 1, "m8", "", []model.DedupeKey{expired}, "", ""},
+		{"expired key is free", 1, "m9", "", []model.DedupeKey{key("expired")}, "", ""},
+	}
+	for _, step := range steps {
+		tx, err := s.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = claimDedupeKeys(tx, step.deviceID, step.messageID, step.scheduleID, step.keys)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		var dup *DuplicateError
+		switch {
+		case step.wantDup == "" && err != nil:
+			t.Errorf("%s: claimDedupeKeys() error = %v, want nil", step.name, err)
+		case step.wantDup != "" && !errors.As(err, &dup):
+			t.Errorf("%s: claimDedupeKeys() error = %v, want a duplicate of %s", step.name, err, step.wantDup)
+		case dup != nil && (dup.MessageID != step.wantDup || dup.ScheduleID != step.wantSchedule):
+			t.Errorf("%s: duplicate of %q (schedule %q), want %q (schedule %q)",
+				step.name, dup.MessageID, dup.ScheduleID, step.wantDup, step.wantSchedule)
+		}
+	}
+}
+
+func TestCreateMessageDuplicate(t *testing.T) {
+	s, _ := openTestStorage(t)
+
+	device := &model.Device{DeviceKey: "device", DeviceType: "android"}
+	if err := s.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	dedupe := []model.DedupeKey{{Key: "same", Window: time.Minute}}
+
+	first := &model.Message{DeviceID: device.ID, MessageID: "first", Title: "t", Body: "b", Dedupe: dedupe}
+	if err := s.CreateMessage(first); err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+
+	repeat := &model.Message{DeviceID: device.ID, MessageID: "repeat", Title: "t", Body: "b", Dedupe: dedupe}
+	var dup *DuplicateError
+	if err := s.CreateMessage(repeat); !errors.As(err, &dup) || dup.MessageID != "first" {
+		t.Fatalf("CreateMessage() error = %v, want a duplicate of first", err)
+	}
+
+	history, err := s.GetMessageHistory(device.ID, &model.HistoryFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("stored %d messages, want only the first", len(history))
+	}
+}
+
+func TestDeleteExpiredDedupeKeys(t *testing.T) {
+	s, _ := openTestStorage(t)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []model.DedupeKey{
+		{Key: "passed", Window: -time.Second},
+		{Key: "live", Window: time.Minute},
+	}
+	if err := claimDedupeKeys(tx, 1, "m1", "", keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.DeleteExpiredDedupeKeys()
+	if err != nil {
+		t.Fatalf("DeleteExpiredDedupeKeys() error = %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("DeleteExpiredDedupeKeys() = %d, want 1", deleted)
+	}
+
+	var left int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM dedupe_keys WHERE dedupe_key = 'live'`).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Error("live dedupe key was deleted")
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Device management operations
+
+const deviceStatsSelect = `SELECT d.id, d.device_key, d.device_type, COALESCE(d.name, ''), d.created_at, d.last_seen,
+	COUNT(m.id),
+	COALESCE(SUM(CASE WHEN m.id IS NOT NULL AND m.delivered = FALSE THEN 1 ELSE 0 END), 0),
+	COALESCE(SUM(CASE WHEN m.id IS NOT NULL AND m.read_at IS NULL THEN 1 ELSE 0 END), 0)
+	FROM devices d LEFT JOIN messages m ON m.device_id = d.id`
+
+// ListDeviceStats returns devices with their message counts, most recently
+// seen first. An empty deviceType lists all devices.
+func (s *SQLStorage) ListDeviceStats(deviceType string, limit, offset int) ([]*model.DeviceStats, error) {
+	rows, err := s.db.Query(
+		deviceStatsSelect+` WHERE (? = '' OR d.device_type = ?)
+		 GROUP BY d.id ORDER BY d.last_seen DESC, d.id DESC LIMIT ? OFFSET ?`,
+		deviceType, deviceType, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeviceStats(rows)
+}
+
+// GetDeviceStats returns a device with its message counts, or nil
+func (s *SQLStorage) GetDeviceStats(id int64) (*model.DeviceStats, error) {
+	rows, err := s.db.Query(deviceStatsSelect+` WHERE d.id = ? GROUP BY d.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := scanDeviceStats(rows)
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+	return devices[0], nil
+}
+
+// RenameDevice sets the display name of a device.
+// It reports whether the device exists.
+func (s *SQLStorage) RenameDevice(id int64, name string) (bool, error) {
+	result, err := s.db.Exec(`UPDATE devices SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteDevice deletes a device with its messages, scheduled messages and group
+// memberships. It returns the number of messages deleted. Retired keys stay
+// retired, so they are never handed out again, and registration attempts are
+// kept for audit.
+func (s *SQLStorage) DeleteDevice(id int64) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM messages WHERE device_id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	queries := []string{
+		`DELETE FROM message_events WHERE device_id = ?`,
+		`DELETE FROM scheduled_messages WHERE device_id = ?`,
+		`DELETE FROM dedupe_keys WHERE device_id = ?`,
+		`DELETE FROM device_group_members WHERE device_id = ?`,
+		`DELETE FROM devices WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, id); err != nil {
+			return 0, err
+		}
+	}
+
+	// Keys still in their grace period have no device to resolve to anymore
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		`UPDATE device_key_aliases SET expires_at = ? WHERE device_id = ? AND expires_at > ?`,
+		now, id, now,
+	); err != nil {
+		return 0, err
+	}
+
+	return messages, tx.Commit()
+}
+
+func scanDeviceStats(rows *sql.Rows) ([]*model.DeviceStats, error) {
+	defer rows.Close()
+
+	devices := []*model.DeviceStats{}
+	for rows.Next() {
+		d := &model.DeviceStats{}
+		err := rows.Scan(&d.ID, &d.DeviceKey, &d.DeviceType, &d.Name, &d.CreatedAt, &d.LastSeen,
+			&d.Messages, &d.Undelivered, &d.Unread)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+func TestDeleteDeviceKeepsRetiredKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+	}{
+		{"retired key", 0},
+		{"key in its grace period", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := openTestStorage(t)
+			device := &model.Device{DeviceKey: "old-key", DeviceType: "android"}
+			if err := s.CreateDevice(device); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RotateDeviceKey(device.ID, "old-key", "new-key", time.Now().Add(tt.grace)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.DeleteDevice(device.ID); err != nil {
+				t.Fatalf("DeleteDevice() error = %v", err)
+			}
+
+			if _, err := s.GetDeviceByKey("old-key"); !errors.Is(err, ErrDeviceKeyRetired) {
+				t.Errorf("GetDeviceByKey(old key) error = %v, want ErrDeviceKeyRetired", err)
+			}
+			if device, err := s.GetDeviceByKey("new-key"); device != nil || err != nil {
+				t.Errorf("GetDeviceByKey(deleted key) = %v, %v, want nil, nil", device, err)
+			}
+
+			other := &model.Device{DeviceKey: "other", DeviceType: "android"}
+			if err := s.CreateDevice(other); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RotateDeviceKey(other.ID, "other", "old-key", time.Now()); !errors.Is(err, ErrDeviceKeyInUse) {
+				t.Errorf("RotateDeviceKey(to a retired key) error = %v, want ErrDeviceKeyInUse", err)
+			}
+		})
+	}
+}
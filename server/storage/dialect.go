@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// dialect is the SQL flavour of the database. Queries are written with ?
+// placeholders in the subset of SQL that SQLite and PostgreSQL share, and
+// rewritten where the two differ.
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+// rebind rewrites ? placeholders to PostgreSQL's $1, $2, ...
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// like returns the case-insensitive LIKE operator, which SQLite's LIKE
+// already is for ASCII
+func (d dialect) like() string {
+	if d == dialectPostgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// queryer is implemented by *timedDB and *dbTx
+type queryer interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertID runs an INSERT into a table with an id primary key and returns
+// the id of the new row. PostgreSQL does not report it on the result.
+func insertID(q queryer, d dialect, query string, args ...interface{}) (int64, error) {
+	if d == dialectPostgres {
+		var id int64
+		err := q.QueryRow(query+` RETURNING id`, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := q.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// dbTx is a transaction running queries in the database's dialect
+type dbTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx *dbTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+// Insert runs an INSERT and returns the id of the new row
+func (tx *dbTx) Insert(query string, args ...interface{}) (int64, error) {
+	return insertID(tx, tx.dialect, query, args...)
+}
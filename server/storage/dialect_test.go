@@ -0,0 +1,34 @@
+package storage
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect
+		query   string
+		want    string
+	}{
+		{"sqlite keeps placeholders", dialectSQLite, `SELECT id FROM devices WHERE device_key = ?`, `SELECT id FROM devices WHERE device_key = ?`},
+		{"no placeholders", dialectPostgres, `SELECT COUNT(*) FROM devices`, `SELECT COUNT(*) FROM devices`},
+		{"numbered in order", dialectPostgres,
+			`UPDATE devices SET device_key = ? WHERE id = ? AND device_key = ?`,
+			`UPDATE devices SET device_key = $1 WHERE id = $2 AND device_key = $3`},
+		{"question mark in a literal", dialectPostgres,
+			`SELECT id FROM messages WHERE title = '?' AND body = ?`,
+			`SELECT id FROM messages WHERE title = '?' AND body = $1`},
+		{"escaped quote in a literal", dialectPostgres,
+			`SELECT id FROM messages WHERE title = 'it''s ?' AND body = ? AND url LIKE '%?%'`,
+			`SELECT id FROM messages WHERE title = 'it''s ?' AND body = $1 AND url LIKE '%?%'`},
+		{"more than nine", dialectPostgres,
+			`VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			`VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.rebind(tt.query); got != tt.want {
+				t.Errorf("rebind() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Message event operations
+
+// execer is implemented by *timedDB and *dbTx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// AddMessageEvent records a lifecycle event for a message
+func (s *SQLStorage) AddMessageEvent(event *model.MessageEvent) error {
+	return addMessageEvent(s.db, event)
+}
+
+// addMessageEvent records a lifecycle event using the given executor
+func addMessageEvent(db execer, event *model.MessageEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	_, err := db.Exec(
+		`INSERT INTO message_events (message_id, device_id, state, reason, apns_id, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		event.MessageID, event.DeviceID, event.State, event.Reason, event.ApnsID, event.CreatedAt,
+	)
+	return err
+}
+
+// GetMessageEvents retrieves the lifecycle events of a message in order
+func (s *SQLStorage) GetMessageEvents(messageID string) ([]*model.MessageEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT message_id, device_id, state, COALESCE(reason, ''), COALESCE(apns_id, ''), created_at 
+		 FROM message_events WHERE message_id = ? 
+		 ORDER BY id ASC`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*model.MessageEvent
+	for rows.Next() {
+		e := &model.MessageEvent{}
+		if err := rows.Scan(&e.MessageID, &e.DeviceID, &e.State, &e.Reason, &e.ApnsID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GetMessageDelivered reports whether a stored message is delivered.
+// found is false if the message row no longer exists.
+func (s *SQLStorage) GetMessageDelivered(messageID string) (delivered bool, found bool, err error) {
+	err = s.db.QueryRow(`SELECT delivered FROM messages WHERE message_id = ?`, messageID).Scan(&delivered)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return delivered, true, nil
+}
+
+// GetGroupTokensForMessage returns the tokens of groups whose pushes produced the message
+func (s *SQLStorage) GetGroupTokensForMessage(messageID string) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT g.token 
+		 FROM group_push_results r 
+		 JOIN group_pushes p ON p.push_id = r.push_id 
+		 JOIN device_groups g ON g.id = p.group_id 
+		 WHERE r.message_id = ?`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
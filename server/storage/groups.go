@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Group operations
+
+// CreateGroup creates a new device group
+func (s *SQLStorage) CreateGroup(group *model.DeviceGroup) error {
+	group.CreatedAt = time.Now()
+	id, err := s.db.Insert(
+		`INSERT INTO device_groups (name, token, created_at) VALUES (?, ?, ?)`,
+		group.Name, group.Token, group.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	group.ID = id
+	return nil
+}
+
+// GetGroupByName retrieves a group and its member device keys
+func (s *SQLStorage) GetGroupByName(name string) (*model.DeviceGroup, error) {
+	group := &model.DeviceGroup{}
+	err := s.db.QueryRow(
+		`SELECT id, name, token, created_at FROM device_groups WHERE name = ?`,
+		name,
+	).Scan(&group.ID, &group.Name, &group.Token, &group.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.GetGroupMembers(group.ID)
+	if err != nil {
+		return nil, err
+	}
+	group.Members = members
+	return group, nil
+}
+
+// GetGroupMembers returns the device keys of all group members
+func (s *SQLStorage) GetGroupMembers(groupID int64) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT d.device_key 
+		 FROM device_group_members m 
+		 JOIN devices d ON d.id = m.device_id 
+		 WHERE m.group_id = ? 
+		 ORDER BY m.created_at ASC`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		members = append(members, key)
+	}
+	return members, rows.Err()
+}
+
+// AddGroupMember adds a device to a group, ignoring existing memberships
+func (s *SQLStorage) AddGroupMember(groupID, deviceID int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO device_group_members (group_id, device_id, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT (group_id, device_id) DO NOTHING`,
+		groupID, deviceID, time.Now(),
+	)
+	return err
+}
+
+// RemoveGroupMember removes a device from a group
+func (s *SQLStorage) RemoveGroupMember(groupID, deviceID int64) (bool, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM device_group_members WHERE group_id = ? AND device_id = ?`,
+		groupID, deviceID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteGroup deletes a group with its memberships and push results
+func (s *SQLStorage) DeleteGroup(groupID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM group_push_results WHERE push_id IN (SELECT push_id FROM group_pushes WHERE group_id = ?)`,
+		`DELETE FROM group_pushes WHERE group_id = ?`,
+		`DELETE FROM device_group_members WHERE group_id = ?`,
+		`DELETE FROM device_groups WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, groupID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveGroupPush stores a group push and its per-member results
+func (s *SQLStorage) SaveGroupPush(groupID int64, push *model.GroupPush) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO group_pushes (push_id, group_id, created_at) VALUES (?, ?, ?)`,
+		push.PushID, groupID, push.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	for _, r := range push.Results {
+		if _, err := tx.Exec(
+			`INSERT INTO group_push_results (push_id, device_key, message_id, transport, delivered, sent, queued, code, error) 
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			push.PushID, r.DeviceKey, r.MessageID, r.Transport, r.Delivered, r.Sent, r.Queued, r.Code, r.Error,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetGroupPush retrieves a group push with its per-member results
+func (s *SQLStorage) GetGroupPush(groupID int64, pushID string) (*model.GroupPush, error) {
+	push := &model.GroupPush{PushID: pushID}
+	err := s.db.QueryRow(
+		`SELECT p.created_at, g.name 
+		 FROM group_pushes p JOIN device_groups g ON g.id = p.group_id 
+		 WHERE p.push_id = ? AND p.group_id = ?`,
+		pushID, groupID,
+	).Scan(&push.CreatedAt, &push.Group)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Sent and queued messages may have been delivered since, so fold in the message state
+	rows, err := s.db.Query(
+		`SELECT r.device_key, r.message_id, r.transport, 
+		        r.delivered OR COALESCE(m.delivered, FALSE), 
+		        r.sent AND NOT COALESCE(m.delivered, FALSE), 
+		        r.queued AND NOT COALESCE(m.delivered, FALSE), 
+		        r.code, r.error 
+		 FROM group_push_results r 
+		 LEFT JOIN messages m ON m.message_id = r.message_id 
+		 WHERE r.push_id = ?`,
+		pushID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	push.Results = []*model.DeliveryResult{}
+	for rows.Next() {
+		r := &model.DeliveryResult{}
+		if err := rows.Scan(&r.DeviceKey, &r.MessageID, &r.Transport, &r.Delivered, &r.Sent, &r.Queued, &r.Code, &r.Error); err != nil {
+			return nil, err
+		}
+		push.Results = append(push.Results, r)
+	}
+	return push, rows.Err()
+}
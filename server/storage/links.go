@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Device link operations
+
+// GetDeviceLink returns the link token of a device, or "" when it is not linked
+func (s *SQLStorage) GetDeviceLink(deviceID int64) (string, error) {
+	var token string
+	err := s.db.QueryRow(
+		`SELECT COALESCE(link_id, '') FROM devices WHERE id = ?`,
+		deviceID,
+	).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, err
+}
+
+// SetDeviceLink links a device to the token, or unlinks it when token is empty
+func (s *SQLStorage) SetDeviceLink(deviceID int64, token string) error {
+	_, err := s.db.Exec(
+		`UPDATE devices SET link_id = NULLIF(?, '') WHERE id = ?`,
+		token, deviceID,
+	)
+	return err
+}
+
+// GetLinkedDevices returns all devices sharing the link token
+func (s *SQLStorage) GetLinkedDevices(token string) ([]*model.Device, error) {
+	rows, err := s.db.Query(
+		`SELECT id, device_key, device_type, device_token, public_key, name, created_at, last_seen
+		 FROM devices WHERE link_id = ? ORDER BY id`,
+		token,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []*model.Device{}
+	for rows.Next() {
+		device := &model.Device{}
+		err := rows.Scan(&device.ID, &device.DeviceKey, &device.DeviceType, &device.DeviceToken, &device.PublicKey, &device.Name, &device.CreatedAt, &device.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// Read state operations
+
+// MarkMessageRead marks a message of a device as read. It returns the message,
+// or nil when it does not exist, and whether it was unread before.
+func (s *SQLStorage) MarkMessageRead(deviceID int64, messageID string) (*model.Message, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	msg := &model.Message{}
+	err = tx.QueryRow(
+		`SELECT id, device_id, message_id, COALESCE(notification_id, ''), title, body, group_name, created_at, read_at
+		 FROM messages WHERE device_id = ? AND message_id = ?`,
+		deviceID, messageID,
+	).Scan(&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body, &msg.Group, &msg.CreatedAt, &msg.ReadAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if msg.ReadAt != nil {
+		return msg, false, nil
+	}
+
+	if err := markRead(tx, msg); err != nil {
+		return nil, false, err
+	}
+	return msg, true, tx.Commit()
+}
+
+// MarkMatchingMessagesRead marks the unread messages of a device that are
+// copies of src as read: the same notification ID when src has one, otherwise
+// the same title, body and group created within window of src.
+// It returns the messages it marked.
+func (s *SQLStorage) MarkMatchingMessagesRead(deviceID int64, src *model.Message, window time.Duration) ([]*model.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, device_id, message_id, COALESCE(notification_id, '')
+		 FROM messages WHERE device_id = ? AND read_at IS NULL`
+	args := []interface{}{deviceID}
+	if src.NotificationID != "" {
+		query += ` AND notification_id = ?`
+		args = append(args, src.NotificationID)
+	} else {
+		// created_at is stored in local time
+		query += ` AND title = ? AND body = ? AND group_name = ? AND created_at BETWEEN ? AND ?`
+		args = append(args, src.Title, src.Body, src.Group, src.CreatedAt.Add(-window).Local(), src.CreatedAt.Add(window).Local())
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages := []*model.Message{}
+	for rows.Next() {
+		msg := &model.Message{}
+		if err := rows.Scan(&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		if err := markRead(tx, msg); err != nil {
+			return nil, err
+		}
+	}
+	return messages, tx.Commit()
+}
+
+// markRead sets read_at and records the read event within a transaction
+func markRead(tx *dbTx, msg *model.Message) error {
+	now := time.Now()
+	if _, err := tx.Exec(`UPDATE messages SET read_at = ? WHERE id = ?`, now, msg.ID); err != nil {
+		return err
+	}
+	msg.ReadAt = &now
+	return addMessageEvent(tx, &model.MessageEvent{MessageID: msg.MessageID, DeviceID: msg.DeviceID, State: model.MessageStateRead, CreatedAt: now})
+}
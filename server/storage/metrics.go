@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/abnotify/server/metrics"
+)
+
+var queryDuration = metrics.NewHistogramVec(
+	"abnotify_db_query_duration_seconds",
+	"Database statement latency by statement type; begin measures waiting for the write lock.",
+	metrics.DefaultBuckets, "op",
+)
+
+// timedDB records the latency of statements run outside transactions and of
+// starting transactions. Queries are rewritten for the database's dialect.
+type timedDB struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (db *timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer queryDuration.ObserveSince(time.Now(), queryOp(query))
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *timedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer queryDuration.ObserveSince(time.Now(), queryOp(query))
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *timedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer queryDuration.ObserveSince(time.Now(), queryOp(query))
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+// Insert runs an INSERT and returns the id of the new row
+func (db *timedDB) Insert(query string, args ...interface{}) (int64, error) {
+	return insertID(db, db.dialect, query, args...)
+}
+
+func (db *timedDB) Begin() (*dbTx, error) {
+	defer queryDuration.ObserveSince(time.Now(), "begin")
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+// queryOp returns the statement type (select, insert, ...) as metric label
+func queryOp(query string) string {
+	op := strings.TrimSpace(query)
+	if i := strings.IndexFunc(op, unicode.IsSpace); i >= 0 {
+		op = op[:i]
+	}
+	switch op = strings.ToLower(op); op {
+	case "select", "insert", "update", "delete", "create", "alter", "drop", "pragma", "vacuum", "analyze", "with":
+		return op
+	}
+	return "other"
+}
+
+// CountQueuedMessages returns the number of unexpired messages waiting to be
+// delivered to offline devices
+func (s *SQLStorage) CountQueuedMessages() (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM messages WHERE delivered = FALSE AND read_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`,
+		time.Now().UTC(),
+	).Scan(&count)
+	return count, err
+}
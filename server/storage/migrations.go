@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Schema migrations
+//
+// The schema is changed only by appending a migration to this list. Each
+// migration is applied once, in order and in its own transaction, and
+// recorded in the schema_version table. Never edit a released migration;
+// add a new one instead.
+//
+// Databases created before migrations were versioned have some of the
+// tables and columns already, so every migration only creates what is
+// missing: CREATE ... IF NOT EXISTS and ADD COLUMN IF NOT EXISTS.
+
+// migration is a versioned schema change with an up step per dialect
+type migration struct {
+	version int
+	name    string
+	up      map[dialect]func(tx *dbTx) error
+}
+
+var migrations = []migration{
+	{1, "initial schema", schema(sqliteInitialSchema, postgresInitialSchema)},
+	{2, "device groups", schema(sqliteDeviceGroups, postgresDeviceGroups)},
+	{3, "scheduled messages", schema(sqliteScheduledMessages, postgresScheduledMessages)},
+	{4, "message expiry", schema(sqliteMessageExpiry, postgresMessageExpiry)},
+	{5, "delivery acknowledgements", schema(sqliteDeliveryAcks, postgresDeliveryAcks)},
+	{6, "message events", schema(sqliteMessageEvents, postgresMessageEvents)},
+	{7, "message search", map[dialect]func(tx *dbTx) error{
+		dialectSQLite: createSearchIndex,
+		// PostgreSQL searches with ILIKE
+		dialectPostgres: execAll(nil),
+	}},
+	{8, "notification ids", schema(sqliteNotificationIDs, postgresNotificationIDs)},
+	{9, "linked devices", schema(sqliteLinkedDevices, postgresLinkedDevices)},
+	{10, "dedupe keys", schema(sqliteDedupeKeys, postgresDedupeKeys)},
+	{11, "subscribe secrets", schema(sqliteSubscribeSecrets, postgresSubscribeSecrets)},
+	{12, "device key aliases", schema(sqliteKeyAliases, postgresKeyAliases)},
+	{13, "registration attempts", schema(sqliteRegistrationAttempts, postgresRegistrationAttempts)},
+	{14, "group push sent state", schema(sqliteGroupPushSent, postgresGroupPushSent)},
+}
+
+// LatestSchemaVersion returns the schema version this server migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrationLockID serializes migrations of servers starting at the same time
+// on PostgreSQL; SQLite transactions already take the write lock
+const migrationLockID = 0x61626e6f
+
+// Migration describes a schema migration of the database
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil while pending
+}
+
+// schema returns the up steps of a migration given as statements per dialect
+func schema(sqlite, postgres []string) map[dialect]func(tx *dbTx) error {
+	return map[dialect]func(tx *dbTx) error{
+		dialectSQLite:   execAll(sqlite),
+		dialectPostgres: execAll(postgres),
+	}
+}
+
+// execAll returns an up step running the statements in order
+func execAll(statements []string) func(tx *dbTx) error {
+	return func(tx *dbTx) error {
+		for _, query := range statements {
+			if m := addColumnIfMissing.FindStringSubmatch(query); m != nil && tx.dialect == dialectSQLite {
+				if err := sqliteAddColumn(tx, m[1], m[2], m[3]); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumnIfMissing matches ALTER TABLE ... ADD COLUMN IF NOT EXISTS, which
+// SQLite does not support
+var addColumnIfMissing = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+) (.+)$`)
+
+// sqliteAddColumn adds a column to a SQLite table unless it exists
+func sqliteAddColumn(tx *dbTx, table, column, definition string) error {
+	var n int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// createSchemaVersion creates the table recording applied migrations
+func createSchemaVersion(db *timedDB) error {
+	timestamp := "DATETIME"
+	if db.dialect == dialectPostgres {
+		timestamp = "TIMESTAMPTZ"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL
+	)`)
+	return err
+}
+
+// schemaVersion returns the highest applied migration, 0 for a new database
+func schemaVersion(q queryer) (int, error) {
+	var version int
+	err := q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// migrate applies the pending migrations. It refuses a database whose schema
+// is newer than this server, as written by a later release.
+func (s *SQLStorage) migrate() error {
+	if err := createSchemaVersion(s.db); err != nil {
+		return fmt.Errorf("create schema_version: %w", err)
+	}
+	current, err := schemaVersion(s.db)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return fmt.Errorf("database schema version %d is newer than version %d supported by this server, upgrade the server", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		applied, err := s.applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("schema migration %d (%s): %w", m.version, m.name, err)
+		}
+		if applied {
+			slog.Info("applied schema migration", "version", m.version, "name", m.name)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records it in one transaction. It
+// reports false when another server applied it meanwhile.
+func (s *SQLStorage) applyMigration(m migration) (bool, error) {
+	up, ok := m.up[s.db.dialect]
+	if !ok {
+		return false, fmt.Errorf("no migration for this database")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if s.db.dialect == dialectPostgres {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLockID); err != nil {
+			return false, err
+		}
+	}
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if current >= m.version {
+		return false, nil
+	}
+
+	if err := up(tx); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UTC(),
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SchemaStatus returns the migrations known to this server and those
+// recorded in the database, in order, without changing the database
+func SchemaStatus(driver, dsn string) ([]Migration, error) {
+	byVersion := map[int]*Migration{}
+	for _, m := range migrations {
+		byVersion[m.version] = &Migration{Version: m.version, Name: m.name}
+	}
+
+	var db *timedDB
+	switch driver {
+	case DriverSQLite, "":
+		// Opening would create a missing database, whose migrations are all
+		// pending
+		if _, err := os.Stat(dsn); os.IsNotExist(err) {
+			return sortedMigrations(byVersion), nil
+		} else if err != nil {
+			return nil, err
+		}
+		sqlDB, err := openSQLite(dsn)
+		if err != nil {
+			return nil, err
+		}
+		db = &timedDB{DB: sqlDB, dialect: dialectSQLite}
+	case DriverPostgres:
+		sqlDB, err := openPostgres(dsn)
+		if err != nil {
+			return nil, err
+		}
+		db = &timedDB{DB: sqlDB, dialect: dialectPostgres}
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	defer db.Close()
+
+	// Applied migrations, including those of newer releases
+	versioned, err := hasSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if versioned {
+		rows, err := db.Query(`SELECT version, name, applied_at FROM schema_version`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			applied := &Migration{}
+			var at time.Time
+			if err := rows.Scan(&applied.Version, &applied.Name, &at); err != nil {
+				return nil, err
+			}
+			applied.AppliedAt = &at
+			byVersion[applied.Version] = applied
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sortedMigrations(byVersion), nil
+}
+
+// sortedMigrations returns the migrations ordered by version
+func sortedMigrations(byVersion map[int]*Migration) []Migration {
+	status := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		status = append(status, *m)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status
+}
+
+// hasSchemaVersion reports whether the database has the schema_version
+// table, which it lacks before its first migration
+func hasSchemaVersion(db *timedDB) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`
+	if db.dialect == dialectPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version'`
+	}
+	var n int
+	err := db.QueryRow(query).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// openTestStorage opens a migrated SQLite database in a temporary directory
+func openTestStorage(t *testing.T) (*SQLStorage, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "abnotify.db")
+	s, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+		for _, d := range []dialect{dialectSQLite, dialectPostgres} {
+			if m.up[d] == nil {
+				t.Errorf("migration %d (%s) has no step for dialect %d", m.version, m.name, d)
+			}
+		}
+	}
+	if got := LatestSchemaVersion(); got != len(migrations) {
+		t.Errorf("LatestSchemaVersion() = %d, want %d", got, len(migrations))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opens int
+	}{
+		{"new database", 1},
+		{"re-run is a no-op", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "abnotify.db")
+			for i := 0; i < tt.opens; i++ {
+				s, err := NewSQLiteStorage(path)
+				if err != nil {
+					t.Fatalf("open %d: NewSQLiteStorage() error = %v", i+1, err)
+				}
+				s.Close()
+			}
+
+			status, err := SchemaStatus(DriverSQLite, path)
+			if err != nil {
+				t.Fatalf("SchemaStatus() error = %v", err)
+			}
+			if len(status) != len(migrations) {
+				t.Fatalf("SchemaStatus() returned %d migrations, want %d", len(status), len(migrations))
+			}
+			for _, m := range status {
+				if m.AppliedAt == nil {
+					t.Errorf("migration %d (%s) pending after open", m.Version, m.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	s, path := openTestStorage(t)
+	newer := LatestSchemaVersion() + 1
+	if _, err := s.db.Exec(
+		`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		newer, "from a later release", time.Now().UTC(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, err := NewSQLiteStorage(path)
+	if err == nil {
+		t.Fatal("NewSQLiteStorage() opened a database with a newer schema")
+	}
+	if !strings.Contains(err.Error(), "newer") {
+		t.Errorf("NewSQLiteStorage() error = %v, want a newer schema error", err)
+	}
+
+	status, err := SchemaStatus(DriverSQLite, path)
+	if err != nil {
+		t.Fatalf("SchemaStatus() error = %v", err)
+	}
+	if last := status[len(status)-1]; last.Version != newer || last.AppliedAt == nil {
+		t.Errorf("SchemaStatus() last migration = %+v, want applied version %d", last, newer)
+	}
+}
+
+func TestMigrateAdoptsUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abnotify.db")
+
+	// Schema of the last release before migrations were versioned
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`CREATE TABLE devices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_key TEXT UNIQUE NOT NULL,
+			device_type TEXT DEFAULT 'ios',
+			device_token TEXT,
+			public_key TEXT,
+			name TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_seen DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id INTEGER NOT NULL,
+			message_id TEXT UNIQUE NOT NULL,
+			title TEXT,
+			body TEXT,
+			group_name TEXT,
+			icon TEXT,
+			url TEXT,
+			sound TEXT,
+			badge INTEGER DEFAULT 0,
+			encrypted_payload BLOB,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delivered BOOLEAN DEFAULT FALSE
+		)`,
+		`INSERT INTO devices (device_key, device_token, public_key, name) VALUES ('legacy', 'token', '', '')`,
+		`INSERT INTO messages (device_id, message_id, title, body, group_name, icon, url, sound)
+		 VALUES (1, 'm1', 'title', 'body', '', '', '', '')`,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage() error = %v", err)
+	}
+	defer s.Close()
+
+	version, err := schemaVersion(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", version, LatestSchemaVersion())
+	}
+
+	device, err := s.GetDeviceByKey("legacy")
+	if err != nil {
+		t.Fatalf("GetDeviceByKey() error = %v", err)
+	}
+	if device == nil || device.DeviceType != "ios" || device.DeviceToken != "token" {
+		t.Fatalf("GetDeviceByKey() = %+v, want the legacy iOS device", device)
+	}
+
+	history, err := s.GetMessageHistory(device.ID, &model.HistoryFilter{Limit: 10})
+	if err != nil {
+		t.Fatalf("GetMessageHistory() error = %v", err)
+	}
+	if len(history) != 1 || history[0].MessageID != "m1" {
+		t.Errorf("GetMessageHistory() = %d messages, want the legacy message", len(history))
+	}
+}
+
+func TestSchemaStatusMissingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.db")
+	status, err := SchemaStatus(DriverSQLite, path)
+	if err != nil {
+		t.Fatalf("SchemaStatus() error = %v", err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("SchemaStatus() returned %d migrations, want %d", len(status), len(migrations))
+	}
+	for _, m := range status {
+		if m.AppliedAt != nil {
+			t.Errorf("migration %d applied on a missing database", m.Version)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("SchemaStatus() created the database, stat error = %v", err)
+	}
+}
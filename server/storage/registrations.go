@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Registration attempt operations
+
+// CreateRegistrationAttempt records a failed registration change
+func (s *SQLStorage) CreateRegistrationAttempt(a *model.RegistrationAttempt) error {
+	a.CreatedAt = time.Now()
+	id, err := s.db.Insert(
+		`INSERT INTO registration_attempts (device_id, device_key, device_type, device_token, public_key, client_ip, user_agent, reason, status, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.DeviceID, a.DeviceKey, a.DeviceType, a.DeviceToken, a.PublicKey, a.ClientIP, a.UserAgent, a.Reason, a.Status, a.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	a.ID = id
+	return nil
+}
+
+// GetRegistrationAttempt returns a registration attempt, or nil
+func (s *SQLStorage) GetRegistrationAttempt(id int64) (*model.RegistrationAttempt, error) {
+	rows, err := s.db.Query(registrationAttemptSelect+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := scanRegistrationAttempts(rows)
+	if err != nil || len(attempts) == 0 {
+		return nil, err
+	}
+	return attempts[0], nil
+}
+
+// ListRegistrationAttempts returns the newest attempts, optionally only those
+// in the given state
+func (s *SQLStorage) ListRegistrationAttempts(status string, limit int) ([]*model.RegistrationAttempt, error) {
+	rows, err := s.db.Query(
+		registrationAttemptSelect+` WHERE (? = '' OR status = ?) ORDER BY id DESC LIMIT ?`,
+		status, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRegistrationAttempts(rows)
+}
+
+// ResolveRegistrationAttempt moves a quarantined attempt to the given state.
+// It reports whether the attempt was still quarantined.
+func (s *SQLStorage) ResolveRegistrationAttempt(id int64, status string) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE registration_attempts SET status = ?, resolved_at = ? WHERE id = ? AND status = ?`,
+		status, time.Now(), id, model.AttemptQuarantined,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteOldRegistrationAttempts deletes audit records older than the given
+// duration, counted from their review if they had one. Quarantined attempts
+// are kept until they are reviewed.
+func (s *SQLStorage) DeleteOldRegistrationAttempts(olderThan time.Duration) (int64, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM registration_attempts WHERE COALESCE(resolved_at, created_at) < ? AND status != ?`,
+		time.Now().Add(-olderThan), model.AttemptQuarantined,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const registrationAttemptSelect = `SELECT id, device_id, device_key, device_type, device_token, public_key,
+	client_ip, user_agent, reason, status, created_at, resolved_at FROM registration_attempts`
+
+func scanRegistrationAttempts(rows *sql.Rows) ([]*model.RegistrationAttempt, error) {
+	defer rows.Close()
+
+	attempts := []*model.RegistrationAttempt{}
+	for rows.Next() {
+		a := &model.RegistrationAttempt{}
+		err := rows.Scan(&a.ID, &a.DeviceID, &a.DeviceKey, &a.DeviceType, &a.DeviceToken, &a.PublicKey,
+			&a.ClientIP, &a.UserAgent, &a.Reason, &a.Status, &a.CreatedAt, &a.ResolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+func TestDeleteOldRegistrationAttempts(t *testing.T) {
+	s, _ := openTestStorage(t)
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		reason     string
+		status     string
+		createdAt  time.Time
+		resolvedAt *time.Time
+		wantKept   bool
+	}{
+		{"old rejected", model.AttemptRejected, old, nil, false},
+		{"recent rejected", model.AttemptRejected, recent, nil, true},
+		{"old quarantined", model.AttemptQuarantined, old, nil, true},
+		{"old, reviewed long ago", model.AttemptApproved, old, &old, false},
+		{"old, reviewed recently", model.AttemptDismissed, old, &recent, true},
+	}
+	for _, tt := range tests {
+		a := &model.RegistrationAttempt{DeviceID: 1, DeviceKey: "device", Reason: tt.reason, Status: tt.status}
+		if err := s.CreateRegistrationAttempt(a); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec(`UPDATE registration_attempts SET created_at = ?, resolved_at = ? WHERE id = ?`,
+			tt.createdAt, tt.resolvedAt, a.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.DeleteOldRegistrationAttempts(24 * time.Hour); err != nil {
+		t.Fatalf("DeleteOldRegistrationAttempts() error = %v", err)
+	}
+
+	attempts, err := s.ListRegistrationAttempts("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]bool{}
+	for _, a := range attempts {
+		kept[a.Reason] = true
+	}
+	for _, tt := range tests {
+		if kept[tt.reason] != tt.wantKept {
+			t.Errorf("%s: kept = %v, want %v", tt.reason, kept[tt.reason], tt.wantKept)
+		}
+	}
+}
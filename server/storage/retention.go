@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Retention operations
+
+// retentionBatchSize bounds each DELETE so cleanup never holds the write lock
+// long enough to starve concurrent pushes
+const retentionBatchSize = 1000
+
+// DeleteOldMessages deletes messages older than the specified duration.
+// Messages in excludeGroups are skipped, and so are undelivered messages when
+// keepUndelivered is set.
+func (s *SQLStorage) DeleteOldMessages(olderThan time.Duration, keepUndelivered bool, excludeGroups ...string) (int64, error) {
+	query := `SELECT id FROM messages WHERE created_at < ?`
+	args := []interface{}{time.Now().Add(-olderThan)}
+	if keepUndelivered {
+		query += ` AND delivered = TRUE`
+	}
+	if len(excludeGroups) > 0 {
+		query += ` AND group_name NOT IN (?` + strings.Repeat(`, ?`, len(excludeGroups)-1) + `)`
+		for _, group := range excludeGroups {
+			args = append(args, group)
+		}
+	}
+	return s.deleteMessagesIn(query, args...)
+}
+
+// DeleteOldGroupMessages deletes messages of a group older than the specified duration
+func (s *SQLStorage) DeleteOldGroupMessages(group string, olderThan time.Duration, keepUndelivered bool) (int64, error) {
+	query := `SELECT id FROM messages WHERE group_name = ? AND created_at < ?`
+	if keepUndelivered {
+		query += ` AND delivered = TRUE`
+	}
+	return s.deleteMessagesIn(query, group, time.Now().Add(-olderThan))
+}
+
+// TrimDeviceMessages keeps only the newest max messages of every device.
+// Undelivered messages beyond the limit are kept when keepUndelivered is set.
+func (s *SQLStorage) TrimDeviceMessages(max int, keepUndelivered bool) (int64, error) {
+	query := `SELECT id FROM (
+			SELECT id, delivered, ROW_NUMBER() OVER (PARTITION BY device_id ORDER BY id DESC) AS rn FROM messages
+		 ) AS ranked WHERE rn > ?`
+	if keepUndelivered {
+		query += ` AND delivered = TRUE`
+	}
+	return s.deleteMessagesIn(query, max)
+}
+
+// DeleteOldMessageEvents deletes events older than the specified duration
+// whose message no longer exists
+func (s *SQLStorage) DeleteOldMessageEvents(olderThan time.Duration) (int64, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM message_events WHERE created_at < ?
+		 AND message_id NOT IN (SELECT message_id FROM messages)`,
+		time.Now().Add(-olderThan),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Optimize lets the database refresh the query planner statistics
+func (s *SQLStorage) Optimize() error {
+	query := `PRAGMA optimize`
+	if s.db.dialect == dialectPostgres {
+		query = `ANALYZE`
+	}
+	_, err := s.db.Exec(query)
+	return err
+}
+
+// Vacuum reclaims the space of deleted rows. SQLite rebuilds the database
+// file; PostgreSQL marks the space for reuse.
+func (s *SQLStorage) Vacuum() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// deleteMessagesIn deletes the messages selected by the id query in batches
+func (s *SQLStorage) deleteMessagesIn(query string, args ...interface{}) (int64, error) {
+	args = append(args, retentionBatchSize)
+	var total int64
+	for {
+		result, err := s.db.Exec(`DELETE FROM messages WHERE id IN (`+query+` LIMIT ?)`, args...)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < retentionBatchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// insertTestMessages inserts n messages of a device in one transaction
+func insertTestMessages(t *testing.T, s *SQLStorage, deviceID int64, n int, group string, createdAt time.Time, delivered bool) {
+	t.Helper()
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for i := 0; i < n; i++ {
+		if _, err := tx.Exec(
+			`INSERT INTO messages (device_id, message_id, title, body, group_name, created_at, delivered) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			deviceID, fmt.Sprintf("%d-%s-%d-%t-%d", deviceID, group, createdAt.UnixNano(), delivered, i), "t", "b", group, createdAt, delivered,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countMessages returns how many messages of the device are stored
+func countMessages(t *testing.T, s *SQLStorage, deviceID int64) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE device_id = ?`, deviceID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDeleteOldMessagesBatches(t *testing.T) {
+	s, _ := openTestStorage(t)
+	old := time.Now().Add(-48 * time.Hour)
+	batches := 2*retentionBatchSize + 5
+
+	insertTestMessages(t, s, 1, batches, "", old, true)
+	insertTestMessages(t, s, 1, 3, "", time.Now(), true)
+	insertTestMessages(t, s, 1, 2, "", old, false)
+	insertTestMessages(t, s, 1, 4, "keep", old, true)
+
+	n, err := s.DeleteOldMessages(24*time.Hour, true, "keep")
+	if err != nil {
+		t.Fatalf("DeleteOldMessages() error = %v", err)
+	}
+	if n != int64(batches) {
+		t.Errorf("DeleteOldMessages() = %d, want %d", n, batches)
+	}
+	// Recent, undelivered and excluded messages are kept
+	if got := countMessages(t, s, 1); got != 3+2+4 {
+		t.Errorf("%d messages left, want %d", got, 3+2+4)
+	}
+
+	n, err = s.DeleteOldGroupMessages("keep", 24*time.Hour, false)
+	if err != nil || n != 4 {
+		t.Errorf("DeleteOldGroupMessages() = %d, %v, want 4", n, err)
+	}
+}
+
+func TestTrimDeviceMessages(t *testing.T) {
+	tests := []struct {
+		name            string
+		keepUndelivered bool
+		wantDeleted     int64
+		wantLeft        int
+	}{
+		{"trim all", false, retentionBatchSize + 10, 5},
+		{"keep undelivered", true, retentionBatchSize, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := openTestStorage(t)
+			old := time.Now().Add(-time.Hour)
+			// Oldest first: undelivered, then delivered, then the newest five
+			insertTestMessages(t, s, 1, 10, "", old, false)
+			insertTestMessages(t, s, 1, retentionBatchSize, "", old, true)
+			insertTestMessages(t, s, 1, 5, "", time.Now(), true)
+			insertTestMessages(t, s, 2, 5, "", old, true)
+
+			n, err := s.TrimDeviceMessages(5, tt.keepUndelivered)
+			if err != nil {
+				t.Fatalf("TrimDeviceMessages() error = %v", err)
+			}
+			if n != tt.wantDeleted {
+				t.Errorf("TrimDeviceMessages() = %d, want %d", n, tt.wantDeleted)
+			}
+			if got := countMessages(t, s, 1); got != tt.wantLeft {
+				t.Errorf("%d messages left, want %d", got, tt.wantLeft)
+			}
+			if got := countMessages(t, s, 2); got != 5 {
+				t.Errorf("other device has %d messages left, want 5", got)
+			}
+		})
+	}
+}
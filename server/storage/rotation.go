@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+var (
+	// ErrDeviceKeyInUse is returned when the new key belongs to another device
+	ErrDeviceKeyInUse = errors.New("device key already in use")
+
+	// ErrDeviceKeyRotated is returned when the key was replaced meanwhile
+	ErrDeviceKeyRotated = errors.New("device key was rotated by another request")
+
+	// ErrDeviceKeyRetired is returned when looking up a key whose rotation
+	// grace period is over
+	ErrDeviceKeyRetired = errors.New("device key has been retired")
+)
+
+// Device key rotation
+
+// RotateDeviceKey replaces the key of a device. The device keeps its ID and so
+// its messages, group memberships and links. The old key keeps resolving to the
+// device until graceUntil and is remembered as retired afterwards.
+func (s *SQLStorage) RotateDeviceKey(deviceID int64, oldKey, newKey string, graceUntil time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Retired keys of other devices are never handed out again
+	var taken int
+	err = tx.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM devices WHERE device_key = ?) +
+		        (SELECT COUNT(*) FROM device_key_aliases WHERE old_key = ? AND device_id != ?)`,
+		newKey, newKey, deviceID,
+	).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrDeviceKeyInUse
+	}
+
+	// Rotating back to one of the device's previous keys
+	if _, err := tx.Exec(`DELETE FROM device_key_aliases WHERE old_key = ?`, newKey); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE devices SET device_key = ? WHERE id = ? AND device_key = ?`,
+		newKey, deviceID, oldKey,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeviceKeyRotated
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO device_key_aliases (old_key, device_id, rotated_at, expires_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (old_key) DO UPDATE SET
+		   device_id = excluded.device_id, rotated_at = excluded.rotated_at, expires_at = excluded.expires_at`,
+		oldKey, deviceID, time.Now().UTC(), graceUntil.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getDeviceByAlias returns the device an old key still resolves to during
+// its grace period, ErrDeviceKeyRetired after it, or nil for an unknown key
+func (s *SQLStorage) getDeviceByAlias(oldKey string) (*model.Device, error) {
+	var deviceID int64
+	var expiresAt time.Time
+	err := s.db.QueryRow(
+		`SELECT device_id, expires_at FROM device_key_aliases WHERE old_key = ?`,
+		oldKey,
+	).Scan(&deviceID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, ErrDeviceKeyRetired
+	}
+	device, err := s.GetDeviceByID(deviceID)
+	if err == nil && device == nil {
+		// The device was deleted
+		return nil, ErrDeviceKeyRetired
+	}
+	return device, err
+}
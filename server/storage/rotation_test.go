@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+func TestRotateDeviceKey(t *testing.T) {
+	s, _ := openTestStorage(t)
+	device := &model.Device{DeviceKey: "k1", DeviceType: "android"}
+	if err := s.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDevice(&model.Device{DeviceKey: "taken", DeviceType: "android"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateMessage(&model.Message{DeviceID: device.ID, MessageID: "m1", Title: "t", Body: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name           string
+		oldKey, newKey string
+		grace          time.Duration
+		wantErr        error
+	}{
+		{"rotate with a grace period", "k1", "k2", time.Hour, nil},
+		{"rotate without a grace period", "k2", "k3", 0, nil},
+		{"stale old key", "k2", "k4", time.Hour, ErrDeviceKeyRotated},
+		{"key of another device", "k3", "taken", time.Hour, ErrDeviceKeyInUse},
+	}
+	for _, step := range steps {
+		err := s.RotateDeviceKey(device.ID, step.oldKey, step.newKey, time.Now().Add(step.grace))
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: RotateDeviceKey() error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	lookups := []struct {
+		key     string
+		wantErr error
+	}{
+		{"k3", nil},                 // current key
+		{"k1", nil},                 // in its grace period
+		{"k2", ErrDeviceKeyRetired}, // grace period over
+	}
+	for _, l := range lookups {
+		got, err := s.GetDeviceByKey(l.key)
+		if !errors.Is(err, l.wantErr) {
+			t.Errorf("GetDeviceByKey(%s) error = %v, want %v", l.key, err, l.wantErr)
+			continue
+		}
+		if l.wantErr == nil && (got == nil || got.ID != device.ID || got.DeviceKey != "k3") {
+			t.Errorf("GetDeviceByKey(%s) = %+v, want device %d with key k3", l.key, got, device.ID)
+		}
+	}
+
+	// History stays with the device
+	messages, err := s.GetUndeliveredMessages(device.ID)
+	if err != nil || len(messages) != 1 || messages[0].MessageID != "m1" {
+		t.Errorf("GetUndeliveredMessages() = %d messages, %v, want m1", len(messages), err)
+	}
+
+	// A device may return to one of its own retired keys
+	if err := s.RotateDeviceKey(device.ID, "k3", "k2", time.Now()); err != nil {
+		t.Fatalf("RotateDeviceKey(back to k2) error = %v", err)
+	}
+	if got, err := s.GetDeviceByKey("k2"); err != nil || got == nil || got.ID != device.ID {
+		t.Errorf("GetDeviceByKey(k2) = %v, %v, want device %d", got, err, device.ID)
+	}
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Scheduled message operations
+
+// ErrScheduleNotPending is returned when storing the message of a scheduled
+// message that was cancelled or delivered meanwhile
+var ErrScheduleNotPending = errors.New("scheduled message is no longer pending")
+
+// CreateScheduledMessage stores a push request for delivery at sm.SendAt.
+// It returns a *DuplicateError when the request repeats an earlier one.
+func (s *SQLStorage) CreateScheduledMessage(sm *model.ScheduledMessage) error {
+	payload, err := json.Marshal(sm.Request)
+	if err != nil {
+		return err
+	}
+
+	sm.Status = model.ScheduleStatusPending
+	sm.CreatedAt = time.Now()
+	// Store UTC so send_at compares correctly as text
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := claimDedupeKeys(tx, sm.DeviceID, sm.MessageID, sm.ScheduleID, sm.Dedupe); err != nil {
+		return err
+	}
+	id, err := tx.Insert(
+		`INSERT INTO scheduled_messages (schedule_id, device_id, message_id, payload, send_at, status, created_at) 
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sm.ScheduleID, sm.DeviceID, sm.MessageID, string(payload), sm.SendAt.UTC(), sm.Status, sm.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := addMessageEvent(tx, &model.MessageEvent{MessageID: sm.MessageID, DeviceID: sm.DeviceID, State: model.MessageStateScheduled}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sm.ID = id
+	return nil
+}
+
+// GetScheduledMessage retrieves a scheduled message by its schedule ID
+func (s *SQLStorage) GetScheduledMessage(scheduleID string) (*model.ScheduledMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT id, schedule_id, device_id, message_id, payload, send_at, status, created_at 
+		 FROM scheduled_messages WHERE schedule_id = ?`,
+		scheduleID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := scanScheduledMessages(rows)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// GetPendingScheduledMessages retrieves pending scheduled messages for a device
+func (s *SQLStorage) GetPendingScheduledMessages(deviceID int64) ([]*model.ScheduledMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT id, schedule_id, device_id, message_id, payload, send_at, status, created_at 
+		 FROM scheduled_messages 
+		 WHERE device_id = ? AND status = ? 
+		 ORDER BY send_at ASC`,
+		deviceID, model.ScheduleStatusPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanScheduledMessages(rows)
+}
+
+// GetDueScheduledMessages retrieves pending scheduled messages due at or before now
+func (s *SQLStorage) GetDueScheduledMessages(now time.Time, limit int) ([]*model.ScheduledMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT id, schedule_id, device_id, message_id, payload, send_at, status, created_at 
+		 FROM scheduled_messages 
+		 WHERE status = ? AND send_at <= ? 
+		 ORDER BY send_at ASC 
+		 LIMIT ?`,
+		model.ScheduleStatusPending, now.UTC(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanScheduledMessages(rows)
+}
+
+// UpdateScheduledMessageStatus moves a scheduled message from one status to another.
+// It reports false if the message was not in the expected status.
+func (s *SQLStorage) UpdateScheduledMessageStatus(scheduleID, from, to string) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE scheduled_messages SET status = ? WHERE schedule_id = ? AND status = ?`,
+		to, scheduleID, from,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// claimScheduledMessage marks a pending scheduled message sent in the
+// transaction storing its message, so a crash cannot lose it in between
+func claimScheduledMessage(tx *dbTx, scheduleID string) error {
+	if scheduleID == "" {
+		return nil
+	}
+	result, err := tx.Exec(
+		`UPDATE scheduled_messages SET status = ? WHERE schedule_id = ? AND status = ?`,
+		model.ScheduleStatusSent, scheduleID, model.ScheduleStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrScheduleNotPending
+	}
+	return nil
+}
+
+// scanScheduledMessages scans scheduled message rows and decodes their payloads
+func scanScheduledMessages(rows *sql.Rows) ([]*model.ScheduledMessage, error) {
+	var messages []*model.ScheduledMessage
+	for rows.Next() {
+		sm := &model.ScheduledMessage{}
+		var payload string
+		err := rows.Scan(
+			&sm.ID, &sm.ScheduleID, &sm.DeviceID, &sm.MessageID, &payload,
+			&sm.SendAt, &sm.Status, &sm.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sm.Request = &model.PushRequest{}
+		if err := json.Unmarshal([]byte(payload), sm.Request); err != nil {
+			return nil, err
+		}
+		sm.Title = sm.Request.Title
+		sm.Body = sm.Request.Body
+		sm.Group = sm.Request.Group
+		messages = append(messages, sm)
+	}
+
+	return messages, rows.Err()
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abnotify/server/model"
+)
+
+// Full-text search over messages uses an external-content FTS5 table kept in
+// sync by triggers. FTS5 is only compiled into go-sqlite3 with the
+// sqlite_fts5 build tag; without it search falls back to LIKE matching.
+// PostgreSQL ranks substring matches with tsvector functions instead.
+//
+// The trigram tokenizer is used so substrings match in any language
+// (Chinese text has no word boundaries), at the cost of requiring search
+// terms of at least three characters.
+const minTrigramTerm = 3
+
+var searchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		title, body, group_name,
+		content='messages', content_rowid='id', tokenize='trigram'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_ai AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, title, body, group_name)
+		VALUES (new.id, new.title, new.body, new.group_name);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_ad AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, body, group_name)
+		VALUES ('delete', old.id, old.title, old.body, old.group_name);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_au AFTER UPDATE OF title, body, group_name ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, title, body, group_name)
+		VALUES ('delete', old.id, old.title, old.body, old.group_name);
+		INSERT INTO messages_fts(rowid, title, body, group_name)
+		VALUES (new.id, new.title, new.body, new.group_name);
+	END`,
+}
+
+var searchTriggers = []string{"messages_fts_ai", "messages_fts_ad", "messages_fts_au"}
+
+// createSearchIndex is the migration creating the FTS5 index. A build
+// without FTS5 skips it; checkSearch creates the index once a build with
+// FTS5 opens the database.
+func createSearchIndex(tx *dbTx) error {
+	if !fts5Enabled(tx) {
+		return nil
+	}
+	return buildSearchIndex(tx)
+}
+
+// checkSearch enables FTS5 search when this build supports it and repairs
+// the index of a database last opened by a build without FTS5
+func (s *SQLStorage) checkSearch() {
+	if !fts5Enabled(s.db) {
+		// Triggers left behind by an FTS5 build would make every insert fail
+		for _, name := range searchTriggers {
+			s.db.Exec(`DROP TRIGGER IF EXISTS ` + name)
+		}
+		slog.Warn("SQLite built without FTS5, message search falls back to LIKE (build with -tags sqlite_fts5)")
+		return
+	}
+
+	if searchTriggerCount(s.db) < len(searchTriggers) {
+		if err := buildSearchIndex(s.db); err != nil {
+			slog.Warn("failed to create search index, falling back to LIKE", "error", err)
+			return
+		}
+	}
+
+	s.fts = true
+}
+
+// fts5Enabled reports whether SQLite was built with FTS5
+func fts5Enabled(q queryer) bool {
+	var enabled bool
+	q.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&enabled)
+	return enabled
+}
+
+// searchTriggerCount returns how many of the index triggers exist
+func searchTriggerCount(q queryer) int {
+	var n int
+	q.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'`).Scan(&n)
+	return n
+}
+
+// buildSearchIndex creates the FTS5 table and triggers. Missing triggers mean
+// the index is new or went stale while they were dropped, so it is rebuilt
+// from the messages.
+func buildSearchIndex(q queryer) error {
+	stale := searchTriggerCount(q) < len(searchTriggers)
+
+	for _, query := range searchSchema {
+		if _, err := q.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	if stale {
+		if _, err := q.Exec(`INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')`); err != nil {
+			return fmt.Errorf("rebuild search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// SearchMessages finds messages of a device matching every term of the query,
+// best match first. group optionally restricts the search to one group.
+func (s *SQLStorage) SearchMessages(deviceID int64, query, group string, limit, offset int) ([]*model.SearchResult, error) {
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return []*model.SearchResult{}, nil
+	}
+
+	if s.db.dialect == dialectPostgres {
+		return s.searchMessagesPostgres(deviceID, query, terms, group, limit, offset)
+	}
+
+	useFTS := s.fts
+	for _, term := range terms {
+		if utf8.RuneCountInString(term) < minTrigramTerm {
+			useFTS = false
+		}
+	}
+	if !useFTS {
+		return s.searchMessagesLike(deviceID, terms, group, limit, offset)
+	}
+
+	// Quote every term so user input is never parsed as FTS5 syntax
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+
+	sqlQuery := `SELECT m.id, m.device_id, m.message_id, COALESCE(m.notification_id, ''), m.title, m.body, m.group_name, m.icon, m.url, m.sound, m.badge,
+			m.created_at, m.expires_at, m.sent_at, m.acked_at, m.read_at, m.delivered,
+			highlight(messages_fts, 0, '<mark>', '</mark>'),
+			snippet(messages_fts, 1, '<mark>', '</mark>', '…', 32),
+			-bm25(messages_fts, 5.0, 1.0, 2.0) AS score
+		 FROM messages_fts
+		 JOIN messages m ON m.id = messages_fts.rowid
+		 WHERE messages_fts MATCH ? AND m.device_id = ?`
+	args := []interface{}{strings.Join(quoted, " "), deviceID}
+	if group != "" {
+		sqlQuery += ` AND m.group_name = ?`
+		args = append(args, group)
+	}
+	sqlQuery += ` ORDER BY score DESC, m.id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*model.SearchResult{}
+	for rows.Next() {
+		msg := &model.Message{}
+		result := &model.SearchResult{Message: msg}
+		err := rows.Scan(
+			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body,
+			&msg.Group, &msg.Icon, &msg.URL, &msg.Sound, &msg.Badge,
+			&msg.CreatedAt, &msg.ExpiresAt, &msg.SentAt, &msg.AckedAt, &msg.ReadAt, &msg.Delivered,
+			&result.TitleHighlight, &result.BodyHighlight, &result.Rank,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// searchMessagesPostgres matches substrings like the LIKE fallback, since
+// tsvector tokens cannot split Chinese text, and ranks and highlights the
+// matches by their words with ts_rank and ts_headline
+func (s *SQLStorage) searchMessagesPostgres(deviceID int64, query string, terms []string, group string, limit, offset int) ([]*model.SearchResult, error) {
+	sqlQuery := `SELECT id, device_id, message_id, COALESCE(notification_id, ''), title, body, group_name, icon, url, sound, badge,
+			created_at, expires_at, sent_at, acked_at, read_at, delivered,
+			ts_headline('simple', COALESCE(title, ''), q, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+			ts_headline('simple', COALESCE(body, ''), q, 'StartSel=<mark>, StopSel=</mark>, MaxWords=32, MinWords=8, FragmentDelimiter="…"'),
+			ts_rank(
+				setweight(to_tsvector('simple', COALESCE(title, '')), 'A') ||
+				setweight(to_tsvector('simple', COALESCE(body, '')), 'B') ||
+				setweight(to_tsvector('simple', COALESCE(group_name, '')), 'C'),
+				q) AS score
+		 FROM messages, plainto_tsquery('simple', ?) q
+		 WHERE device_id = ?`
+	args := []interface{}{query, deviceID}
+	where, whereArgs := s.likeTerms(terms)
+	sqlQuery += where
+	args = append(args, whereArgs...)
+	if group != "" {
+		sqlQuery += ` AND group_name = ?`
+		args = append(args, group)
+	}
+	sqlQuery += ` ORDER BY score DESC, id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*model.SearchResult{}
+	for rows.Next() {
+		msg := &model.Message{}
+		result := &model.SearchResult{Message: msg}
+		err := rows.Scan(
+			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body,
+			&msg.Group, &msg.Icon, &msg.URL, &msg.Sound, &msg.Badge,
+			&msg.CreatedAt, &msg.ExpiresAt, &msg.SentAt, &msg.AckedAt, &msg.ReadAt, &msg.Delivered,
+			&result.TitleHighlight, &result.BodyHighlight, &result.Rank,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// likeTerms returns the condition matching every term as a substring of the
+// title, body or group, with its arguments
+func (s *SQLStorage) likeTerms(terms []string) (string, []interface{}) {
+	var where string
+	var args []interface{}
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	like := s.db.dialect.like()
+	for _, term := range terms {
+		pattern := "%" + escaper.Replace(term) + "%"
+		where += ` AND (title ` + like + ` ? ESCAPE '\' OR body ` + like + ` ? ESCAPE '\' OR group_name ` + like + ` ? ESCAPE '\')`
+		args = append(args, pattern, pattern, pattern)
+	}
+	return where, args
+}
+
+// searchMessagesLike is the unranked fallback when FTS5 cannot be used
+func (s *SQLStorage) searchMessagesLike(deviceID int64, terms []string, group string, limit, offset int) ([]*model.SearchResult, error) {
+	sqlQuery := `SELECT id, device_id, message_id, COALESCE(notification_id, ''), title, body, group_name, icon, url, sound, badge, created_at, expires_at, sent_at, acked_at, read_at, delivered
+		 FROM messages
+		 WHERE device_id = ?`
+	args := []interface{}{deviceID}
+	where, whereArgs := s.likeTerms(terms)
+	sqlQuery += where
+	args = append(args, whereArgs...)
+	if group != "" {
+		sqlQuery += ` AND group_name = ?`
+		args = append(args, group)
+	}
+	sqlQuery += ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*model.SearchResult{}
+	for rows.Next() {
+		msg := &model.Message{}
+		err := rows.Scan(
+			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body,
+			&msg.Group, &msg.Icon, &msg.URL, &msg.Sound, &msg.Badge,
+			&msg.CreatedAt, &msg.ExpiresAt, &msg.SentAt, &msg.AckedAt, &msg.ReadAt, &msg.Delivered,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &model.SearchResult{Message: msg})
+	}
+
+	return results, rows.Err()
+}
@@ -10,36 +10,40 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// SQLiteStorage implements storage using SQLite
-type SQLiteStorage struct {
-	db *sql.DB
-}
-
-// NewSQLiteStorage creates a new SQLite storage instance
-func NewSQLiteStorage(dbPath string) (*SQLiteStorage, error) {
-	// Ensure directory exists
-	dir := filepath.Dir(dbPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
-	}
-
-	db, err := sql.Open("sqlite3", dbPath)
+// NewSQLiteStorage opens the SQLite database at dbPath, creating it if needed,
+// and migrates its schema
+func NewSQLiteStorage(dbPath string) (*SQLStorage, error) {
+	db, err := openSQLite(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	storage := &SQLiteStorage{db: db}
-	if err := storage.initTables(); err != nil {
+	storage := &SQLStorage{db: &timedDB{DB: db, dialect: dialectSQLite}}
+	if err := storage.migrate(); err != nil {
 		db.Close()
 		return nil, err
 	}
+	storage.checkSearch()
 
 	return storage, nil
 }
 
-// initTables creates the necessary tables
-func (s *SQLiteStorage) initTables() error {
-	queries := []string{
+// openSQLite opens the database file, creating its directory if needed
+func openSQLite(dbPath string) (*sql.DB, error) {
+	// Ensure directory exists
+	dir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Concurrent writers (batch pushes, hub acks) wait for the lock instead of
+	// failing; immediate transactions avoid read-to-write upgrade deadlocks
+	return sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_txlock=immediate")
+}
+
+// SQLite schema of each migration, see migrations.go
+var (
+	sqliteInitialSchema = []string{
 		`CREATE TABLE IF NOT EXISTS devices (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			device_key TEXT UNIQUE NOT NULL,
@@ -66,39 +70,162 @@ func (s *SQLiteStorage) initTables() error {
 			delivered BOOLEAN DEFAULT FALSE,
 			FOREIGN KEY (device_id) REFERENCES devices(id)
 		)`,
+		// Missing from the oldest databases
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS device_type TEXT DEFAULT 'ios'`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS device_token TEXT`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_device_id ON messages(device_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at)`,
-		// Migration: Add new columns to existing tables
-		`ALTER TABLE devices ADD COLUMN device_type TEXT DEFAULT 'ios'`,
-		`ALTER TABLE devices ADD COLUMN device_token TEXT`,
 	}
 
-	for _, query := range queries {
-		// Ignore errors for ALTER TABLE (column may already exist)
-		s.db.Exec(query)
+	sqliteDeviceGroups = []string{
+		`CREATE TABLE IF NOT EXISTS device_groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			token TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS device_group_members (
+			group_id INTEGER NOT NULL,
+			device_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (group_id, device_id),
+			FOREIGN KEY (group_id) REFERENCES device_groups(id),
+			FOREIGN KEY (device_id) REFERENCES devices(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_pushes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			push_id TEXT UNIQUE NOT NULL,
+			group_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (group_id) REFERENCES device_groups(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_push_results (
+			push_id TEXT NOT NULL,
+			device_key TEXT NOT NULL,
+			message_id TEXT,
+			transport TEXT,
+			delivered BOOLEAN DEFAULT FALSE,
+			queued BOOLEAN DEFAULT FALSE,
+			code INTEGER DEFAULT 0,
+			error TEXT,
+			FOREIGN KEY (push_id) REFERENCES group_pushes(push_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_group_members_device_id ON device_group_members(device_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_group_push_results_push_id ON group_push_results(push_id)`,
+	}
+
+	sqliteScheduledMessages = []string{
+		`CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			schedule_id TEXT UNIQUE NOT NULL,
+			device_id INTEGER NOT NULL,
+			message_id TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			send_at DATETIME NOT NULL,
+			status TEXT DEFAULT 'pending',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (device_id) REFERENCES devices(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages(status, send_at)`,
 	}
 
-	return nil
-}
+	sqliteMessageExpiry = []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at DATETIME`,
+	}
 
-// Close closes the database connection
-func (s *SQLiteStorage) Close() error {
-	return s.db.Close()
-}
+	sqliteDeliveryAcks = []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS sent_at DATETIME`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS acked_at DATETIME`,
+	}
+
+	sqliteMessageEvents = []string{
+		`CREATE TABLE IF NOT EXISTS message_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT NOT NULL,
+			device_id INTEGER NOT NULL,
+			state TEXT NOT NULL,
+			reason TEXT,
+			apns_id TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_events_message_id ON message_events(message_id)`,
+	}
+
+	sqliteNotificationIDs = []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS notification_id TEXT`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_notification_id ON messages(device_id, notification_id)`,
+	}
+
+	sqliteLinkedDevices = []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at DATETIME`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS link_id TEXT`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_link_id ON devices(link_id)`,
+	}
+
+	sqliteDedupeKeys = []string{
+		`CREATE TABLE IF NOT EXISTS dedupe_keys (
+			device_id INTEGER NOT NULL,
+			dedupe_key TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			schedule_id TEXT,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			PRIMARY KEY (device_id, dedupe_key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_dedupe_keys_expires_at ON dedupe_keys(expires_at)`,
+	}
+
+	sqliteSubscribeSecrets = []string{
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS subscribe_secret TEXT`,
+	}
+
+	sqliteKeyAliases = []string{
+		`CREATE TABLE IF NOT EXISTS device_key_aliases (
+			old_key TEXT PRIMARY KEY,
+			device_id INTEGER NOT NULL,
+			rotated_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_key_aliases_device_id ON device_key_aliases(device_id)`,
+	}
+
+	sqliteRegistrationAttempts = []string{
+		`CREATE TABLE IF NOT EXISTS registration_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id INTEGER NOT NULL,
+			device_key TEXT NOT NULL,
+			device_type TEXT NOT NULL DEFAULT '',
+			device_token TEXT NOT NULL DEFAULT '',
+			public_key TEXT NOT NULL DEFAULT '',
+			client_ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			resolved_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_registration_attempts_status ON registration_attempts(status)`,
+	}
+
+	sqliteGroupPushSent = []string{
+		`ALTER TABLE group_push_results ADD COLUMN IF NOT EXISTS sent BOOLEAN DEFAULT FALSE`,
+	}
+)
 
 // Device operations
 
 // GetDeviceByKey retrieves a device by its key
-func (s *SQLiteStorage) GetDeviceByKey(deviceKey string) (*model.Device, error) {
+func (s *SQLStorage) GetDeviceByKey(deviceKey string) (*model.Device, error) {
 	device := &model.Device{}
 	err := s.db.QueryRow(
-		`SELECT id, device_key, device_type, device_token, public_key, name, created_at, last_seen 
+		`SELECT id, device_key, device_type, device_token, public_key, COALESCE(subscribe_secret, ''), name, created_at, last_seen 
 		 FROM devices WHERE device_key = ?`,
 		deviceKey,
-	).Scan(&device.ID, &device.DeviceKey, &device.DeviceType, &device.DeviceToken, &device.PublicKey, &device.Name, &device.CreatedAt, &device.LastSeen)
+	).Scan(&device.ID, &device.DeviceKey, &device.DeviceType, &device.DeviceToken, &device.PublicKey, &device.SubscribeSecret, &device.Name, &device.CreatedAt, &device.LastSeen)
 
 	if err == sql.ErrNoRows {
-		return nil, nil
+		// A rotated key keeps working during its grace period
+		return s.getDeviceByAlias(deviceKey)
 	}
 	if err != nil {
 		return nil, err
@@ -106,18 +233,31 @@ func (s *SQLiteStorage) GetDeviceByKey(deviceKey string) (*model.Device, error)
 	return device, nil
 }
 
-// CreateDevice creates a new device
-func (s *SQLiteStorage) CreateDevice(device *model.Device) error {
-	result, err := s.db.Exec(
-		`INSERT INTO devices (device_key, device_type, device_token, public_key, name, created_at, last_seen) 
-		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		device.DeviceKey, device.DeviceType, device.DeviceToken, device.PublicKey, device.Name, time.Now(), time.Now(),
-	)
+// GetDeviceByID retrieves a device by its ID
+func (s *SQLStorage) GetDeviceByID(id int64) (*model.Device, error) {
+	device := &model.Device{}
+	err := s.db.QueryRow(
+		`SELECT id, device_key, device_type, device_token, public_key, COALESCE(subscribe_secret, ''), name, created_at, last_seen 
+		 FROM devices WHERE id = ?`,
+		id,
+	).Scan(&device.ID, &device.DeviceKey, &device.DeviceType, &device.DeviceToken, &device.PublicKey, &device.SubscribeSecret, &device.Name, &device.CreatedAt, &device.LastSeen)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return device, nil
+}
 
-	id, err := result.LastInsertId()
+// CreateDevice creates a new device
+func (s *SQLStorage) CreateDevice(device *model.Device) error {
+	id, err := s.db.Insert(
+		`INSERT INTO devices (device_key, device_type, device_token, public_key, subscribe_secret, name, created_at, last_seen) 
+		 VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?)`,
+		device.DeviceKey, device.DeviceType, device.DeviceToken, device.PublicKey, device.SubscribeSecret, device.Name, time.Now(), time.Now(),
+	)
 	if err != nil {
 		return err
 	}
@@ -126,7 +266,7 @@ func (s *SQLiteStorage) CreateDevice(device *model.Device) error {
 }
 
 // UpdateDevicePublicKey updates the public key for a device
-func (s *SQLiteStorage) UpdateDevicePublicKey(deviceKey, publicKey string) error {
+func (s *SQLStorage) UpdateDevicePublicKey(deviceKey, publicKey string) error {
 	_, err := s.db.Exec(
 		`UPDATE devices SET public_key = ?, last_seen = ? WHERE device_key = ?`,
 		publicKey, time.Now(), deviceKey,
@@ -135,7 +275,7 @@ func (s *SQLiteStorage) UpdateDevicePublicKey(deviceKey, publicKey string) error
 }
 
 // UpdateDeviceLastSeen updates the last seen timestamp
-func (s *SQLiteStorage) UpdateDeviceLastSeen(deviceKey string) error {
+func (s *SQLStorage) UpdateDeviceLastSeen(deviceKey string) error {
 	_, err := s.db.Exec(
 		`UPDATE devices SET last_seen = ? WHERE device_key = ?`,
 		time.Now(), deviceKey,
@@ -144,7 +284,7 @@ func (s *SQLiteStorage) UpdateDeviceLastSeen(deviceKey string) error {
 }
 
 // UpdateDevice updates a device
-func (s *SQLiteStorage) UpdateDevice(device *model.Device) error {
+func (s *SQLStorage) UpdateDevice(device *model.Device) error {
 	_, err := s.db.Exec(
 		`UPDATE devices SET device_type = ?, device_token = ?, public_key = ?, name = ?, last_seen = ? WHERE device_key = ?`,
 		device.DeviceType, device.DeviceToken, device.PublicKey, device.Name, time.Now(), device.DeviceKey,
@@ -152,8 +292,22 @@ func (s *SQLiteStorage) UpdateDevice(device *model.Device) error {
 	return err
 }
 
+// ClaimSubscribeSecret sets the subscriber secret of a device that has none.
+// It reports whether the secret was set.
+func (s *SQLStorage) ClaimSubscribeSecret(deviceID int64, secret string) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE devices SET subscribe_secret = ? WHERE id = ? AND subscribe_secret IS NULL`,
+		secret, deviceID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 // UpdateDeviceToken updates the APNs token for a device
-func (s *SQLiteStorage) UpdateDeviceToken(deviceKey, deviceToken string) error {
+func (s *SQLStorage) UpdateDeviceToken(deviceKey, deviceToken string) error {
 	_, err := s.db.Exec(
 		`UPDATE devices SET device_token = ?, last_seen = ? WHERE device_key = ?`,
 		deviceToken, time.Now(), deviceKey,
@@ -162,7 +316,7 @@ func (s *SQLiteStorage) UpdateDeviceToken(deviceKey, deviceToken string) error {
 }
 
 // CountDevices returns the total number of devices
-func (s *SQLiteStorage) CountDevices() (int, error) {
+func (s *SQLStorage) CountDevices() (int, error) {
 	var count int
 	err := s.db.QueryRow(`SELECT COUNT(*) FROM devices`).Scan(&count)
 	if err != nil {
@@ -173,27 +327,105 @@ func (s *SQLiteStorage) CountDevices() (int, error) {
 
 // Message operations
 
-// CreateMessage stores a new message
-func (s *SQLiteStorage) CreateMessage(msg *model.Message) error {
-	result, err := s.db.Exec(
-		`INSERT INTO messages (device_id, message_id, title, body, group_name, icon, url, sound, badge, encrypted_payload, created_at, delivered) 
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		msg.DeviceID, msg.MessageID, msg.Title, msg.Body, msg.Group, msg.Icon, msg.URL, msg.Sound, msg.Badge, msg.EncryptedPayload, time.Now(), false,
+// CreateMessage stores a new message.
+// It returns a *DuplicateError when the message repeats an earlier one.
+func (s *SQLStorage) CreateMessage(msg *model.Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := claimDedupeKeys(tx, msg.DeviceID, msg.MessageID, "", msg.Dedupe); err != nil {
+		return err
+	}
+	if err := insertMessage(tx, msg); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceMessage stores a new message and deletes older messages of the device
+// with the same notification ID, so only the latest version is kept and replayed.
+// It returns the message IDs of the replaced messages, or a *DuplicateError
+// when the message repeats an earlier one.
+func (s *SQLStorage) ReplaceMessage(msg *model.Message) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := claimDedupeKeys(tx, msg.DeviceID, msg.MessageID, "", msg.Dedupe); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT message_id FROM messages WHERE device_id = ? AND notification_id = ?`,
+		msg.DeviceID, msg.NotificationID,
 	)
 	if err != nil {
+		return nil, err
+	}
+	replaced := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		replaced = append(replaced, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range replaced {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE message_id = ?`, id); err != nil {
+			return nil, err
+		}
+		if err := addMessageEvent(tx, &model.MessageEvent{MessageID: id, DeviceID: msg.DeviceID, State: model.MessageStateReplaced, Reason: msg.MessageID}); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertMessage(tx, msg); err != nil {
+		return nil, err
+	}
+
+	return replaced, tx.Commit()
+}
+
+// insertMessage inserts a message and its stored event within a transaction
+func insertMessage(tx *dbTx, msg *model.Message) error {
+	if err := claimScheduledMessage(tx, msg.ScheduleID); err != nil {
 		return err
 	}
 
-	id, err := result.LastInsertId()
+	msg.CreatedAt = time.Now()
+	var expiresAt interface{}
+	if msg.ExpiresAt != nil {
+		expiresAt = msg.ExpiresAt.UTC()
+	}
+
+	id, err := tx.Insert(
+		`INSERT INTO messages (device_id, message_id, notification_id, title, body, group_name, icon, url, sound, badge, encrypted_payload, created_at, expires_at, delivered) 
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.DeviceID, msg.MessageID, msg.NotificationID, msg.Title, msg.Body, msg.Group, msg.Icon, msg.URL, msg.Sound, msg.Badge, msg.EncryptedPayload, msg.CreatedAt, expiresAt, false,
+	)
 	if err != nil {
 		return err
 	}
+	if err := addMessageEvent(tx, &model.MessageEvent{MessageID: msg.MessageID, DeviceID: msg.DeviceID, State: model.MessageStateStored}); err != nil {
+		return err
+	}
+
 	msg.ID = id
 	return nil
 }
 
 // MarkMessageDelivered marks a message as delivered
-func (s *SQLiteStorage) MarkMessageDelivered(messageID string) error {
+func (s *SQLStorage) MarkMessageDelivered(messageID string) error {
 	_, err := s.db.Exec(
 		`UPDATE messages SET delivered = TRUE WHERE message_id = ?`,
 		messageID,
@@ -201,14 +433,51 @@ func (s *SQLiteStorage) MarkMessageDelivered(messageID string) error {
 	return err
 }
 
-// GetUndeliveredMessages retrieves undelivered messages for a device
-func (s *SQLiteStorage) GetUndeliveredMessages(deviceID int64) ([]*model.Message, error) {
+// MarkMessageSent records that a message of the device was written to a WebSocket connection
+func (s *SQLStorage) MarkMessageSent(deviceID int64, messageID string) error {
+	return s.transition(deviceID, messageID, model.MessageStateSent,
+		`UPDATE messages SET sent_at = ? WHERE message_id = ? AND device_id = ?`)
+}
+
+// MarkMessageAcked marks a message of the device as acked by the client and delivered.
+// Repeated acks are ignored.
+func (s *SQLStorage) MarkMessageAcked(deviceID int64, messageID string) error {
+	return s.transition(deviceID, messageID, model.MessageStateAcked,
+		`UPDATE messages SET delivered = TRUE, acked_at = ? WHERE message_id = ? AND device_id = ? AND acked_at IS NULL`)
+}
+
+// transition runs an update taking (now, messageID, deviceID) and records the
+// lifecycle event if a row changed
+func (s *SQLStorage) transition(deviceID int64, messageID, state, query string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, time.Now(), messageID, deviceID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	if err := addMessageEvent(tx, &model.MessageEvent{MessageID: messageID, DeviceID: deviceID, State: state}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUndeliveredMessages retrieves undelivered messages for a device that have
+// neither expired nor been read on a linked device
+func (s *SQLStorage) GetUndeliveredMessages(deviceID int64) ([]*model.Message, error) {
 	rows, err := s.db.Query(
-		`SELECT id, device_id, message_id, title, body, group_name, icon, url, sound, badge, encrypted_payload, created_at, delivered 
+		`SELECT id, device_id, message_id, COALESCE(notification_id, ''), title, body, group_name, icon, url, sound, badge, encrypted_payload, created_at, expires_at, delivered 
 		 FROM messages 
-		 WHERE device_id = ? AND delivered = FALSE 
+		 WHERE device_id = ? AND delivered = FALSE AND read_at IS NULL AND (expires_at IS NULL OR expires_at > ?) 
 		 ORDER BY created_at ASC`,
-		deviceID,
+		deviceID, time.Now().UTC(),
 	)
 	if err != nil {
 		return nil, err
@@ -219,9 +488,9 @@ func (s *SQLiteStorage) GetUndeliveredMessages(deviceID int64) ([]*model.Message
 	for rows.Next() {
 		msg := &model.Message{}
 		err := rows.Scan(
-			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.Title, &msg.Body,
+			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body,
 			&msg.Group, &msg.Icon, &msg.URL, &msg.Sound, &msg.Badge,
-			&msg.EncryptedPayload, &msg.CreatedAt, &msg.Delivered,
+			&msg.EncryptedPayload, &msg.CreatedAt, &msg.ExpiresAt, &msg.Delivered,
 		)
 		if err != nil {
 			return nil, err
@@ -232,28 +501,83 @@ func (s *SQLiteStorage) GetUndeliveredMessages(deviceID int64) ([]*model.Message
 	return messages, nil
 }
 
-// GetMessageHistory retrieves message history for a device
-func (s *SQLiteStorage) GetMessageHistory(deviceID int64, limit, offset int) ([]*model.Message, error) {
-	rows, err := s.db.Query(
-		`SELECT id, device_id, message_id, title, body, group_name, icon, url, sound, badge, created_at, delivered 
-		 FROM messages 
-		 WHERE device_id = ? 
-		 ORDER BY created_at DESC 
-		 LIMIT ? OFFSET ?`,
-		deviceID, limit, offset,
+// DeleteExpiredMessages deletes undelivered messages of a device that have expired
+func (s *SQLStorage) DeleteExpiredMessages(deviceID int64) (int64, error) {
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Keep an expired event so the message status stays queryable
+	if _, err := tx.Exec(
+		`INSERT INTO message_events (message_id, device_id, state, created_at) 
+		 SELECT message_id, device_id, ?, ? FROM messages 
+		 WHERE device_id = ? AND delivered = FALSE AND expires_at IS NOT NULL AND expires_at <= ?`,
+		model.MessageStateExpired, now, deviceID, now.UTC(),
+	); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(
+		`DELETE FROM messages WHERE device_id = ? AND delivered = FALSE AND expires_at IS NOT NULL AND expires_at <= ?`,
+		deviceID, now.UTC(),
 	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// GetMessageHistory retrieves message history for a device, newest first
+func (s *SQLStorage) GetMessageHistory(deviceID int64, filter *model.HistoryFilter) ([]*model.Message, error) {
+	query := `SELECT id, device_id, message_id, COALESCE(notification_id, ''), title, body, group_name, icon, url, sound, badge, created_at, expires_at, sent_at, acked_at, read_at, delivered 
+		 FROM messages 
+		 WHERE device_id = ?`
+	args := []interface{}{deviceID}
+
+	if filter.Group != "" {
+		query += ` AND group_name = ?`
+		args = append(args, filter.Group)
+	}
+	// created_at is stored in local time
+	if !filter.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, filter.Since.Local())
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, filter.Until.Local())
+	}
+	if filter.Delivered != nil {
+		query += ` AND delivered = ?`
+		args = append(args, *filter.Delivered)
+	}
+	if filter.Before > 0 {
+		query += ` AND id < ?`
+		args = append(args, filter.Before)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []*model.Message
+	messages := []*model.Message{}
 	for rows.Next() {
 		msg := &model.Message{}
 		err := rows.Scan(
-			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.Title, &msg.Body,
+			&msg.ID, &msg.DeviceID, &msg.MessageID, &msg.NotificationID, &msg.Title, &msg.Body,
 			&msg.Group, &msg.Icon, &msg.URL, &msg.Sound, &msg.Badge,
-			&msg.CreatedAt, &msg.Delivered,
+			&msg.CreatedAt, &msg.ExpiresAt, &msg.SentAt, &msg.AckedAt, &msg.ReadAt, &msg.Delivered,
 		)
 		if err != nil {
 			return nil, err
@@ -261,18 +585,74 @@ func (s *SQLiteStorage) GetMessageHistory(deviceID int64, limit, offset int) ([]
 		messages = append(messages, msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
 }
 
-// DeleteOldMessages deletes messages older than the specified duration
-func (s *SQLiteStorage) DeleteOldMessages(olderThan time.Duration) (int64, error) {
-	cutoff := time.Now().Add(-olderThan)
+// DeleteMessage deletes a single message of a device
+func (s *SQLStorage) DeleteMessage(deviceID int64, messageID string) (bool, error) {
 	result, err := s.db.Exec(
-		`DELETE FROM messages WHERE created_at < ?`,
-		cutoff,
+		`DELETE FROM messages WHERE device_id = ? AND message_id = ?`,
+		deviceID, messageID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteMessagesByGroup deletes all messages of a device in a group
+func (s *SQLStorage) DeleteMessagesByGroup(deviceID int64, group string) (int64, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM messages WHERE device_id = ? AND group_name = ?`,
+		deviceID, group,
 	)
 	if err != nil {
 		return 0, err
 	}
 	return result.RowsAffected()
 }
+
+// RecallMessages deletes the messages of a device whose message ID or
+// notification ID equals id, recording a recalled event for each.
+// It returns the removed messages.
+func (s *SQLStorage) RecallMessages(deviceID int64, id string) ([]*model.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT id, message_id, COALESCE(notification_id, '') FROM messages
+		 WHERE device_id = ? AND (message_id = ? OR notification_id = ?)`,
+		deviceID, id, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	messages := []*model.Message{}
+	for rows.Next() {
+		msg := &model.Message{DeviceID: deviceID}
+		if err := rows.Scan(&msg.ID, &msg.MessageID, &msg.NotificationID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE id = ?`, msg.ID); err != nil {
+			return nil, err
+		}
+		if err := addMessageEvent(tx, &model.MessageEvent{MessageID: msg.MessageID, DeviceID: deviceID, State: model.MessageStateRecalled}); err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, tx.Commit()
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abnotify/server/model"
+)
+
+// Storage persists devices, messages and everything derived from them
+type Storage interface {
+	// Devices
+	GetDeviceByKey(deviceKey string) (*model.Device, error)
+	GetDeviceByID(id int64) (*model.Device, error)
+	CreateDevice(device *model.Device) error
+	UpdateDevice(device *model.Device) error
+	UpdateDevicePublicKey(deviceKey, publicKey string) error
+	UpdateDeviceToken(deviceKey, deviceToken string) error
+	UpdateDeviceLastSeen(deviceKey string) error
+	ClaimSubscribeSecret(deviceID int64, secret string) (bool, error)
+	CountDevices() (int, error)
+
+	// Device management
+	ListDeviceStats(deviceType string, limit, offset int) ([]*model.DeviceStats, error)
+	GetDeviceStats(id int64) (*model.DeviceStats, error)
+	RenameDevice(id int64, name string) (bool, error)
+	DeleteDevice(id int64) (int64, error)
+
+	// Device key rotation
+	RotateDeviceKey(deviceID int64, oldKey, newKey string, graceUntil time.Time) error
+
+	// Registration attempts
+	CreateRegistrationAttempt(a *model.RegistrationAttempt) error
+	GetRegistrationAttempt(id int64) (*model.RegistrationAttempt, error)
+	ListRegistrationAttempts(status string, limit int) ([]*model.RegistrationAttempt, error)
+	ResolveRegistrationAttempt(id int64, status string) (bool, error)
+	DeleteOldRegistrationAttempts(olderThan time.Duration) (int64, error)
+
+	// Messages
+	CreateMessage(msg *model.Message) error
+	ReplaceMessage(msg *model.Message) ([]string, error)
+	MarkMessageDelivered(messageID string) error
+	MarkMessageSent(deviceID int64, messageID string) error
+	MarkMessageAcked(deviceID int64, messageID string) error
+	GetUndeliveredMessages(deviceID int64) ([]*model.Message, error)
+	CountQueuedMessages() (int, error)
+	DeleteExpiredMessages(deviceID int64) (int64, error)
+	GetMessageHistory(deviceID int64, filter *model.HistoryFilter) ([]*model.Message, error)
+	SearchMessages(deviceID int64, query, group string, limit, offset int) ([]*model.SearchResult, error)
+	DeleteMessage(deviceID int64, messageID string) (bool, error)
+	DeleteMessagesByGroup(deviceID int64, group string) (int64, error)
+	RecallMessages(deviceID int64, id string) ([]*model.Message, error)
+
+	// Message events
+	AddMessageEvent(event *model.MessageEvent) error
+	GetMessageEvents(messageID string) ([]*model.MessageEvent, error)
+	GetMessageDelivered(messageID string) (delivered bool, found bool, err error)
+	GetGroupTokensForMessage(messageID string) ([]string, error)
+
+	// Deduplication
+	DeleteExpiredDedupeKeys() (int64, error)
+
+	// Device links and read state
+	GetDeviceLink(deviceID int64) (string, error)
+	SetDeviceLink(deviceID int64, token string) error
+	GetLinkedDevices(token string) ([]*model.Device, error)
+	MarkMessageRead(deviceID int64, messageID string) (*model.Message, bool, error)
+	MarkMatchingMessagesRead(deviceID int64, src *model.Message, window time.Duration) ([]*model.Message, error)
+
+	// Groups
+	CreateGroup(group *model.DeviceGroup) error
+	GetGroupByName(name string) (*model.DeviceGroup, error)
+	GetGroupMembers(groupID int64) ([]string, error)
+	AddGroupMember(groupID, deviceID int64) error
+	RemoveGroupMember(groupID, deviceID int64) (bool, error)
+	DeleteGroup(groupID int64) error
+	SaveGroupPush(groupID int64, push *model.GroupPush) error
+	GetGroupPush(groupID int64, pushID string) (*model.GroupPush, error)
+
+	// Scheduled messages
+	CreateScheduledMessage(sm *model.ScheduledMessage) error
+	GetScheduledMessage(scheduleID string) (*model.ScheduledMessage, error)
+	GetPendingScheduledMessages(deviceID int64) ([]*model.ScheduledMessage, error)
+	GetDueScheduledMessages(now time.Time, limit int) ([]*model.ScheduledMessage, error)
+	UpdateScheduledMessageStatus(scheduleID, from, to string) (bool, error)
+
+	// Retention
+	DeleteOldMessages(olderThan time.Duration, keepUndelivered bool, excludeGroups ...string) (int64, error)
+	DeleteOldGroupMessages(group string, olderThan time.Duration, keepUndelivered bool) (int64, error)
+	TrimDeviceMessages(max int, keepUndelivered bool) (int64, error)
+	DeleteOldMessageEvents(olderThan time.Duration) (int64, error)
+	Optimize() error
+	Vacuum() error
+
+	Close() error
+}
+
+// Supported database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Open opens the storage of the given driver. dsn is the database file for
+// SQLite and the connection URL for PostgreSQL.
+func Open(driver, dsn string) (Storage, error) {
+	var s *SQLStorage
+	var err error
+	switch driver {
+	case DriverSQLite, "":
+		s, err = NewSQLiteStorage(dsn)
+	case DriverPostgres:
+		s, err = NewPostgresStorage(dsn)
+	default:
+		err = fmt.Errorf("unsupported database driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SQLStorage implements Storage on SQLite or PostgreSQL
+type SQLStorage struct {
+	db  *timedDB
+	fts bool // FTS5 search index available
+}
+
+var _ Storage = (*SQLStorage)(nil)
+
+// Close closes the database connection
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}